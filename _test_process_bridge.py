@@ -0,0 +1,125 @@
+import io
+import struct
+import unittest
+
+import process_bridge
+from process_bridge import packb, unpackb
+
+
+class PackTest(unittest.TestCase):
+
+    def test_pack(self):
+        cases = [
+            (None, b'\xc0'),
+            (True, b'\xc3'),
+            (False, b'\xc2'),
+            (1, b'\xd3' + struct.pack('>q', 1)),
+            (-1, b'\xd3' + struct.pack('>q', -1)),
+            (2 ** 63, b'\xcf' + struct.pack('>Q', 2 ** 63)),
+            (1.5, b'\xcb' + struct.pack('>d', 1.5)),
+            (u'a', b'\xa1a'),
+            (u'a' * 32, b'\xd9\x20' + b'a' * 32),
+            (u'a' * 256, b'\xda\x01\x00' + b'a' * 256),
+            (u'\u3042', b'\xa3\xe3\x81\x82'),
+            # bytes of Python 2 are str, so binaries are given as bytearray
+            (bytearray(b'\x00\x01'), b'\xc4\x02\x00\x01'),
+            (bytearray(256), b'\xc5\x01\x00' + b'\x00' * 256),
+            ([1, u'a'], b'\x92\xd3' + struct.pack('>q', 1) + b'\xa1a'),
+            ((None,), b'\x91\xc0'),
+            ([None] * 16, b'\xdc\x00\x10' + b'\xc0' * 16),
+            ({u'a': None}, b'\x81\xa1a\xc0'),
+        ]
+        for v, b in cases:
+            self.assertEqual(packb(v), b, repr(v))
+
+    def test_pack_out_of_range(self):
+        self.assertRaises(ValueError, packb, 2 ** 64)
+        self.assertRaises(ValueError, packb, -2 ** 63 - 1)
+
+    def test_pack_unsupported(self):
+        self.assertRaises(TypeError, packb, object())
+
+    def test_pack_tolist(self):
+        class Array(object):
+            def tolist(self):
+                return [1, 2]
+        self.assertEqual(packb(Array()), packb([1, 2]))
+
+
+class UnpackTest(unittest.TestCase):
+
+    def test_unpack(self):
+        cases = [
+            (b'\xc0', None),
+            (b'\xc3', True),
+            (b'\xc2', False),
+            (b'\x7f', 127),
+            (b'\xff', -1),
+            (b'\xe0', -32),
+            (b'\xcc\x80', 128),
+            (b'\xcd\x01\x00', 256),
+            (b'\xce\x00\x01\x00\x00', 65536),
+            (b'\xcf' + struct.pack('>Q', 2 ** 63), 2 ** 63),
+            (b'\xd0\xdf', -33),
+            (b'\xd1\xff\x7f', -129),
+            (b'\xd2' + struct.pack('>i', -2 ** 31), -2 ** 31),
+            (b'\xd3' + struct.pack('>q', -2 ** 63), -2 ** 63),
+            (b'\xca' + struct.pack('>f', 1.5), 1.5),
+            (b'\xcb' + struct.pack('>d', 1.5), 1.5),
+            (b'\xa1a', u'a'),
+            (b'\xd9\x01a', u'a'),
+            (b'\xda\x00\x01a', u'a'),
+            (b'\xdb\x00\x00\x00\x01a', u'a'),
+            (b'\xa3\xe3\x81\x82', u'\u3042'),
+            (b'\xc4\x01\x00', b'\x00'),
+            (b'\xc5\x00\x01\x00', b'\x00'),
+            (b'\xc6\x00\x00\x00\x01\x00', b'\x00'),
+            (b'\x92\x01\xc0', [1, None]),
+            (b'\xdc\x00\x01\x01', [1]),
+            (b'\xdd\x00\x00\x00\x01\x01', [1]),
+            (b'\x81\xa1a\x01', {u'a': 1}),
+            (b'\xde\x00\x01\xa1a\x01', {u'a': 1}),
+            (b'\xdf\x00\x00\x00\x01\xa1a\x01', {u'a': 1}),
+            (b'\xd4\x01\x02', b'\x02'),
+            (b'\xc7\x02\x01\x02\x03', b'\x02\x03'),
+        ]
+        for b, v in cases:
+            self.assertEqual(unpackb(b), v, repr(b))
+
+    def test_unpack_truncated(self):
+        for b in [b'\xcd\x01', b'\xa2a', b'\x92\x01', b'\xc4\x02\x00']:
+            self.assertRaises(ValueError, unpackb, b)
+
+    def test_unpack_unsupported(self):
+        self.assertRaises(ValueError, unpackb, b'\xc1')
+
+    def test_round_trip(self):
+        v = {u'a': [1, -1, 1.5, u'\u3042', b'\x00', None, True, False],
+             u'b': {u'c': [u'x' * 40, b'\x01' * 300]}}
+        self.assertEqual(unpackb(packb(v)), v)
+
+
+class FrameTest(unittest.TestCase):
+
+    def test_write_and_read_frame(self):
+        f = io.BytesIO()
+        process_bridge.write_frame(f, {u'method': u'save'}, b'model')
+        process_bridge.write_frame(f, {u'result': None})
+        f.seek(0)
+        self.assertEqual(process_bridge.read_frame(f),
+                         ({u'method': u'save'}, b'model'))
+        self.assertEqual(process_bridge.read_frame(f),
+                         ({u'result': None}, b''))
+        self.assertEqual(process_bridge.read_frame(f), (None, None))
+
+    def test_read_truncated_frame(self):
+        f = io.BytesIO()
+        process_bridge.write_frame(f, {u'a': 1}, b'model')
+        b = f.getvalue()
+        msg, attachment = process_bridge.read_frame(io.BytesIO(b[:-1]))
+        self.assertEqual(msg, {u'a': 1})
+        self.assertIsNone(attachment)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -1,3 +1,5 @@
+import time
+
 import six
 
 
@@ -21,9 +23,42 @@ class TestClass(object):
     def predict(self, data):
         return 'predict called'
 
+    def score(self, data):
+        return 1.0 / (self.cnt + 1)
+
     def save(self, filepath, *args, **kwargs):
         with open(filepath, 'w') as f:
             six.moves.cPickle.dump(self, f)
 
     def confirm_to_call_fit(self):
         return self.cnt
+
+
+class ConstantScoreClass(TestClass):
+
+    @staticmethod
+    def create():
+        self = ConstantScoreClass()
+        self.cnt = 0
+        return self
+
+    def score(self, data):
+        return {'loss': 1.0}
+
+
+class SlowClass(TestClass):
+
+    @staticmethod
+    def create(delay=0):
+        self = SlowClass()
+        self.cnt = 0
+        self.delay = delay
+        return self
+
+    def fit(self, data):
+        time.sleep(self.delay)
+        return super(SlowClass, self).fit(data)
+
+    def predict(self, data):
+        time.sleep(self.delay)
+        return super(SlowClass, self).predict(data)
@@ -0,0 +1,78 @@
+import os
+import pickle
+import time
+
+
+class ProcessTestClass(object):
+
+    @staticmethod
+    def create(**kwargs):
+        self = ProcessTestClass()
+        self.cnt = 0
+        self.params = kwargs
+        return self
+
+    @staticmethod
+    def load(filepath, *args, **kwargs):
+        with open(filepath, 'rb') as f:
+            return pickle.load(f)
+
+    def save(self, filepath, *args, **kwargs):
+        time.sleep(self.params.get('save_delay', 0))
+        with open(filepath, 'wb') as f:
+            pickle.dump(self, f)
+
+    def fit(self, data):
+        if any(isinstance(d, dict) and d.get('fail') for d in data):
+            raise ValueError('failed')
+        self.cnt += 1
+        return 'fit called'
+
+    def predict(self, data):
+        time.sleep(self.params.get('delay', 0))
+        if data == self.params.get('failing_input', 'error'):
+            raise ValueError('failed')
+        return data
+
+    def score(self, data):
+        time.sleep(self.params.get('delay', 0))
+        return len(data)
+
+    def confirm_to_call_fit(self):
+        return self.cnt
+
+    def param(self, name):
+        return self.params.get(name)
+
+    def sleep(self, sec):
+        time.sleep(sec)
+
+    def crash(self):
+        os._exit(1)
+
+    def fail(self):
+        raise ValueError('failed')
+
+
+class RequiredArgsTestClass(object):
+
+    @staticmethod
+    def create(name):
+        self = RequiredArgsTestClass()
+        self.name = name
+        return self
+
+    @staticmethod
+    def load(filepath, *args, **kwargs):
+        with open(filepath, 'rb') as f:
+            return pickle.load(f)
+
+    def save(self, filepath, *args, **kwargs):
+        with open(filepath, 'wb') as f:
+            pickle.dump(self, f)
+
+    def fit(self, data):
+        return 'fit called'
+
+    def predict(self, data):
+        return self.name
@@ -0,0 +1,198 @@
+// Package archive reads and writes states saved by pymlstate without
+// SensorBee nor Python so that trained models can be inspected and moved
+// between environments. A saved state has MLParams encoded in msgpack and a
+// payload of the Python model saved by pystate.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// LegacyFormatVersion is the version byte of the format preceding
+	// containers. It's followed by the size of MLParams in uint32 little
+	// endian, MLParams, and the payload of the model.
+	LegacyFormatVersion uint8 = 1
+
+	// ParamsSection is the name of the section having MLParams.
+	ParamsSection = "params"
+
+	// ModelSection is the name of the section having the payload of the
+	// Python model.
+	ModelSection = "model"
+)
+
+// Archive is a saved state.
+type Archive struct {
+	// Header is the header of the container. It's nil when the state is in
+	// the legacy format.
+	Header *container.Header
+
+	// Params is MLParams encoded in msgpack.
+	Params []byte
+
+	// Model is the payload of the Python model.
+	Model []byte
+}
+
+// Read reads a saved state in the container format or the legacy format.
+// key is required when the state is encrypted.
+func Read(r io.Reader, key []byte) (*Archive, error) {
+	var v [1]byte
+	if _, err := io.ReadFull(r, v[:]); err != nil {
+		return nil, fmt.Errorf("cannot read the format version: %v", err)
+	}
+
+	switch v[0] {
+	case LegacyFormatVersion:
+		return readLegacy(r)
+	case container.Magic[0]:
+		return readContainer(io.MultiReader(bytes.NewReader(v[:]), r), key)
+	default:
+		return nil, fmt.Errorf("unsupported format version of State container: %v", v[0])
+	}
+}
+
+// ReadFile reads a saved state from a file.
+func ReadFile(path string, key []byte) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(bufio.NewReader(f), key)
+}
+
+// requiredSections are sections which a state container must have.
+var requiredSections = []string{ParamsSection, ModelSection}
+
+// readLegacyParamsSize reads the size of MLParams following the version byte
+// of the legacy format.
+func readLegacyParamsSize(r io.Reader) (uint32, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, fmt.Errorf("cannot read the size of MLParams: %v", err)
+	}
+	if size == 0 {
+		return 0, errors.New("size of MLParams must be greater than 0")
+	}
+	return size, nil
+}
+
+func readLegacy(r io.Reader) (*Archive, error) {
+	size, err := readLegacyParamsSize(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		Params: make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, a.Params); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("cannot read MLParams: %v", err)
+	}
+	m, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	a.Model = m
+	return a, nil
+}
+
+func readContainer(r io.Reader, key []byte) (*Archive, error) {
+	h, err := container.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		Header: h,
+	}
+	found := map[string]bool{}
+	for i := range h.Entries {
+		e := &h.Entries[i]
+		d, err := container.ReadSection(r, e)
+		if err != nil {
+			return nil, err
+		}
+		if d, err = container.Decode(e, d, key); err != nil {
+			return nil, err
+		}
+		switch e.Name {
+		case ParamsSection:
+			a.Params = d
+		case ModelSection:
+			a.Model = d
+		}
+		found[e.Name] = true
+	}
+	for _, name := range requiredSections {
+		if !found[name] {
+			return nil, missingSection(name)
+		}
+	}
+	return a, nil
+}
+
+func missingSection(name string) error {
+	return fmt.Errorf("state container doesn't have '%v' section", name)
+}
+
+// DecodeParams decodes MLParams into a map.
+func (a *Archive) DecodeParams() (data.Map, error) {
+	m, err := data.UnmarshalMsgpack(a.Params)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode MLParams: %v", err)
+	}
+	return m, nil
+}
+
+// Write writes the state in the container format. The container is encoded
+// as opts specifies, and opts can be nil.
+func (a *Archive) Write(w io.Writer, opts *container.Options) error {
+	if len(a.Params) == 0 {
+		return errors.New("MLParams must not be empty")
+	}
+	return container.Write(w, []container.Section{
+		{Name: ParamsSection, Data: a.Params},
+		{Name: ModelSection, Data: a.Model},
+	}, opts)
+}
+
+// WriteFile writes the state to a file in the container format. The file is
+// replaced only after the whole state is written.
+func (a *Archive) WriteFile(path string, opts *container.Options) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := a.Write(w, opts); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
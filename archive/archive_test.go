@@ -0,0 +1,108 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	Convey("Given a saved state", t, func() {
+		params, err := data.MarshalMsgpack(data.Map{
+			"batch_train_size": data.Int(10),
+		})
+		So(err, ShouldBeNil)
+		a := &Archive{
+			Params: params,
+			Model:  []byte("pickled model"),
+		}
+		key := bytes.Repeat([]byte{5}, 16)
+
+		Convey("When write it compressed and encrypted", func() {
+			buf := bytes.NewBuffer(nil)
+			So(a.Write(buf, &container.Options{
+				Compression: container.CompressionGzip,
+				Key:         key,
+			}), ShouldBeNil)
+
+			Convey("Then it should be read with the key", func() {
+				b, err := Read(buf, key)
+				So(err, ShouldBeNil)
+				So(b.Header, ShouldNotBeNil)
+				So(b.Header.Entries[0].Flags, ShouldEqual,
+					container.FlagGzip|container.FlagAESGCM)
+				So(b.Params, ShouldResemble, a.Params)
+				So(b.Model, ShouldResemble, a.Model)
+
+				m, err := b.DecodeParams()
+				So(err, ShouldBeNil)
+				So(m["batch_train_size"], ShouldEqual, data.Int(10))
+			})
+		})
+
+		Convey("When write it in the legacy format", func() {
+			buf := bytes.NewBuffer(nil)
+			buf.WriteByte(LegacyFormatVersion)
+			binary.Write(buf, binary.LittleEndian, uint32(len(params)))
+			buf.Write(params)
+			buf.Write(a.Model)
+
+			Convey("Then it should be read", func() {
+				b, err := Read(buf, nil)
+				So(err, ShouldBeNil)
+				So(b.Header, ShouldBeNil)
+				So(b.Params, ShouldResemble, a.Params)
+				So(b.Model, ShouldResemble, a.Model)
+			})
+		})
+
+		Convey("When write it to a file", func() {
+			dir, err := ioutil.TempDir("", "pymlstate_archive_test")
+			So(err, ShouldBeNil)
+			Reset(func() {
+				os.RemoveAll(dir)
+			})
+			path := filepath.Join(dir, "state")
+			So(a.WriteFile(path, nil), ShouldBeNil)
+
+			Convey("Then it should be read from the file", func() {
+				b, err := ReadFile(path, nil)
+				So(err, ShouldBeNil)
+				So(b.Model, ShouldResemble, a.Model)
+			})
+
+			Convey("Then no temporary file should be left", func() {
+				fs, err := ioutil.ReadDir(dir)
+				So(err, ShouldBeNil)
+				So(len(fs), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When write a container without the model", func() {
+			buf := bytes.NewBuffer(nil)
+			So(container.Write(buf, []container.Section{
+				{Name: ParamsSection, Data: params},
+			}, nil), ShouldBeNil)
+
+			Convey("Then it should not be read", func() {
+				_, err := Read(buf, nil)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, ModelSection)
+			})
+		})
+
+		Convey("When read data of an unknown format", func() {
+			_, err := Read(bytes.NewReader([]byte{0xff, 0, 0}), nil)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,322 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Report is a result of inspecting a saved state.
+type Report struct {
+	// FileSize is the size of the file.
+	FileSize int64
+
+	// Legacy is true when the state is in the legacy format.
+	Legacy bool
+
+	// Header is the header of the container. It's nil when the state is in
+	// the legacy format or the header cannot be read.
+	Header *container.Header
+
+	// HeaderSize is the number of bytes of the header including the magic
+	// number and the section table.
+	HeaderSize int64
+
+	// Sections has results of sections in the order of the file.
+	Sections []SectionReport
+
+	// Params is decoded MLParams. It's nil when they cannot be read.
+	Params data.Map
+
+	// Problems has descriptions of problems found in the state. The state
+	// can be loaded when it's empty.
+	Problems []string
+}
+
+// SectionReport is a result of inspecting a section.
+type SectionReport struct {
+	// Name is the name of the section.
+	Name string
+
+	// Flags is the encoding of the section.
+	Flags uint8
+
+	// Offset is the offset of the section from the beginning of the file.
+	Offset int64
+
+	// Size is the size of the section in the file.
+	Size int64
+
+	// DecodedSize is the size of the section after it's decoded. It's -1 when
+	// the section cannot be decoded.
+	DecodedSize int64
+}
+
+// OK returns true when no problem is found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Inspect inspects a saved state without loading the model. It validates the
+// format version, checksums, and sizes of sections against the size of the
+// file, and reports where the state is truncated or corrupted. key is
+// required to decode encrypted sections. It only returns an error when the
+// file cannot be opened.
+func Inspect(path string, key []byte) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return InspectReaderAt(f, info.Size(), key), nil
+}
+
+// InspectReaderAt inspects a saved state having size bytes in r. See Inspect
+// for details. Sections are parsed by the same functions as Read, and the
+// state is finally read by Read so that a state is reported ok only when Read
+// accepts it.
+func InspectReaderAt(r io.ReaderAt, size int64, key []byte) *Report {
+	rep := &Report{
+		FileSize: size,
+	}
+	if size == 0 {
+		rep.problem("file is empty")
+		return rep
+	}
+
+	var v [1]byte
+	if _, err := r.ReadAt(v[:], 0); err != nil {
+		rep.problem("cannot read the format version: %v", err)
+		return rep
+	}
+	switch v[0] {
+	case LegacyFormatVersion:
+		rep.Legacy = true
+		inspectLegacy(rep, r)
+	case container.Magic[0]:
+		inspectContainer(rep, r, key)
+	default:
+		rep.problem("unsupported format version at offset 0: 0x%02x", v[0])
+	}
+
+	if rep.OK() {
+		if _, err := Read(io.NewSectionReader(r, 0, size), key); err != nil {
+			rep.problem("cannot be read: %v", err)
+		}
+	}
+	return rep
+}
+
+func inspectLegacy(rep *Report, r io.ReaderAt) {
+	body := func() io.Reader {
+		return io.NewSectionReader(r, 1, rep.FileSize-1)
+	}
+	size, err := readLegacyParamsSize(body())
+	if err != nil {
+		rep.problem("invalid MLParams at offset 1: %v", err)
+		return
+	}
+
+	params := SectionReport{
+		Name:        ParamsSection,
+		Offset:      5,
+		Size:        int64(size),
+		DecodedSize: int64(size),
+	}
+	if end := params.Offset + params.Size; end > rep.FileSize {
+		rep.problem("truncated in MLParams: %v bytes at offset %v are expected but the file ends at %v (%v bytes missing)",
+			size, params.Offset, rep.FileSize, end-rep.FileSize)
+		params.DecodedSize = -1
+		rep.Sections = append(rep.Sections, params)
+		return
+	}
+	a, err := readLegacy(body())
+	if err != nil {
+		rep.problem("%v", err)
+		return
+	}
+	rep.Sections = append(rep.Sections, params, SectionReport{
+		Name:        ModelSection,
+		Offset:      params.Offset + params.Size,
+		Size:        int64(len(a.Model)),
+		DecodedSize: int64(len(a.Model)),
+	})
+	decodeParams(rep, a.Params)
+
+	// the legacy format doesn't have the size nor checksums of the model
+	if len(a.Model) == 0 {
+		rep.problem("the model is empty, the file may be truncated at offset %v",
+			params.Offset+params.Size)
+	}
+}
+
+func inspectContainer(rep *Report, r io.ReaderAt, key []byte) {
+	cr := &countingReader{r: io.NewSectionReader(r, 0, rep.FileSize)}
+	h, err := container.ReadHeader(cr)
+	if err != nil {
+		rep.problem("invalid header at offset %v: %v", cr.n, err)
+		return
+	}
+	rep.Header = h
+	rep.HeaderSize = cr.n
+
+	offset := rep.HeaderSize
+	found := map[string]bool{}
+	for i := range h.Entries {
+		e := &h.Entries[i]
+		found[e.Name] = true
+		s := SectionReport{
+			Name:        e.Name,
+			Flags:       e.Flags,
+			Offset:      offset,
+			Size:        int64(e.Size),
+			DecodedSize: -1,
+		}
+		offset += s.Size
+		rep.Sections = append(rep.Sections, s)
+		sr := &rep.Sections[len(rep.Sections)-1]
+
+		if s.Offset+s.Size > rep.FileSize {
+			missing := s.Offset + s.Size - rep.FileSize
+			if s.Offset >= rep.FileSize {
+				rep.problem("truncated before section '%v': it's expected at offset %v but the file ends at %v (%v bytes missing)",
+					s.Name, s.Offset, rep.FileSize, missing)
+			} else {
+				rep.problem("truncated in section '%v': %v bytes at offset %v are expected but the file ends at %v (%v bytes missing)",
+					s.Name, s.Size, s.Offset, rep.FileSize, missing)
+			}
+			continue
+		}
+
+		d, err := container.ReadSection(io.NewSectionReader(r, s.Offset, s.Size), e)
+		if err != nil {
+			rep.problem("section '%v' at offset %v: %v", s.Name, s.Offset, err)
+			continue
+		}
+		if d, err = container.Decode(e, d, key); err != nil {
+			rep.problem("section '%v' at offset %v: %v", s.Name, s.Offset, err)
+			continue
+		}
+		sr.DecodedSize = int64(len(d))
+		if s.Name == ParamsSection {
+			decodeParams(rep, d)
+		}
+	}
+
+	for _, name := range requiredSections {
+		if !found[name] {
+			rep.problem("%v", missingSection(name))
+		}
+	}
+	if offset < rep.FileSize {
+		rep.problem("%v extra bytes after the last section at offset %v",
+			rep.FileSize-offset, offset)
+	}
+}
+
+func decodeParams(rep *Report, d []byte) {
+	m, err := (&Archive{Params: d}).DecodeParams()
+	if err != nil {
+		rep.problem("%v", err)
+		return
+	}
+	rep.Params = m
+}
+
+// countingReader counts bytes read to report offsets of errors.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// FlagNames returns names of flags of a section separated by commas.
+func FlagNames(f uint8) string {
+	var names []string
+	if f&container.FlagGzip != 0 {
+		names = append(names, "gzip")
+		f &^= container.FlagGzip
+	}
+	if f&container.FlagAESGCM != 0 {
+		names = append(names, "aes-gcm")
+		f &^= container.FlagAESGCM
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("unknown(0x%02x)", f))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// String returns a human readable report.
+func (r *Report) String() string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "file size: %v bytes\n", r.FileSize)
+	switch {
+	case r.Legacy:
+		fmt.Fprintf(buf, "format: legacy (version %v)\n", LegacyFormatVersion)
+	case r.Header != nil:
+		fmt.Fprintf(buf, "format: container (version %v)\n", r.Header.Version)
+		fmt.Fprintf(buf, "header: %v bytes\n", r.HeaderSize)
+	}
+
+	if len(r.Sections) > 0 {
+		fmt.Fprintln(buf, "sections:")
+		for i, s := range r.Sections {
+			decoded := "unavailable"
+			if s.DecodedSize >= 0 {
+				decoded = fmt.Sprint(s.DecodedSize)
+			}
+			fmt.Fprintf(buf, "  %v: offset=%v size=%v decoded_size=%v flags=%v",
+				s.Name, s.Offset, s.Size, decoded, FlagNames(s.Flags))
+			if r.Header != nil {
+				// sections of a container are in the order of the header
+				e := &r.Header.Entries[i]
+				fmt.Fprintf(buf, " crc32=%08x sha256=%x", e.CRC32, e.SHA256)
+			}
+			fmt.Fprintln(buf)
+		}
+	}
+
+	if r.Params != nil {
+		fmt.Fprintln(buf, "MLParams:")
+		keys := make([]string, 0, len(r.Params))
+		for k := range r.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "  %v: %v\n", k, r.Params[k])
+		}
+	}
+
+	if r.OK() {
+		fmt.Fprintln(buf, "status: ok")
+	} else {
+		fmt.Fprintln(buf, "problems:")
+		for _, p := range r.Problems {
+			fmt.Fprintf(buf, "  %v\n", p)
+		}
+	}
+	return buf.String()
+}
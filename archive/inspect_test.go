@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	Convey("Given a saved state", t, func() {
+		params, err := data.MarshalMsgpack(data.Map{
+			"batch_train_size": data.Int(10),
+		})
+		So(err, ShouldBeNil)
+		a := &Archive{
+			Params: params,
+			Model:  []byte("pickled model"),
+		}
+		buf := bytes.NewBuffer(nil)
+		So(a.Write(buf, nil), ShouldBeNil)
+		b := buf.Bytes()
+		modelOffset := int64(len(b) - len(a.Model))
+
+		Convey("When inspect it", func() {
+			rep := InspectReaderAt(bytes.NewReader(b), int64(len(b)), nil)
+
+			Convey("Then it should have no problem", func() {
+				So(rep.OK(), ShouldBeTrue)
+				So(rep.Header.Version, ShouldEqual, container.Version)
+				So(rep.HeaderSize, ShouldEqual, modelOffset-int64(len(params)))
+				So(rep.Params["batch_train_size"], ShouldEqual, data.Int(10))
+				So(len(rep.Sections), ShouldEqual, 2)
+				So(rep.Sections[1].Offset, ShouldEqual, modelOffset)
+				So(rep.Sections[1].DecodedSize, ShouldEqual, len(a.Model))
+				So(rep.String(), ShouldContainSubstring, "status: ok")
+			})
+		})
+
+		Convey("When inspect it truncated in the model", func() {
+			rep := InspectReaderAt(bytes.NewReader(b), int64(len(b)-3), nil)
+
+			Convey("Then it should report where it's truncated", func() {
+				So(rep.OK(), ShouldBeFalse)
+				So(rep.Problems[0], ShouldContainSubstring, "truncated in section 'model'")
+				So(rep.Problems[0], ShouldContainSubstring, "3 bytes missing")
+				So(rep.Params, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When inspect it truncated in the header", func() {
+			rep := InspectReaderAt(bytes.NewReader(b), 12, nil)
+
+			Convey("Then it should report the header is truncated", func() {
+				So(rep.OK(), ShouldBeFalse)
+				So(rep.Problems[0], ShouldContainSubstring, "invalid header at offset 12")
+				So(rep.Problems[0], ShouldContainSubstring, "truncated")
+			})
+		})
+
+		Convey("When inspect it corrupted in the model", func() {
+			b[len(b)-1] ^= 0xff
+			rep := InspectReaderAt(bytes.NewReader(b), int64(len(b)), nil)
+
+			Convey("Then it should report the corrupted section", func() {
+				So(rep.OK(), ShouldBeFalse)
+				So(len(rep.Problems), ShouldEqual, 1)
+				So(rep.Problems[0], ShouldContainSubstring, "section 'model'")
+				So(rep.Problems[0], ShouldContainSubstring, "corrupted")
+			})
+		})
+
+		Convey("When inspect it having extra bytes", func() {
+			b = append(b, 0, 0)
+			rep := InspectReaderAt(bytes.NewReader(b), int64(len(b)), nil)
+
+			Convey("Then it should report them", func() {
+				So(rep.OK(), ShouldBeFalse)
+				So(rep.Problems[0], ShouldContainSubstring, "2 extra bytes")
+			})
+		})
+
+		Convey("When inspect it in the legacy format", func() {
+			buf := bytes.NewBuffer(nil)
+			buf.WriteByte(LegacyFormatVersion)
+			binary.Write(buf, binary.LittleEndian, uint32(len(params)))
+			buf.Write(params)
+			buf.Write(a.Model)
+			b := buf.Bytes()
+
+			Convey("Then it should have no problem", func() {
+				rep := InspectReaderAt(bytes.NewReader(b), int64(len(b)), nil)
+				So(rep.OK(), ShouldBeTrue)
+				So(rep.Legacy, ShouldBeTrue)
+				So(rep.Sections[1].Size, ShouldEqual, len(a.Model))
+			})
+
+			Convey("Then it should report truncated MLParams", func() {
+				rep := InspectReaderAt(bytes.NewReader(b), 7, nil)
+				So(rep.OK(), ShouldBeFalse)
+				So(rep.Problems[0], ShouldContainSubstring, "truncated in MLParams")
+			})
+		})
+
+		Convey("When inspect data of an unknown format", func() {
+			rep := InspectReaderAt(bytes.NewReader([]byte{0xff}), 1, nil)
+
+			Convey("Then it should report the format version", func() {
+				So(rep.OK(), ShouldBeFalse)
+				So(rep.Problems[0], ShouldContainSubstring, "unsupported format version")
+			})
+		})
+	})
+}
@@ -0,0 +1,286 @@
+// Package batch provides a bucket state and UDSFs to assemble mini-batches
+// for training pymlstate from a stream of tuples.
+package batch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	bucketSizePath  = data.MustCompilePath("bucket_size")
+	outputFieldPath = data.MustCompilePath("output_field")
+	poolPath        = data.MustCompilePath("pool")
+)
+
+// BucketStateCreator creates or loads a shared state, which manages a bucket
+// to train & predict.
+type BucketStateCreator struct {
+}
+
+var _ udf.UDSLoader = &BucketStateCreator{}
+
+// CreateState creates a bucket state.
+//
+// bucket_size:  a bucket size, required
+//
+// output_field: a field name of the bucket in tuples emitted by the UDSF
+// created by CreateBucketStoreUDSF, "bucket" by default
+func (c *BucketStateCreator) CreateState(ctx *core.Context, params data.Map) (
+	core.SharedState, error) {
+	bucketSize := 0
+	if bs, err := params.Get(bucketSizePath); err != nil {
+		return nil, err
+	} else if size, err := data.AsInt(bs); err != nil {
+		return nil, err
+	} else if size <= 0 {
+		return nil, errors.New("bucket_size must be greater than 0")
+	} else {
+		bucketSize = int(size)
+	}
+
+	outputField := "bucket"
+	if of, err := params.Get(outputFieldPath); err == nil {
+		if outputField, err = data.AsString(of); err != nil {
+			return nil, err
+		}
+		if outputField == "" {
+			return nil, errors.New("output_field must not be empty")
+		}
+	}
+
+	return &dataBucket{
+		bucketSize:  bucketSize,
+		outputField: outputField,
+		pool:        make(data.Array, 0, bucketSize),
+	}, nil
+}
+
+// LoadState loads a bucket state saved by SAVE STATE including data stored in
+// the bucket.
+func (c *BucketStateCreator) LoadState(ctx *core.Context, r io.Reader,
+	params data.Map) (core.SharedState, error) {
+	b := &dataBucket{}
+	if err := b.load(r); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type dataBucket struct {
+	bucketSize  int
+	outputField string
+
+	pool data.Array
+	mu   sync.Mutex
+}
+
+var _ core.LoadableSharedState = &dataBucket{}
+
+func (b *dataBucket) store(dt data.Value) bool {
+	b.pool = append(b.pool, dt)
+	if len(b.pool) < b.bucketSize {
+		return false
+	}
+	return true
+}
+
+// stream returns data stored in the bucket and clears the bucket. The length
+// of the returned array is less than bucketSize when the bucket is flushed
+// before it gets full.
+func (b *dataBucket) stream() data.Array {
+	temp := make(data.Array, len(b.pool), len(b.pool))
+	copy(temp, b.pool)
+	b.pool = b.pool[:0] // clear slice but keep capacity
+	return temp
+}
+
+func (b *dataBucket) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+const (
+	bucketFormatVersion uint8 = 1
+)
+
+// Save saves the bucket size, the output field name, and data stored in the
+// bucket.
+func (b *dataBucket) Save(ctx *core.Context, w io.Writer, params data.Map) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := w.Write([]byte{bucketFormatVersion}); err != nil {
+		return err
+	}
+
+	out, err := data.MarshalMsgpack(data.Map{
+		"bucket_size":  data.Int(b.bucketSize),
+		"output_field": data.String(b.outputField),
+		"pool":         b.pool,
+	})
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(out))); err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// Load replaces the bucket with the saved one.
+func (b *dataBucket) Load(ctx *core.Context, r io.Reader, params data.Map) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.load(r)
+}
+
+func (b *dataBucket) load(r io.Reader) error {
+	var formatVersion uint8
+	if err := binary.Read(r, binary.LittleEndian, &formatVersion); err != nil {
+		return err
+	}
+	if formatVersion != bucketFormatVersion {
+		return fmt.Errorf("unsupported format version of bucket state: %v",
+			formatVersion)
+	}
+
+	var dataSize uint32
+	if err := binary.Read(r, binary.LittleEndian, &dataSize); err != nil {
+		return err
+	}
+	buf := make([]byte, dataSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	m, err := data.UnmarshalMsgpack(buf)
+	if err != nil {
+		return err
+	}
+
+	var bucketSize int64
+	if bs, err := m.Get(bucketSizePath); err != nil {
+		return err
+	} else if bucketSize, err = data.AsInt(bs); err != nil {
+		return err
+	}
+	var outputField string
+	if of, err := m.Get(outputFieldPath); err != nil {
+		return err
+	} else if outputField, err = data.AsString(of); err != nil {
+		return err
+	}
+	var pool data.Array
+	if p, err := m.Get(poolPath); err != nil {
+		return err
+	} else if pool, err = data.AsArray(p); err != nil {
+		return err
+	}
+
+	if bucketSize <= 0 {
+		return fmt.Errorf("bucket_size must be greater than 0: %v", bucketSize)
+	}
+	if int(bucketSize) < len(pool) {
+		return fmt.Errorf("pool has %v values more than bucket_size %v",
+			len(pool), bucketSize)
+	}
+
+	b.bucketSize = int(bucketSize)
+	b.outputField = outputField
+	b.pool = make(data.Array, len(pool), int(bucketSize))
+	copy(b.pool, pool)
+	return nil
+}
+
+// CreateBucketStoreUDSF returns UDSF to store tuple data to the target
+// bucket. When the bucket gets full, the UDSF emits a tuple having all data
+// in the bucket as an array at the output field of the bucket.
+//
+// stream:     target stream name
+// bucketName: target bucket (shared state) name
+func CreateBucketStoreUDSF(ctx *core.Context, decl udf.UDSFDeclarer, stream,
+	bucketName string) (udf.UDSF, error) {
+	if err := decl.Input(stream, &udf.UDSFInputConfig{
+		InputName: "pymlstate_batch",
+	}); err != nil {
+		return nil, err
+	}
+
+	return &bucketStoreUDSF{
+		bucketName: bucketName,
+	}, nil
+}
+
+type bucketStoreUDSF struct {
+	bucketName string
+}
+
+func (sf *bucketStoreUDSF) Process(ctx *core.Context, t *core.Tuple,
+	w core.Writer) error {
+	b, err := lookupDataBucketState(ctx, sf.bucketName)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.store(t.Data) {
+		return nil
+	}
+
+	now := time.Now()
+	m := data.Map{
+		b.outputField: b.stream(),
+	}
+	traces := []core.TraceEvent{}
+	if len(t.Trace) > 0 {
+		traces = make([]core.TraceEvent, len(t.Trace), (cap(t.Trace)+1)*2)
+		copy(traces, t.Trace)
+	}
+	tu := &core.Tuple{
+		Data:          m,
+		Timestamp:     t.Timestamp,
+		ProcTimestamp: now,
+		Trace:         traces,
+	}
+	return w.Write(ctx, tu)
+}
+
+func (sf *bucketStoreUDSF) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+// FlushBucket returns data stored in the bucket as an array and clears the
+// bucket. It's used to take the last partial bucket which doesn't get full
+// by the end of a stream.
+func FlushBucket(ctx *core.Context, bucketName string) (data.Value, error) {
+	b, err := lookupDataBucketState(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stream(), nil
+}
+
+func lookupDataBucketState(ctx *core.Context, name string) (*dataBucket, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := st.(*dataBucket); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("state '%v' cannot be converted to pymlstate_bucket",
+		name)
+}
@@ -0,0 +1,244 @@
+package batch
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestCreateDataBucketState(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a state creator", t, func() {
+		c := &BucketStateCreator{}
+
+		Convey("When pass an empty parameter", func() {
+			params := data.Map{}
+			_, err := c.CreateState(ctx, params)
+			Convey("Then the creator should not create a state", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When pass a valid parameter", func() {
+			params := data.Map{
+				"bucket_size": data.Int(3),
+			}
+			s, err := c.CreateState(ctx, params)
+			So(err, ShouldBeNil)
+			Reset(func() {
+				s.Terminate(ctx)
+			})
+			Convey("Then the creator should return a state", func() {
+				db, ok := s.(*dataBucket)
+				So(ok, ShouldBeTrue)
+				So(db.bucketSize, ShouldEqual, 3)
+				So(db.outputField, ShouldEqual, "bucket")
+			})
+		})
+
+		Convey("When pass an output field name", func() {
+			params := data.Map{
+				"bucket_size":  data.Int(3),
+				"output_field": data.String("batch"),
+			}
+			s, err := c.CreateState(ctx, params)
+			So(err, ShouldBeNil)
+			Convey("Then the state should have the output field name", func() {
+				db, ok := s.(*dataBucket)
+				So(ok, ShouldBeTrue)
+				So(db.outputField, ShouldEqual, "batch")
+			})
+		})
+
+		Convey("When pass a non-positive bucket size", func() {
+			params := data.Map{
+				"bucket_size": data.Int(0),
+			}
+			_, err := c.CreateState(ctx, params)
+			Convey("Then the creator should not create a state", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestDataBucketSaveLoad(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a bucket having two data", t, func() {
+		c := &BucketStateCreator{}
+		s, err := c.CreateState(ctx, data.Map{
+			"bucket_size":  data.Int(3),
+			"output_field": data.String("batch"),
+		})
+		So(err, ShouldBeNil)
+		db := s.(*dataBucket)
+		db.store(data.Map{"data": data.Int(1)})
+		db.store(data.Map{"data": data.Int(2)})
+
+		Convey("When save the bucket", func() {
+			buf := bytes.NewBuffer(nil)
+			So(db.Save(ctx, buf, data.Map{}), ShouldBeNil)
+
+			Convey("And when load the bucket", func() {
+				s2, err := c.LoadState(ctx, buf, data.Map{})
+				So(err, ShouldBeNil)
+
+				Convey("Then the loaded bucket should have the same data", func() {
+					db2, ok := s2.(*dataBucket)
+					So(ok, ShouldBeTrue)
+					So(db2.bucketSize, ShouldEqual, 3)
+					So(db2.outputField, ShouldEqual, "batch")
+					So(db2.pool, ShouldResemble, db.pool)
+					So(cap(db2.pool), ShouldEqual, 3)
+				})
+			})
+
+			Convey("And when load a truncated data", func() {
+				_, err := c.LoadState(ctx, bytes.NewReader(buf.Bytes()[:buf.Len()-1]),
+					data.Map{})
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+
+		Convey("When load a bucket whose size is invalid", func() {
+			for _, size := range []int{1, 0, -1} {
+				db.bucketSize = size
+				buf := bytes.NewBuffer(nil)
+				So(db.Save(ctx, buf, data.Map{}), ShouldBeNil)
+				_, err := c.LoadState(ctx, buf, data.Map{})
+
+				Convey(fmt.Sprintf("Then it should fail with size %v", size), func() {
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
+
+func TestBucketStoreUDSFProcess(t *testing.T) {
+	cc := &core.ContextConfig{}
+	Convey("Given a bucket which set up three tuples pool & bucket store UDSF", t, func() {
+		ctx := core.NewContext(cc)
+		params := data.Map{
+			"bucket_size": data.Int(3),
+		}
+		ss, err := (&BucketStateCreator{}).CreateState(ctx, params)
+		So(err, ShouldBeNil)
+		err = ctx.SharedStates.Add("test_bucket", "bucket_state", ss)
+		So(err, ShouldBeNil)
+
+		udsf := bucketStoreUDSF{
+			bucketName: "test_bucket",
+		}
+
+		Convey("When three tuples are processed", func() {
+			var written data.Array
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				bu, err := t.Data.Get(data.MustCompilePath("bucket"))
+				So(err, ShouldBeNil)
+				array, err := data.AsArray(bu)
+				So(err, ShouldBeNil)
+				So(len(array), ShouldEqual, 3)
+				written = array
+
+				return nil
+			})
+
+			m1 := data.Map{
+				"data": data.String("1"),
+			}
+			t1 := &core.Tuple{
+				Data: m1,
+			}
+			err := udsf.Process(ctx, t1, w)
+			So(err, ShouldBeNil)
+
+			m2 := data.Map{
+				"data": data.String("2"),
+			}
+			t2 := &core.Tuple{
+				Data: m2,
+			}
+			err = udsf.Process(ctx, t2, w)
+			So(err, ShouldBeNil)
+
+			m3 := data.Map{
+				"data": data.String("3"),
+			}
+			t3 := &core.Tuple{
+				Data: m3,
+			}
+			err = udsf.Process(ctx, t3, w)
+			So(err, ShouldBeNil)
+
+			Convey("Then the three tuples should be written", func() {
+				expected := data.Array{m1, m2, m3}
+				So(written, ShouldResemble, expected)
+
+				Convey("And when more three tuples are processed", func() {
+
+					m4 := data.Map{
+						"data": data.String("4"),
+					}
+					t4 := &core.Tuple{
+						Data: m4,
+					}
+					err := udsf.Process(ctx, t4, w)
+					So(err, ShouldBeNil)
+
+					m5 := data.Map{
+						"data": data.String("5"),
+					}
+					t5 := &core.Tuple{
+						Data: m5,
+					}
+					err = udsf.Process(ctx, t5, w)
+					So(err, ShouldBeNil)
+
+					m6 := data.Map{
+						"data": data.String("6"),
+					}
+					t6 := &core.Tuple{
+						Data: m6,
+					}
+					err = udsf.Process(ctx, t6, w)
+					So(err, ShouldBeNil)
+
+					Convey("Then the more three tuples should be written", func() {
+						expected2 := data.Array{m4, m5, m6}
+						So(written, ShouldResemble, expected2)
+					})
+				})
+
+				Convey("And when one more tuple is processed and the bucket is flushed", func() {
+					m4 := data.Map{
+						"data": data.String("4"),
+					}
+					t4 := &core.Tuple{
+						Data: m4,
+					}
+					err := udsf.Process(ctx, t4, w)
+					So(err, ShouldBeNil)
+					partial, err := FlushBucket(ctx, "test_bucket")
+					So(err, ShouldBeNil)
+
+					Convey("Then the partial bucket should have only the tuple", func() {
+						So(partial, ShouldResemble, data.Array{m4})
+
+						rest, err := FlushBucket(ctx, "test_bucket")
+						So(err, ShouldBeNil)
+						So(rest, ShouldResemble, data.Array{})
+					})
+				})
+			})
+		})
+	})
+}
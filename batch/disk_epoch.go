@@ -0,0 +1,278 @@
+package batch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	datasetSizePath = data.MustCompilePath("dataset_size")
+	dirPath         = data.MustCompilePath("dir")
+)
+
+// CreateDiskEpochUDSF returns a UDSF which spills input tuples to a local
+// file and replays them as shuffled mini-batches for several epochs. Unlike
+// the UDSF created by CreateEpochUDSF, it receives each sample as a tuple and
+// doesn't hold the whole dataset in memory, so it can handle datasets larger
+// than memory. Only offsets of records and a single batch are kept in memory.
+//
+// Once the UDSF receives dataset_size tuples, it emits batches of all epochs,
+// removes the file, and then starts spilling the next dataset.
+//
+// stream: target stream name
+//
+// params: a map having following parameters
+//
+// dataset_size: the number of tuples in a dataset, required
+//
+// batch_size:   splitting size, required
+//
+// epoch:        loop count number, 1 by default
+//
+// shuffle:      randomize before streaming, false by default
+//
+// seed:         seed of shuffling, a random seed by default
+//
+// dir:          directory of the file, the default temporary directory by
+// default
+//
+// data_field:   field name of a batch in output tuples, "data" by default
+//
+// epoch_field:  field name of an epoch in output tuples, "epoch" by default
+//
+// Output tuples have the same format as CreateEpochUDSF's.
+func CreateDiskEpochUDSF(ctx *core.Context, decl udf.UDSFDeclarer, stream string,
+	params data.Map) (udf.UDSF, error) {
+	c, err := newEpochConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	datasetSize := 0
+	if ds, err := params.Get(datasetSizePath); err != nil {
+		return nil, err
+	} else if size, err := data.AsInt(ds); err != nil {
+		return nil, err
+	} else {
+		datasetSize = int(size)
+	}
+	if datasetSize <= 0 {
+		return nil, fmt.Errorf("dataset size must be more than zero")
+	}
+
+	dir := ""
+	if d, err := params.Get(dirPath); err == nil {
+		if dir, err = data.AsString(d); err != nil {
+			return nil, err
+		}
+	}
+
+	dataField, epochField, err := parseOutputFields(params, c.random)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decl.Input(stream, &udf.UDSFInputConfig{
+		InputName: "pymlstate_disk_epoch",
+	}); err != nil {
+		return nil, err
+	}
+
+	return &diskEpochUDSF{
+		epochConfig: *c,
+		datasetSize: datasetSize,
+		dir:         dir,
+		dataField:   dataField,
+		epochField:  epochField,
+	}, nil
+}
+
+type diskEpochUDSF struct {
+	epochConfig
+	datasetSize int
+	dir         string
+	dataField   string
+	epochField  string
+
+	file *spillFile
+}
+
+func (sf *diskEpochUDSF) Process(ctx *core.Context, t *core.Tuple,
+	w core.Writer) error {
+	if sf.file == nil {
+		f, err := newSpillFile(sf.dir)
+		if err != nil {
+			return err
+		}
+		sf.file = f
+	}
+
+	if err := sf.file.append(t.Data); err != nil {
+		return err
+	}
+	if sf.file.len() < sf.datasetSize {
+		return nil
+	}
+
+	defer func() {
+		if err := sf.file.close(); err != nil {
+			ctx.ErrLog(err).WithField("path", sf.file.path).
+				Warn("Cannot remove the spill file of the epoch UDSF")
+		}
+		sf.file = nil
+	}()
+	return sf.replay(ctx, t, w)
+}
+
+func (sf *diskEpochUDSF) replay(ctx *core.Context, t *core.Tuple,
+	w core.Writer) error {
+	if err := sf.file.flush(); err != nil {
+		return err
+	}
+
+	r, seed := sf.newRand()
+	ind := make([]int, sf.file.len(), sf.file.len())
+	traceCopyFlag := len(t.Trace) > 0
+	for i := 0; i < sf.epoch; i++ {
+		for j := range ind {
+			ind[j] = j
+		}
+		epochSeed := r.Int63()
+		if sf.random {
+			randomPermutation(ind, rand.New(rand.NewSource(epochSeed)))
+		}
+
+		for j := 0; j < len(ind); j += sf.batchSize {
+			end := j + sf.batchSize
+			if end > len(ind) {
+				end = len(ind)
+			}
+			d := make(data.Array, end-j, end-j)
+			for k, p := range ind[j:end] {
+				m, err := sf.file.read(p)
+				if err != nil {
+					return err
+				}
+				d[k] = m
+			}
+
+			m := data.Map{
+				sf.epochField: data.Int(i + 1),
+				sf.dataField:  d,
+			}
+			if sf.random {
+				m["seed"] = data.Int(seed)
+				m["epoch_seed"] = data.Int(epochSeed)
+			}
+			traces := []core.TraceEvent{}
+			if traceCopyFlag {
+				traces = make([]core.TraceEvent, len(t.Trace), (cap(t.Trace)+1)*2)
+				copy(traces, t.Trace)
+			}
+			tu := &core.Tuple{
+				Data:          m,
+				Timestamp:     time.Now(),
+				ProcTimestamp: t.ProcTimestamp,
+				Trace:         traces,
+			}
+			if err := w.Write(ctx, tu); err != nil {
+				return err
+			}
+		}
+		ctx.Log().Infof("epoch:%d has been emitted", i+1)
+	}
+	return nil
+}
+
+func (sf *diskEpochUDSF) Terminate(ctx *core.Context) error {
+	if sf.file == nil {
+		return nil
+	}
+	err := sf.file.close()
+	sf.file = nil
+	return err
+}
+
+// spillFile is a temporary file having msgpack records. Each record is
+// prefixed by its size in uint32.
+type spillFile struct {
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	offsets []int64
+	size    int64
+	buf     []byte
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, "pymlstate_epoch")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{
+		path: f.Name(),
+		f:    f,
+		w:    bufio.NewWriter(f),
+	}, nil
+}
+
+func (s *spillFile) append(m data.Map) error {
+	b, err := data.MarshalMsgpack(m)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(s.w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, s.size)
+	s.size += 4 + int64(len(b))
+	return nil
+}
+
+func (s *spillFile) len() int {
+	return len(s.offsets)
+}
+
+func (s *spillFile) flush() error {
+	return s.w.Flush()
+}
+
+// read reads the i-th record. flush must be called after the last append.
+func (s *spillFile) read(i int) (data.Map, error) {
+	var sizeBuf [4]byte
+	if _, err := s.f.ReadAt(sizeBuf[:], s.offsets[i]); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(sizeBuf[:]))
+	if cap(s.buf) < size {
+		s.buf = make([]byte, size)
+	}
+	b := s.buf[:size]
+	if _, err := s.f.ReadAt(b, s.offsets[i]+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data.UnmarshalMsgpack(b)
+}
+
+// close closes and removes the file.
+func (s *spillFile) close() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.path)
+}
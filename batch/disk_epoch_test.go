@@ -0,0 +1,123 @@
+package batch
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpillFile(t *testing.T) {
+	Convey("Given a spill file", t, func() {
+		f, err := newSpillFile("")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			f.close()
+		})
+
+		Convey("When append records", func() {
+			ms := []data.Map{
+				{"data": data.Array{data.Float(0.5), data.Float(1)}, "label": data.Int(1)},
+				{"data": data.String("text"), "label": data.Int(2)},
+				{"label": data.Int(3)},
+			}
+			for _, m := range ms {
+				So(f.append(m), ShouldBeNil)
+			}
+			So(f.flush(), ShouldBeNil)
+
+			Convey("Then records should be read in any order", func() {
+				So(f.len(), ShouldEqual, 3)
+				for _, i := range []int{2, 0, 1} {
+					m, err := f.read(i)
+					So(err, ShouldBeNil)
+					So(m, ShouldResemble, ms[i])
+				}
+			})
+		})
+	})
+}
+
+func TestDiskEpochUDSFProcess(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a disk epoch UDSF", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_disk_epoch_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		sf := &diskEpochUDSF{
+			epochConfig: epochConfig{
+				batchSize: 3,
+				epoch:     2,
+				random:    true,
+				seed:      1,
+				hasSeed:   true,
+			},
+			datasetSize: 7,
+			dir:         dir,
+			dataField:   "data",
+			epochField:  "epoch",
+		}
+		Reset(func() {
+			sf.Terminate(ctx)
+		})
+
+		written := []data.Map{}
+		w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			written = append(written, t.Data)
+			return nil
+		})
+
+		Convey("When process tuples less than the dataset size", func() {
+			for i := 0; i < 6; i++ {
+				So(sf.Process(ctx, &core.Tuple{Data: data.Map{"id": data.Int(i)}}, w), ShouldBeNil)
+			}
+
+			Convey("Then the UDSF should not emit any tuple", func() {
+				So(len(written), ShouldEqual, 0)
+			})
+
+			Convey("Then the tuples should be spilled to a file", func() {
+				fs, err := ioutil.ReadDir(dir)
+				So(err, ShouldBeNil)
+				So(len(fs), ShouldEqual, 1)
+			})
+
+			Convey("And when process the last tuple of the dataset", func() {
+				So(sf.Process(ctx, &core.Tuple{Data: data.Map{"id": data.Int(6)}}, w), ShouldBeNil)
+
+				Convey("Then the UDSF should emit shuffled batches of all epochs", func() {
+					So(len(written), ShouldEqual, 6)
+					for e := 0; e < 2; e++ {
+						ids := map[data.Value]bool{}
+						for i, m := range written[e*3 : (e+1)*3] {
+							So(m["epoch"], ShouldEqual, data.Int(e+1))
+							So(m["seed"], ShouldEqual, data.Int(1))
+							d := m["data"].(data.Array)
+							if i == 2 {
+								So(len(d), ShouldEqual, 1)
+							} else {
+								So(len(d), ShouldEqual, 3)
+							}
+							for _, v := range d {
+								ids[v.(data.Map)["id"]] = true
+							}
+						}
+						So(len(ids), ShouldEqual, 7)
+					}
+				})
+
+				Convey("Then the spill file should be removed", func() {
+					fs, err := ioutil.ReadDir(dir)
+					So(err, ShouldBeNil)
+					So(len(fs), ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,273 @@
+package batch
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"math/rand"
+	"time"
+)
+
+var (
+	arrayFieldPath = data.MustCompilePath("array_field")
+	batchSizePath  = data.MustCompilePath("batch_size")
+	epochPath      = data.MustCompilePath("epoch")
+	shufflePath    = data.MustCompilePath("shuffle")
+	seedPath       = data.MustCompilePath("seed")
+	dataFieldPath  = data.MustCompilePath("data_field")
+	epochFieldPath = data.MustCompilePath("epoch_field")
+)
+
+// epochConfig has parameters common to epoch UDSFs.
+type epochConfig struct {
+	arrayKeyPath data.Path
+	batchSize    int
+	epoch        int
+	random       bool
+
+	// seed is a seed of shuffling. A seed is generated every time an input
+	// tuple is processed when hasSeed is false.
+	seed    int64
+	hasSeed bool
+}
+
+// newRand returns a random number generator to derive seeds of epochs from
+// and its seed.
+func (c *epochConfig) newRand() (*rand.Rand, int64) {
+	seed := c.seed
+	if !c.hasSeed {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed)), seed
+}
+
+func newEpochConfig(params data.Map) (*epochConfig, error) {
+	arrayKey := "data"
+	if ak, err := params.Get(arrayFieldPath); err == nil {
+		if arrayKey, err = data.AsString(ak); err != nil {
+			return nil, err
+		}
+	}
+	if arrayKey == "" {
+		return nil, fmt.Errorf("array_field must not be empty")
+	}
+	arrayKeyPath, err := data.CompilePath(arrayKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &epochConfig{
+		arrayKeyPath: arrayKeyPath,
+		epoch:        1,
+	}
+	if bs, err := params.Get(batchSizePath); err != nil {
+		return nil, err
+	} else if size, err := data.AsInt(bs); err != nil {
+		return nil, err
+	} else {
+		c.batchSize = int(size)
+	}
+	if c.batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be more than zero")
+	}
+
+	if ep, err := params.Get(epochPath); err == nil {
+		e, err := data.AsInt(ep)
+		if err != nil {
+			return nil, err
+		}
+		c.epoch = int(e)
+	}
+	if c.epoch <= 0 {
+		return nil, fmt.Errorf("epoch size must be more than zero")
+	}
+
+	if sh, err := params.Get(shufflePath); err == nil {
+		if c.random, err = data.AsBool(sh); err != nil {
+			return nil, err
+		}
+	}
+
+	if sd, err := params.Get(seedPath); err == nil {
+		if c.seed, err = data.AsInt(sd); err != nil {
+			return nil, err
+		}
+		c.hasSeed = true
+	}
+	return c, nil
+}
+
+// parseOutputFields returns field names of a batch and an epoch in output
+// tuples of epoch UDSFs.
+func parseOutputFields(params data.Map, random bool) (string, string, error) {
+	dataField := "data"
+	if df, err := params.Get(dataFieldPath); err == nil {
+		if dataField, err = data.AsString(df); err != nil {
+			return "", "", err
+		}
+	}
+	epochField := "epoch"
+	if ef, err := params.Get(epochFieldPath); err == nil {
+		if epochField, err = data.AsString(ef); err != nil {
+			return "", "", err
+		}
+	}
+	if dataField == "" || epochField == "" {
+		return "", "", fmt.Errorf("output field names must not be empty")
+	}
+	if dataField == epochField {
+		return "", "", fmt.Errorf("data_field and epoch_field must be different")
+	}
+	for _, f := range []string{dataField, epochField} {
+		if random && (f == "seed" || f == "epoch_seed") {
+			return "", "", fmt.Errorf("'%v' is reserved for the seed of shuffling", f)
+		}
+	}
+
+	return dataField, epochField, nil
+}
+
+// CreateEpochUDSF returns bucket to batch stream function. It splits an array
+// in each input tuple into batches and emits them for several epochs.
+//
+// stream: target stream name
+//
+// params: a map having following parameters
+//
+// array_field: key name of splitting array, "data" by default
+//
+// batch_size:  splitting size, required
+//
+// epoch:       loop count number, 1 by default
+//
+// shuffle:     randomize before streaming, false by default
+//
+// seed:        seed of shuffling, a random seed by default
+//
+// data_field:  field name of a batch in output tuples, "data" by default
+//
+// epoch_field: field name of an epoch in output tuples, "epoch" by default
+//
+// When shuffle is true, a seed of each epoch is derived from the seed, and
+// output tuples have "seed" and "epoch_seed" fields. Batches are reproduced
+// by passing the recorded seed with the same data.
+func CreateEpochUDSF(ctx *core.Context, decl udf.UDSFDeclarer, stream string,
+	params data.Map) (udf.UDSF, error) {
+	if err := decl.Input(stream, &udf.UDSFInputConfig{
+		InputName: "pymlstate_epoch",
+	}); err != nil {
+		return nil, err
+	}
+
+	c, err := newEpochConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	dataField, epochField, err := parseOutputFields(params, c.random)
+	if err != nil {
+		return nil, err
+	}
+
+	return &epochUDSF{
+		epochConfig: *c,
+		dataField:   dataField,
+		epochField:  epochField,
+	}, nil
+}
+
+type epochUDSF struct {
+	epochConfig
+	dataField  string
+	epochField string
+}
+
+func (sf *epochUDSF) Process(ctx *core.Context, t *core.Tuple,
+	w core.Writer) error {
+	var bucket data.Array
+	if target, err := t.Data.Get(sf.arrayKeyPath); err != nil {
+		return err
+	} else if bucket, err = data.AsArray(target); err != nil {
+		return err
+	}
+
+	bucketNum := len(bucket)
+	n := bucketNum / sf.batchSize
+	mod := bucketNum % sf.batchSize
+	batchNum := n
+	if mod != 0 {
+		batchNum++
+	}
+
+	perm := make([]int, bucketNum, bucketNum)
+	for i := range perm {
+		perm[i] = i
+	}
+
+	r, seed := sf.newRand()
+	traceCopyFlag := len(t.Trace) > 0
+	for i := 0; i < sf.epoch; i++ {
+		// create randomized indication array list
+		// [0..100]
+		// -> randomized [9,88, ... , 3]
+		// -> separated  [[9,88...],[..3]]
+		ind := make([]int, bucketNum, bucketNum)
+		copy(ind, perm)
+		epochSeed := r.Int63()
+		if sf.random {
+			randomPermutation(ind, rand.New(rand.NewSource(epochSeed)))
+		}
+		inds := make([][]int, batchNum, batchNum)
+		for j := 0; j < n; j++ {
+			temp := ind[j*sf.batchSize : (j+1)*sf.batchSize]
+			inds[j] = temp
+		}
+		if mod != 0 {
+			temp := ind[bucketNum-mod : bucketNum]
+			inds[batchNum-1] = temp
+		}
+
+		for _, in := range inds {
+			d := make(data.Array, len(in), len(in))
+			for k, p := range in {
+				d[k] = bucket[p]
+			}
+			now := time.Now()
+			m := data.Map{
+				sf.epochField: data.Int(i + 1),
+				sf.dataField:  d,
+			}
+			if sf.random {
+				m["seed"] = data.Int(seed)
+				m["epoch_seed"] = data.Int(epochSeed)
+			}
+			traces := []core.TraceEvent{}
+			if traceCopyFlag {
+				traces = make([]core.TraceEvent, len(t.Trace), (cap(t.Trace)+1)*2)
+				copy(traces, t.Trace)
+			}
+			tu := &core.Tuple{
+				Data:          m,
+				Timestamp:     now,
+				ProcTimestamp: t.ProcTimestamp,
+				Trace:         traces,
+			}
+			w.Write(ctx, tu)
+		}
+		ctx.Log().Infof("epoch:%d has been emitted", i+1)
+	}
+
+	return nil
+}
+
+func randomPermutation(perm []int, r *rand.Rand) {
+	for i := range perm {
+		j := r.Intn(i + 1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+}
+
+func (sf *epochUDSF) Terminate(ctx *core.Context) error {
+	return nil
+}
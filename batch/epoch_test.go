@@ -0,0 +1,254 @@
+package batch
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestEpochUDSFProcess(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a bucketToBatch UDSF", t, func() {
+		sf := epochUDSF{
+			epochConfig: epochConfig{
+				arrayKeyPath: data.MustCompilePath("key"),
+				batchSize:    3,
+				epoch:        2,
+				random:       true,
+			},
+			dataField:  "data",
+			epochField: "epoch",
+		}
+		Convey("When process empty tuple", func() {
+			tu := &core.Tuple{
+				Data: data.Map{},
+			}
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			Convey("Then the UDSF should return an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When process empty array", func() {
+			tu := &core.Tuple{
+				Data: data.Map{
+					"key": data.Array{},
+				},
+			}
+			i := 0
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				i++
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			So(err, ShouldBeNil)
+			Convey("Then the UDSF should not generate any stream", func() {
+				So(i, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When process data less than batch size", func() {
+			is := data.Array{data.Int(10), data.Int(20)}
+			tu := &core.Tuple{
+				Data: data.Map{
+					"key": is,
+				},
+			}
+			i := 0
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				d, err := t.Data.Get(data.MustCompilePath("data"))
+				So(err, ShouldBeNil)
+				da, err := data.AsArray(d)
+				So(err, ShouldBeNil)
+				So(len(da), ShouldEqual, len(is))
+				for _, v := range is {
+					So(da, ShouldContain, v)
+				}
+				i++
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			So(err, ShouldBeNil)
+			Convey("Then the UDSF should not generate one stream * epoch", func() {
+				So(i, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When process data over than batch size", func() {
+			is := data.Array{data.Int(0), data.Int(1), data.Int(2), data.Int(3),
+				data.Int(4), data.Int(5), data.Int(6), data.Int(7), data.Int(8),
+				data.Int(9)}
+			tu := &core.Tuple{
+				Data: data.Map{
+					"key": is,
+				},
+			}
+			i := 0
+			act := []data.Value{}
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				d, err := t.Data.Get(data.MustCompilePath("data"))
+				So(err, ShouldBeNil)
+				da, err := data.AsArray(d)
+				So(err, ShouldBeNil)
+
+				ep, err := t.Data.Get(data.MustCompilePath("epoch"))
+				So(err, ShouldBeNil)
+				epoch, err := data.AsInt(ep)
+				So(err, ShouldBeNil)
+				So(epoch, ShouldEqual, i/4+1)
+
+				if i%4 == 3 {
+					So(len(da), ShouldEqual, 1)
+				} else {
+					So(len(da), ShouldEqual, 3)
+				}
+				i++
+				act = append(act, da...)
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			So(err, ShouldBeNil)
+			Convey("Then the UDSF should not generate four stream * epoch", func() {
+				So(i, ShouldEqual, 8)
+				So(len(act), ShouldEqual, 20)
+			})
+		})
+	})
+}
+
+func TestNewEpochConfig(t *testing.T) {
+	Convey("Given epoch parameters", t, func() {
+		Convey("When only batch_size is given", func() {
+			c, err := newEpochConfig(data.Map{
+				"batch_size": data.Int(10),
+			})
+			So(err, ShouldBeNil)
+			Convey("Then other parameters should be default values", func() {
+				So(c.arrayKeyPath, ShouldResemble, data.MustCompilePath("data"))
+				So(c.batchSize, ShouldEqual, 10)
+				So(c.epoch, ShouldEqual, 1)
+				So(c.random, ShouldBeFalse)
+				So(c.hasSeed, ShouldBeFalse)
+			})
+		})
+
+		Convey("When all parameters are given", func() {
+			c, err := newEpochConfig(data.Map{
+				"array_field": data.String("bucket"),
+				"batch_size":  data.Int(10),
+				"epoch":       data.Int(3),
+				"shuffle":     data.Bool(true),
+				"seed":        data.Int(7),
+			})
+			So(err, ShouldBeNil)
+			Convey("Then the config should have them", func() {
+				So(c.arrayKeyPath, ShouldResemble, data.MustCompilePath("bucket"))
+				So(c.epoch, ShouldEqual, 3)
+				So(c.random, ShouldBeTrue)
+				So(c.hasSeed, ShouldBeTrue)
+				So(c.seed, ShouldEqual, 7)
+			})
+		})
+
+		invalids := map[string]data.Map{
+			"batch_size is missing": data.Map{},
+			"batch_size is zero":    data.Map{"batch_size": data.Int(0)},
+			"epoch is zero":         data.Map{"batch_size": data.Int(1), "epoch": data.Int(0)},
+			"array_field is empty":  data.Map{"batch_size": data.Int(1), "array_field": data.String("")},
+		}
+		for name, params := range invalids {
+			params := params
+			Convey("When "+name, func() {
+				_, err := newEpochConfig(params)
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+	})
+}
+
+func TestEpochUDSFSeed(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given an epoch UDSF with a seed", t, func() {
+		sf := epochUDSF{
+			epochConfig: epochConfig{
+				arrayKeyPath: data.MustCompilePath("key"),
+				batchSize:    4,
+				epoch:        3,
+				random:       true,
+				seed:         42,
+				hasSeed:      true,
+			},
+			dataField:  "data",
+			epochField: "epoch",
+		}
+		is := data.Array{}
+		for i := 0; i < 20; i++ {
+			is = append(is, data.Int(i))
+		}
+		tu := &core.Tuple{
+			Data: data.Map{
+				"key": is,
+			},
+		}
+		run := func(sf *epochUDSF) []data.Map {
+			res := []data.Map{}
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				res = append(res, t.Data)
+				return nil
+			})
+			So(sf.Process(ctx, tu, w), ShouldBeNil)
+			return res
+		}
+
+		Convey("When process the same data twice", func() {
+			res1 := run(&sf)
+			res2 := run(&sf)
+
+			Convey("Then the UDSF should emit the same batches", func() {
+				So(len(res1), ShouldEqual, 15)
+				So(res2, ShouldResemble, res1)
+			})
+
+			Convey("Then tuples should have the seed and per-epoch seeds", func() {
+				epochSeeds := map[data.Value]bool{}
+				for _, m := range res1 {
+					So(m["seed"], ShouldEqual, data.Int(42))
+					epochSeeds[m["epoch_seed"]] = true
+				}
+				So(len(epochSeeds), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When process the data with a different seed", func() {
+			sf2 := sf
+			sf2.seed = 43
+			res1 := run(&sf)
+			res2 := run(&sf2)
+
+			Convey("Then the UDSF should emit different batches", func() {
+				So(res2, ShouldNotResemble, res1)
+			})
+		})
+
+		Convey("When process the data without a seed", func() {
+			sf2 := sf
+			sf2.hasSeed = false
+			res := run(&sf2)
+
+			Convey("Then tuples should have the generated seed", func() {
+				So(res[0]["seed"], ShouldNotEqual, data.Int(42))
+				for _, m := range res {
+					So(m["seed"], ShouldEqual, res[0]["seed"])
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,250 @@
+package batch
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	lossPath            = data.MustCompilePath("loss")
+	validationRatioPath = data.MustCompilePath("validation_ratio")
+	patiencePath        = data.MustCompilePath("patience")
+)
+
+// CreateTrainEpochUDSF returns a UDSF which trains a pymlstate with a bucket
+// for several epochs. Unlike the UDSF created by CreateEpochUDSF, it calls
+// "fit" of the state by itself so that the model can be evaluated with a
+// validation set after each epoch. The validation set is reserved from the
+// bucket and never used for training. The UDSF stops training when the
+// validation loss hasn't improved for "patience" epochs.
+//
+// stream:    target stream name
+//
+// stateName: pymlstate name to be trained
+//
+// params: a map having following parameters
+//
+// array_field:      key name of splitting array, "data" by default
+//
+// batch_size:       splitting size, required
+//
+// epoch:            maximum loop count number, 1 by default
+//
+// shuffle:          randomize before training, false by default
+//
+// seed:             seed of shuffling, a random seed by default
+//
+// validation_ratio: ratio of the validation set in [0, 1), 0 by default
+//
+// patience:         epochs without improvement before stopping, 0 (disabled)
+// by default
+//
+// The validation loss is a value returned from "score" method of the state,
+// or its "loss" field when the method returns a map. The validation set is
+// chosen with the seed, and a seed of each epoch is derived from it, so a
+// training run can be reproduced by passing the seed recorded in output
+// tuples.
+//
+// Output (per epoch):
+//  data.Map{
+//    "epoch":                data.Int,
+//    "batches":              data.Int,
+//    "train_size":           data.Int,
+//    "validation_size":      data.Int,
+//    "validation_loss":      data.Float (only with validation set),
+//    "validation_score":     score returned from Python (only with validation set),
+//    "best_validation_loss": data.Float (only with validation set),
+//    "best_epoch":           data.Int (only with validation set),
+//    "stopped":              data.Bool, true when stopped early,
+//    "seed":                 data.Int (only with shuffle),
+//    "epoch_seed":           data.Int (only with shuffle)
+//  }
+func CreateTrainEpochUDSF(ctx *core.Context, decl udf.UDSFDeclarer, stream,
+	stateName string, params data.Map) (udf.UDSF, error) {
+	if err := decl.Input(stream, &udf.UDSFInputConfig{
+		InputName: "pymlstate_train_epoch",
+	}); err != nil {
+		return nil, err
+	}
+
+	if stateName == "" {
+		return nil, fmt.Errorf("state name must not be empty")
+	}
+	c, err := newEpochConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	validationRatio := 0.0
+	if vr, err := params.Get(validationRatioPath); err == nil {
+		if validationRatio, err = data.ToFloat(vr); err != nil {
+			return nil, err
+		}
+	}
+	if validationRatio < 0 || validationRatio >= 1 {
+		return nil, fmt.Errorf("validation ratio must be in [0, 1)")
+	}
+
+	patience := 0
+	if pa, err := params.Get(patiencePath); err == nil {
+		p, err := data.AsInt(pa)
+		if err != nil {
+			return nil, err
+		}
+		patience = int(p)
+	}
+	if patience < 0 {
+		return nil, fmt.Errorf("patience must not be negative")
+	}
+	if patience > 0 && validationRatio == 0 {
+		return nil, fmt.Errorf("early stopping requires validation ratio")
+	}
+
+	return &trainEpochUDSF{
+		epochConfig:     *c,
+		stateName:       stateName,
+		validationRatio: validationRatio,
+		patience:        patience,
+	}, nil
+}
+
+type trainEpochUDSF struct {
+	epochConfig
+	stateName       string
+	validationRatio float64
+	patience        int
+}
+
+func (sf *trainEpochUDSF) Process(ctx *core.Context, t *core.Tuple,
+	w core.Writer) error {
+	var bucket data.Array
+	if target, err := t.Data.Get(sf.arrayKeyPath); err != nil {
+		return err
+	} else if bucket, err = data.AsArray(target); err != nil {
+		return err
+	}
+
+	// reserve the validation set from the tail of the (shuffled) bucket
+	r, seed := sf.newRand()
+	ind := make([]int, len(bucket), len(bucket))
+	for i := range ind {
+		ind[i] = i
+	}
+	if sf.random {
+		randomPermutation(ind, r)
+	}
+	validationSize := int(float64(len(bucket)) * sf.validationRatio)
+	trainPerm := ind[:len(ind)-validationSize]
+	trainInd := make([]int, len(trainPerm), len(trainPerm))
+	validation := make([]data.Value, validationSize, validationSize)
+	for i, p := range ind[len(ind)-validationSize:] {
+		validation[i] = bucket[p]
+	}
+
+	best := math.Inf(1)
+	bestEpoch := 0
+	for i := 0; i < sf.epoch; i++ {
+		copy(trainInd, trainPerm)
+		epochSeed := r.Int63()
+		if sf.random {
+			randomPermutation(trainInd, rand.New(rand.NewSource(epochSeed)))
+		}
+		batches := 0
+		for j := 0; j < len(trainInd); j += sf.batchSize {
+			end := j + sf.batchSize
+			if end > len(trainInd) {
+				end = len(trainInd)
+			}
+			d := make([]data.Value, end-j, end-j)
+			for k, p := range trainInd[j:end] {
+				d[k] = bucket[p]
+			}
+			if _, err := pymlstate.Fit(ctx, sf.stateName, d); err != nil {
+				return err
+			}
+			batches++
+		}
+
+		m := data.Map{
+			"epoch":           data.Int(i + 1),
+			"batches":         data.Int(batches),
+			"train_size":      data.Int(len(trainInd)),
+			"validation_size": data.Int(validationSize),
+			"stopped":         data.Bool(false),
+		}
+		if sf.random {
+			m["seed"] = data.Int(seed)
+			m["epoch_seed"] = data.Int(epochSeed)
+		}
+		stop := false
+		if validationSize > 0 {
+			score, err := pymlstate.Score(ctx, sf.stateName, validation)
+			if err != nil {
+				return err
+			}
+			loss, err := validationLoss(score)
+			if err != nil {
+				return err
+			}
+			if loss < best {
+				best = loss
+				bestEpoch = i + 1
+			} else if sf.patience > 0 && i+1-bestEpoch >= sf.patience {
+				stop = true
+			}
+			m["validation_loss"] = data.Float(loss)
+			m["validation_score"] = score
+			m["best_validation_loss"] = data.Float(best)
+			m["best_epoch"] = data.Int(bestEpoch)
+			m["stopped"] = data.Bool(stop)
+		}
+
+		now := time.Now()
+		traces := []core.TraceEvent{}
+		if len(t.Trace) > 0 {
+			traces = make([]core.TraceEvent, len(t.Trace), (cap(t.Trace)+1)*2)
+			copy(traces, t.Trace)
+		}
+		tu := &core.Tuple{
+			Data:          m,
+			Timestamp:     now,
+			ProcTimestamp: t.ProcTimestamp,
+			Trace:         traces,
+		}
+		if err := w.Write(ctx, tu); err != nil {
+			return err
+		}
+		ctx.Log().Infof("epoch:%d has been trained", i+1)
+
+		if stop {
+			ctx.Log().Infof("training has been stopped early at epoch:%d, "+
+				"the best epoch was %d", i+1, bestEpoch)
+			break
+		}
+	}
+	return nil
+}
+
+func (sf *trainEpochUDSF) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+// validationLoss extracts a loss from a return value of "score". The value
+// is either a number or a map having "loss" field.
+func validationLoss(score data.Value) (float64, error) {
+	if score.Type() == data.TypeMap {
+		m, _ := data.AsMap(score)
+		l, err := m.Get(lossPath)
+		if err != nil {
+			return 0, fmt.Errorf("score doesn't have loss: %v", err)
+		}
+		score = l
+	}
+	return data.ToFloat(score)
+}
@@ -0,0 +1,119 @@
+package batch
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/pymlstate.v0"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestTrainEpochUDSFProcess(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a train epoch UDSF and a pymlstate with improving scores", t, func() {
+		s, err := pymlstate.New(&pystate.BaseParams{
+			ModulePath: "../",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "TestClass",
+		}, &pymlstate.MLParams{BatchSize: 1}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		So(ctx.SharedStates.Add("train_epoch_test", "pymlstate", s), ShouldBeNil)
+
+		sf := trainEpochUDSF{
+			epochConfig: epochConfig{
+				arrayKeyPath: data.MustCompilePath("key"),
+				batchSize:    3,
+				epoch:        3,
+				random:       true,
+			},
+			stateName:       "train_epoch_test",
+			validationRatio: 0.2,
+			patience:        1,
+		}
+
+		Convey("When process ten data", func() {
+			is := data.Array{}
+			for i := 0; i < 10; i++ {
+				is = append(is, data.Int(i))
+			}
+			tu := &core.Tuple{
+				Data: data.Map{
+					"key": is,
+				},
+			}
+			metrics := []data.Map{}
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				metrics = append(metrics, t.Data)
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			So(err, ShouldBeNil)
+
+			Convey("Then the UDSF should emit validation metrics for each epoch", func() {
+				So(len(metrics), ShouldEqual, 3)
+				for i, m := range metrics {
+					So(m["epoch"], ShouldEqual, data.Int(i+1))
+					So(m["batches"], ShouldEqual, data.Int(3))
+					So(m["train_size"], ShouldEqual, data.Int(8))
+					So(m["validation_size"], ShouldEqual, data.Int(2))
+					So(m["best_epoch"], ShouldEqual, data.Int(i+1))
+					So(m["stopped"], ShouldEqual, data.Bool(false))
+					So(m["seed"], ShouldEqual, metrics[0]["seed"])
+					So(m["epoch_seed"], ShouldNotBeNil)
+				}
+				So(metrics[2]["validation_loss"], ShouldEqual, data.Float(1.0/10))
+			})
+		})
+	})
+
+	Convey("Given a train epoch UDSF and a pymlstate with constant scores", t, func() {
+		s, err := pymlstate.New(&pystate.BaseParams{
+			ModulePath: "../",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "ConstantScoreClass",
+		}, &pymlstate.MLParams{BatchSize: 1}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		So(ctx.SharedStates.Add("train_epoch_test2", "pymlstate", s), ShouldBeNil)
+
+		sf := trainEpochUDSF{
+			epochConfig: epochConfig{
+				arrayKeyPath: data.MustCompilePath("key"),
+				batchSize:    2,
+				epoch:        10,
+			},
+			stateName:       "train_epoch_test2",
+			validationRatio: 0.5,
+			patience:        2,
+		}
+
+		Convey("When process four data", func() {
+			tu := &core.Tuple{
+				Data: data.Map{
+					"key": data.Array{data.Int(1), data.Int(2), data.Int(3), data.Int(4)},
+				},
+			}
+			metrics := []data.Map{}
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				metrics = append(metrics, t.Data)
+				return nil
+			})
+			err := sf.Process(ctx, tu, w)
+			So(err, ShouldBeNil)
+
+			Convey("Then the UDSF should stop early after patience epochs", func() {
+				So(len(metrics), ShouldEqual, 3)
+				So(metrics[2]["stopped"], ShouldEqual, data.Bool(true))
+				So(metrics[2]["best_epoch"], ShouldEqual, data.Int(1))
+				So(metrics[2]["validation_loss"], ShouldEqual, data.Float(1))
+			})
+		})
+	})
+}
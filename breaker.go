@@ -0,0 +1,207 @@
+package pymlstate
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"sync"
+	"time"
+)
+
+var (
+	breakerThresholdPath = data.MustCompilePath("breaker_threshold")
+	breakerCooldownPath  = data.MustCompilePath("breaker_cooldown")
+	breakerFallbackPath  = data.MustCompilePath("breaker_fallback")
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// States of the circuit breaker.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half_open"}
+
+// errBreakerOpen is returned by predict while the circuit breaker is open and
+// breaker_fallback isn't given. predict_fallback applies to it.
+var errBreakerOpen = errors.New("pymlstate's circuit breaker is open")
+
+// parseBreakerParams parses parameters of the circuit breaker and removes
+// them from params.
+//
+// breaker_threshold: the number of consecutive failures of "predict" which
+// opens the circuit breaker, 0 disables it (default: 0)
+//
+// breaker_cooldown: the duration the circuit breaker stays open before it
+// tries a prediction, e.g. "10s" or a number of seconds (default: 30 seconds)
+//
+// breaker_fallback: a value returned by Predict while the circuit breaker is
+// open, which is annotated like predict_fallback. It takes precedence over
+// predict_fallback while the breaker is open, and predict_fallback is used
+// when it isn't given. Predict returns an error when neither is given.
+func parseBreakerParams(params data.Map, mlParams *MLParams) error {
+	if bt, err := params.Get(breakerThresholdPath); err == nil {
+		threshold, err := data.AsInt(bt)
+		if err != nil {
+			return err
+		}
+		if threshold < 0 {
+			return errors.New("breaker_threshold must not be negative")
+		}
+		mlParams.BreakerThreshold = int(threshold)
+		delete(params, "breaker_threshold")
+	}
+
+	if bc, err := params.Get(breakerCooldownPath); err == nil {
+		cooldown, err := data.ToDuration(bc)
+		if err != nil {
+			return err
+		}
+		if cooldown <= 0 {
+			return errors.New("breaker_cooldown must be greater than 0")
+		}
+		mlParams.BreakerCooldown = cooldown
+		delete(params, "breaker_cooldown")
+	}
+
+	if bf, err := params.Get(breakerFallbackPath); err == nil {
+		b, err := encodeValue(bf)
+		if err != nil {
+			return err
+		}
+		mlParams.BreakerFallback = b
+		delete(params, "breaker_fallback")
+	}
+	return nil
+}
+
+// encodeValue encodes a data.Value in msgpack so that it can be saved with
+// MLParams.
+func encodeValue(v data.Value) ([]byte, error) {
+	return data.MarshalMsgpack(data.Map{"value": v})
+}
+
+// decodeValue decodes a data.Value encoded by encodeValue.
+func decodeValue(b []byte) (data.Value, error) {
+	m, err := data.UnmarshalMsgpack(b)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := m["value"]
+	if !ok {
+		return nil, errors.New("encoded value doesn't have a value")
+	}
+	return v, nil
+}
+
+func (p *MLParams) breakerCooldown() time.Duration {
+	if p.BreakerCooldown <= 0 {
+		return defaultBreakerCooldown
+	}
+	return p.BreakerCooldown
+}
+
+// circuitBreaker stops calling "predict" after it fails consecutively. The
+// breaker opens when "predict" fails breaker_threshold times in a row, and
+// Predict fails fast while it's open. After breaker_cooldown, the breaker
+// becomes half-open and lets one prediction through. The breaker closes when
+// the prediction succeeds, and opens again when it fails.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// allow returns true when Predict can call "predict".
+func (b *circuitBreaker) allow(ctx *core.Context, p *MLParams) bool {
+	if p.BreakerThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < p.breakerCooldown() {
+			return false
+		}
+		// the prediction made by this call is the trial
+		b.transition(ctx, breakerHalfOpen)
+		return true
+	default:
+		// the trial is running
+		return false
+	}
+}
+
+// done records the result of "predict".
+func (b *circuitBreaker) done(ctx *core.Context, p *MLParams, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(ctx, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if p.BreakerThreshold <= 0 {
+		return
+	}
+	if b.state == breakerHalfOpen ||
+		(b.state == breakerClosed && b.failures >= p.BreakerThreshold) {
+		b.openedAt = time.Now()
+		b.transition(ctx, breakerOpen)
+	}
+}
+
+// reset closes the breaker and forgets failures, which is done when the
+// model is replaced.
+func (b *circuitBreaker) reset(ctx *core.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.transition(ctx, breakerClosed)
+	}
+}
+
+func (b *circuitBreaker) transition(ctx *core.Context, state int) {
+	l := ctx.Log().WithField("from", breakerStateNames[b.state]).
+		WithField("to", breakerStateNames[state]).
+		WithField("consecutive_failures", b.failures)
+	b.state = state
+	if state == breakerOpen {
+		l.Warn("pymlstate's circuit breaker opened")
+	} else {
+		l.Info("pymlstate's circuit breaker changed its state")
+	}
+}
+
+func (b *circuitBreaker) stateName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStateNames[b.state]
+}
+
+// rejectPrediction returns breaker_fallback annotated as a fallback
+// prediction, or errBreakerOpen when the circuit breaker is open.
+func (s *State) rejectPrediction(ctx *core.Context) (data.Value, error) {
+	if s.params.BreakerFallback == nil {
+		return nil, errBreakerOpen
+	}
+	v, err := decodeValue(s.params.BreakerFallback)
+	if err != nil {
+		return nil, fmt.Errorf("%v, and breaker_fallback is broken: %v", errBreakerOpen, err)
+	}
+	ctx.Log().Debug("pymlstate used breaker_fallback")
+	return fallbackResult(v, errBreakerOpen), nil
+}
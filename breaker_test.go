@@ -0,0 +1,175 @@
+package pymlstate
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+	"time"
+)
+
+func TestParseBreakerParams(t *testing.T) {
+	Convey("Given parameters of the circuit breaker", t, func() {
+		params := data.Map{
+			"breaker_threshold": data.Int(3),
+			"breaker_cooldown":  data.String("10s"),
+			"breaker_fallback":  data.Map{"label": data.String("unknown")},
+			"other":             data.Int(1),
+		}
+
+		Convey("When parse them", func() {
+			mp := &MLParams{}
+			So(parseBreakerParams(params, mp), ShouldBeNil)
+
+			Convey("Then MLParams should have them", func() {
+				So(mp.BreakerThreshold, ShouldEqual, 3)
+				So(mp.BreakerCooldown, ShouldEqual, 10*time.Second)
+				v, err := decodeValue(mp.BreakerFallback)
+				So(err, ShouldBeNil)
+				So(v, ShouldResemble, data.Map{"label": data.String("unknown")})
+			})
+
+			Convey("Then they should be removed from parameters", func() {
+				So(params, ShouldResemble, data.Map{"other": data.Int(1)})
+			})
+		})
+
+		Convey("When parse a negative threshold", func() {
+			err := parseBreakerParams(data.Map{"breaker_threshold": data.Int(-1)}, &MLParams{})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("Given a circuit breaker", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		mp := &MLParams{
+			BreakerThreshold: 2,
+			BreakerCooldown:  50 * time.Millisecond,
+		}
+		b := &circuitBreaker{}
+		failed := errors.New("failed")
+
+		Convey("When predictions fail fewer times than the threshold", func() {
+			b.done(ctx, mp, failed)
+
+			Convey("Then it should be closed", func() {
+				So(b.stateName(), ShouldEqual, "closed")
+				So(b.allow(ctx, mp), ShouldBeTrue)
+			})
+		})
+
+		Convey("When predictions fail as many times as the threshold", func() {
+			b.done(ctx, mp, failed)
+			b.done(ctx, mp, failed)
+
+			Convey("Then it should be open", func() {
+				So(b.stateName(), ShouldEqual, "open")
+				So(b.allow(ctx, mp), ShouldBeFalse)
+			})
+
+			Convey("And the cooldown passes", func() {
+				time.Sleep(60 * time.Millisecond)
+
+				Convey("Then it should allow only one trial", func() {
+					So(b.allow(ctx, mp), ShouldBeTrue)
+					So(b.stateName(), ShouldEqual, "half_open")
+					So(b.allow(ctx, mp), ShouldBeFalse)
+				})
+
+				Convey("Then it should close when the trial succeeds", func() {
+					So(b.allow(ctx, mp), ShouldBeTrue)
+					b.done(ctx, mp, nil)
+					So(b.stateName(), ShouldEqual, "closed")
+					So(b.allow(ctx, mp), ShouldBeTrue)
+				})
+
+				Convey("Then it should open again when the trial fails", func() {
+					So(b.allow(ctx, mp), ShouldBeTrue)
+					b.done(ctx, mp, failed)
+					So(b.stateName(), ShouldEqual, "open")
+					So(b.allow(ctx, mp), ShouldBeFalse)
+				})
+			})
+
+			Convey("And the breaker is disabled", func() {
+				mp.BreakerThreshold = 0
+
+				Convey("Then it should allow predictions", func() {
+					So(b.allow(ctx, mp), ShouldBeTrue)
+				})
+			})
+		})
+	})
+}
+
+func TestPyMLStateCircuitBreaker(t *testing.T) {
+	Convey("Given a pymlstate with a circuit breaker", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		fallback, err := encodeValue(data.String("fallback"))
+		So(err, ShouldBeNil)
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:        1,
+			Backend:          processBackend,
+			BreakerThreshold: 2,
+			BreakerCooldown:  time.Hour,
+			BreakerFallback:  fallback,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When predictions keep failing", func() {
+			for i := 0; i < 2; i++ {
+				_, err := s.Predict(ctx, data.String("error"))
+				So(err, ShouldNotBeNil)
+			}
+
+			Convey("Then Predict should return the annotated fallback value", func() {
+				res, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, data.Map{
+					"fallback": data.Bool(true),
+					"result":   data.String("fallback"),
+					"error":    data.String(errBreakerOpen.Error()),
+				})
+			})
+
+			Convey("Then the state should not be ready", func() {
+				h, err := s.Health(ctx)
+				So(err, ShouldBeNil)
+				So(h["breaker"], ShouldEqual, data.String("open"))
+				So(h["ready"], ShouldEqual, data.Bool(false))
+			})
+
+			Convey("And save and load the model", func() {
+				buf := bytes.NewBuffer(nil)
+				So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+				So(s.Load(ctx, buf, data.Map{}), ShouldBeNil)
+
+				Convey("Then the breaker should be closed", func() {
+					So(s.breaker.stateName(), ShouldEqual, "closed")
+					res, err := s.Predict(ctx, data.String("a"))
+					So(err, ShouldBeNil)
+					So(res, ShouldEqual, data.String("a"))
+				})
+			})
+
+			Convey("And the fallback value is removed", func() {
+				s.params.BreakerFallback = nil
+
+				Convey("Then Predict should fail fast", func() {
+					_, err := s.Predict(ctx, data.String("a"))
+					So(err, ShouldEqual, errBreakerOpen)
+				})
+			})
+		})
+	})
+}
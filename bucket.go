@@ -0,0 +1,354 @@
+package pymlstate
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"math/rand"
+	"time"
+)
+
+const (
+	batchPolicy         = "batch"
+	slidingWindowPolicy = "sliding_window"
+	reservoirPolicy     = "reservoir"
+	stratifiedPolicy    = "stratified"
+)
+
+// bucketPolicy decides which tuples written to State are kept in its bucket
+// and when "fit" is called with the bucket. Methods are called while State
+// holds the write lock.
+type bucketPolicy interface {
+	// store adds the value to the bucket. It returns the updated bucket and
+	// true when "fit" should be called with it.
+	store(bucket []data.Value, v data.Value) ([]data.Value, bool, error)
+
+	// batch assembles values passed to "fit" from the bucket.
+	batch(bucket []data.Value) []data.Value
+
+	// sample returns values of the bucket which statistics of preprocess
+	// are fitted with. They're values which the model hasn't been trained
+	// with so that a value kept across trainings isn't counted twice.
+	sample(bucket []data.Value) []data.Value
+
+	// trained returns the bucket to be kept after "fit" was called.
+	trained(bucket []data.Value) []data.Value
+
+	// reset clears internal states of the policy when the bucket is flushed.
+	reset()
+
+	// stats returns statistics specific to the policy. It returns nil when
+	// the policy doesn't have any.
+	stats() data.Map
+}
+
+func newBucketPolicy(params *MLParams) (bucketPolicy, error) {
+	interval := params.TrainInterval
+	if interval <= 0 {
+		interval = params.BatchSize
+	}
+
+	switch params.BucketPolicy {
+	case "", batchPolicy:
+		return &batchBucket{size: params.BatchSize}, nil
+	case slidingWindowPolicy:
+		return &slidingWindowBucket{
+			size:     params.BatchSize,
+			interval: interval,
+		}, nil
+	case reservoirPolicy:
+		return &reservoirBucket{
+			size:     params.BatchSize,
+			interval: interval,
+			rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		}, nil
+	case stratifiedPolicy:
+		p, err := data.CompilePath(params.LabelPath)
+		if err != nil {
+			return nil, fmt.Errorf("label_path is invalid: %v", err)
+		}
+		return &stratifiedBucket{
+			size:        params.BatchSize,
+			labelPath:   p,
+			maxPerClass: params.MaxPerClass,
+			oversample:  params.Oversample,
+			rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+			arrived:     map[string]int64{},
+			seen:        map[string]int64{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported bucket_policy: %v", params.BucketPolicy)
+	}
+}
+
+// batchBucket fills the bucket and flushes it after training. When the size
+// is 1, an array is regarded as a batch.
+type batchBucket struct {
+	size int
+}
+
+func (b *batchBucket) store(bucket []data.Value, v data.Value) ([]data.Value, bool, error) {
+	if b.size > 1 {
+		bucket = append(bucket, v)
+		return bucket, len(bucket) >= b.size, nil
+	}
+
+	if v.Type() == data.TypeArray {
+		arr, _ := data.AsArray(v)
+		return arr, true, nil
+	}
+	return []data.Value{v}, true, nil
+}
+
+func (b *batchBucket) batch(bucket []data.Value) []data.Value {
+	return bucket
+}
+
+func (b *batchBucket) sample(bucket []data.Value) []data.Value {
+	return bucket
+}
+
+func (b *batchBucket) trained(bucket []data.Value) []data.Value {
+	return bucket[:0] // clear slice but keep capacity
+}
+
+func (b *batchBucket) reset() {
+}
+
+func (b *batchBucket) stats() data.Map {
+	return nil
+}
+
+// slidingWindowBucket keeps the last "size" tuples and trains the model with
+// them every "interval" tuples.
+type slidingWindowBucket struct {
+	size     int
+	interval int
+	arrivals int
+	fresh    int // the number of values stored since the last training
+}
+
+func (b *slidingWindowBucket) store(bucket []data.Value, v data.Value) ([]data.Value, bool, error) {
+	if len(bucket) >= b.size {
+		n := copy(bucket, bucket[len(bucket)-b.size+1:])
+		bucket = bucket[:n]
+	}
+	bucket = append(bucket, v)
+	b.arrivals++
+	if b.fresh < b.size {
+		b.fresh++
+	}
+	return bucket, b.arrivals%b.interval == 0, nil
+}
+
+func (b *slidingWindowBucket) batch(bucket []data.Value) []data.Value {
+	return bucket
+}
+
+func (b *slidingWindowBucket) sample(bucket []data.Value) []data.Value {
+	if b.fresh > len(bucket) {
+		return bucket
+	}
+	return bucket[len(bucket)-b.fresh:]
+}
+
+func (b *slidingWindowBucket) trained(bucket []data.Value) []data.Value {
+	b.fresh = 0
+	return bucket
+}
+
+func (b *slidingWindowBucket) reset() {
+	b.arrivals = 0
+	b.fresh = 0
+}
+
+func (b *slidingWindowBucket) stats() data.Map {
+	return nil
+}
+
+// reservoirBucket keeps a uniform sample of "size" tuples from all tuples
+// written so far, and trains the model with them every "interval" tuples.
+type reservoirBucket struct {
+	size     int
+	interval int
+	seen     int64
+	rand     *rand.Rand
+	fresh    []bool // whether each value is stored since the last training
+}
+
+func (b *reservoirBucket) store(bucket []data.Value, v data.Value) ([]data.Value, bool, error) {
+	b.seen++
+	if len(bucket) < b.size {
+		bucket = append(bucket, v)
+		b.fresh = append(b.fresh, true)
+	} else if i := b.rand.Int63n(b.seen); i < int64(b.size) {
+		bucket[i] = v
+		b.fresh[i] = true
+	}
+	return bucket, b.seen%int64(b.interval) == 0, nil
+}
+
+func (b *reservoirBucket) batch(bucket []data.Value) []data.Value {
+	return bucket
+}
+
+func (b *reservoirBucket) sample(bucket []data.Value) []data.Value {
+	res := []data.Value{}
+	for i, v := range bucket {
+		if i < len(b.fresh) && b.fresh[i] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (b *reservoirBucket) trained(bucket []data.Value) []data.Value {
+	for i := range b.fresh {
+		b.fresh[i] = false
+	}
+	return bucket
+}
+
+func (b *reservoirBucket) reset() {
+	b.seen = 0
+	b.fresh = b.fresh[:0]
+}
+
+func (b *reservoirBucket) stats() data.Map {
+	return nil
+}
+
+// stratifiedBucket classifies tuples by the label at labelPath. It keeps at
+// most maxPerClass tuples per class, replacing a random tuple of the same
+// class when the class is full so that kept tuples are a uniform sample of
+// the class. "fit" is called every "size" tuples and tuples of minority
+// classes are repeated up to the number of tuples of the largest class when
+// oversample is true.
+type stratifiedBucket struct {
+	size        int
+	labelPath   data.Path
+	maxPerClass int
+	oversample  bool
+	rand        *rand.Rand
+
+	labels   []string         // labels of tuples in the bucket
+	arrived  map[string]int64 // tuples per class since the last training
+	seen     map[string]int64 // tuples per class since the last reset
+	arrivals int
+}
+
+func (b *stratifiedBucket) store(bucket []data.Value, v data.Value) ([]data.Value, bool, error) {
+	m, err := data.AsMap(v)
+	if err != nil {
+		return bucket, false, fmt.Errorf("stratified bucket requires map data: %v", err)
+	}
+	lv, err := m.Get(b.labelPath)
+	if err != nil {
+		return bucket, false, fmt.Errorf("label is missing: %v", err)
+	}
+	label, err := data.ToString(lv)
+	if err != nil {
+		return bucket, false, err
+	}
+
+	b.arrived[label]++
+	b.seen[label]++
+	b.arrivals++
+	if b.maxPerClass <= 0 || b.count(label) < b.maxPerClass {
+		bucket = append(bucket, v)
+		b.labels = append(b.labels, label)
+	} else if i := b.rand.Int63n(b.arrived[label]); i < int64(b.maxPerClass) {
+		// replace the i-th tuple of the class
+		for j, l := range b.labels {
+			if l != label {
+				continue
+			}
+			if i == 0 {
+				bucket[j] = v
+				break
+			}
+			i--
+		}
+	}
+	return bucket, b.arrivals >= b.size, nil
+}
+
+func (b *stratifiedBucket) count(label string) int {
+	n := 0
+	for _, l := range b.labels {
+		if l == label {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *stratifiedBucket) classes(bucket []data.Value) (map[string][]data.Value, []string) {
+	classes := map[string][]data.Value{}
+	order := []string{}
+	for i, l := range b.labels {
+		if _, ok := classes[l]; !ok {
+			order = append(order, l)
+		}
+		classes[l] = append(classes[l], bucket[i])
+	}
+	return classes, order
+}
+
+func (b *stratifiedBucket) batch(bucket []data.Value) []data.Value {
+	if !b.oversample {
+		return bucket
+	}
+
+	classes, order := b.classes(bucket)
+	max := 0
+	for _, vs := range classes {
+		if len(vs) > max {
+			max = len(vs)
+		}
+	}
+	res := make([]data.Value, 0, max*len(classes))
+	for _, l := range order {
+		vs := classes[l]
+		for i := 0; i < max; i++ {
+			res = append(res, vs[i%len(vs)])
+		}
+	}
+	return res
+}
+
+// sample returns the bucket because it doesn't have oversampled values and it's
+// flushed after every training.
+func (b *stratifiedBucket) sample(bucket []data.Value) []data.Value {
+	return bucket
+}
+
+func (b *stratifiedBucket) trained(bucket []data.Value) []data.Value {
+	b.labels = b.labels[:0]
+	b.arrived = map[string]int64{}
+	b.arrivals = 0
+	return bucket[:0]
+}
+
+func (b *stratifiedBucket) reset() {
+	b.trained(nil)
+	b.seen = map[string]int64{}
+}
+
+func (b *stratifiedBucket) stats() data.Map {
+	counts := data.Map{}
+	for _, l := range b.labels {
+		if c, ok := counts[l]; ok {
+			counts[l] = c.(data.Int) + 1
+		} else {
+			counts[l] = data.Int(1)
+		}
+	}
+	seen := data.Map{}
+	for l, c := range b.seen {
+		seen[l] = data.Int(c)
+	}
+	return data.Map{
+		"class_counts":      counts,
+		"seen_class_counts": seen,
+	}
+}
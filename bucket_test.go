@@ -0,0 +1,243 @@
+package pymlstate
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestBatchBucketPolicy(t *testing.T) {
+	Convey("Given a batch bucket policy with size 3", t, func() {
+		p, err := newBucketPolicy(&MLParams{BatchSize: 3})
+		So(err, ShouldBeNil)
+		bucket := []data.Value{}
+
+		Convey("When store three values", func() {
+			var ready bool
+			for i := 0; i < 3; i++ {
+				So(ready, ShouldBeFalse)
+				bucket, ready, err = p.store(bucket, data.Int(i))
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then the bucket should be ready after the third value", func() {
+				So(ready, ShouldBeTrue)
+				So(bucket, ShouldResemble, []data.Value{data.Int(0), data.Int(1), data.Int(2)})
+			})
+
+			Convey("Then the bucket should be cleared after training", func() {
+				So(len(p.trained(bucket)), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given a batch bucket policy with size 1", t, func() {
+		p, err := newBucketPolicy(&MLParams{BatchSize: 1})
+		So(err, ShouldBeNil)
+
+		Convey("When store an array", func() {
+			arr := data.Array{data.Int(1), data.Int(2)}
+			bucket, ready, err := p.store(nil, arr)
+			So(err, ShouldBeNil)
+
+			Convey("Then the array should be regarded as a batch", func() {
+				So(ready, ShouldBeTrue)
+				So(bucket, ShouldResemble, []data.Value{data.Int(1), data.Int(2)})
+			})
+		})
+	})
+}
+
+func TestSlidingWindowBucketPolicy(t *testing.T) {
+	Convey("Given a sliding window bucket policy with size 3 and interval 2", t, func() {
+		p, err := newBucketPolicy(&MLParams{
+			BatchSize:     3,
+			BucketPolicy:  slidingWindowPolicy,
+			TrainInterval: 2,
+		})
+		So(err, ShouldBeNil)
+		bucket := []data.Value{}
+
+		Convey("When store five values", func() {
+			readies := []bool{}
+			samples := [][]data.Value{}
+			for i := 0; i < 5; i++ {
+				var ready bool
+				bucket, ready, err = p.store(bucket, data.Int(i))
+				So(err, ShouldBeNil)
+				if ready {
+					samples = append(samples, append([]data.Value(nil), p.sample(bucket)...))
+					bucket = p.trained(bucket)
+				}
+				readies = append(readies, ready)
+			}
+
+			Convey("Then samples should only have values stored since the last training", func() {
+				So(samples, ShouldResemble, [][]data.Value{
+					{data.Int(0), data.Int(1)},
+					{data.Int(2), data.Int(3)},
+				})
+			})
+
+			Convey("Then it should be ready every two values", func() {
+				So(readies, ShouldResemble, []bool{false, true, false, true, false})
+			})
+
+			Convey("Then the bucket should have the last three values", func() {
+				So(bucket, ShouldResemble, []data.Value{data.Int(2), data.Int(3), data.Int(4)})
+			})
+
+			Convey("And when reset the policy", func() {
+				p.reset()
+				bucket, ready, err := p.store(bucket[:0], data.Int(5))
+				So(err, ShouldBeNil)
+
+				Convey("Then the interval should be counted from the beginning", func() {
+					So(ready, ShouldBeFalse)
+					So(bucket, ShouldResemble, []data.Value{data.Int(5)})
+				})
+			})
+		})
+	})
+}
+
+func TestReservoirBucketPolicy(t *testing.T) {
+	Convey("Given a reservoir bucket policy with size 10", t, func() {
+		p, err := newBucketPolicy(&MLParams{
+			BatchSize:    10,
+			BucketPolicy: reservoirPolicy,
+		})
+		So(err, ShouldBeNil)
+		bucket := []data.Value{}
+
+		Convey("When store 1000 values", func() {
+			trained := 0
+			for i := 0; i < 1000; i++ {
+				var ready bool
+				bucket, ready, err = p.store(bucket, data.Int(i))
+				So(err, ShouldBeNil)
+				if ready {
+					bucket = p.trained(bucket)
+					trained++
+				}
+			}
+
+			Convey("Then it should be trained every batch_train_size values", func() {
+				So(trained, ShouldEqual, 100)
+			})
+
+			Convey("Then the sample should be empty after the training", func() {
+				So(p.sample(bucket), ShouldBeEmpty)
+			})
+
+			Convey("Then the bucket should keep a sample of the stream", func() {
+				So(len(bucket), ShouldEqual, 10)
+				later := 0
+				for _, v := range bucket {
+					if i, _ := data.AsInt(v); i >= 10 {
+						later++
+					}
+				}
+				So(later, ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
+
+func TestUnsupportedBucketPolicy(t *testing.T) {
+	Convey("Given MLParams having an unsupported bucket policy", t, func() {
+		params := &MLParams{
+			BatchSize:    10,
+			BucketPolicy: "fifo",
+		}
+
+		Convey("When create a bucket policy", func() {
+			_, err := newBucketPolicy(params)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestStratifiedBucketPolicy(t *testing.T) {
+	Convey("Given a stratified bucket policy with size 10 and max_per_class 3", t, func() {
+		p, err := newBucketPolicy(&MLParams{
+			BatchSize:    10,
+			BucketPolicy: stratifiedPolicy,
+			LabelPath:    "label",
+			MaxPerClass:  3,
+			Oversample:   true,
+		})
+		So(err, ShouldBeNil)
+		bucket := []data.Value{}
+
+		Convey("When store nine negatives and one positive", func() {
+			var ready bool
+			for i := 0; i < 10; i++ {
+				label := 0
+				if i == 4 {
+					label = 1
+				}
+				So(ready, ShouldBeFalse)
+				bucket, ready, err = p.store(bucket, data.Map{
+					"label": data.Int(label),
+					"id":    data.Int(i),
+				})
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then the bucket should be ready after the tenth value", func() {
+				So(ready, ShouldBeTrue)
+			})
+
+			Convey("Then the number of negatives should be capped", func() {
+				So(len(bucket), ShouldEqual, 4)
+				st := p.stats()
+				So(st["class_counts"], ShouldResemble, data.Map{
+					"0": data.Int(3),
+					"1": data.Int(1),
+				})
+				So(st["seen_class_counts"], ShouldResemble, data.Map{
+					"0": data.Int(9),
+					"1": data.Int(1),
+				})
+			})
+
+			Convey("Then the positive should be oversampled in the batch", func() {
+				b := p.batch(bucket)
+				So(len(b), ShouldEqual, 6)
+				positives := 0
+				for _, v := range b {
+					if v.(data.Map)["label"] == data.Int(1) {
+						positives++
+					}
+				}
+				So(positives, ShouldEqual, 3)
+			})
+
+			Convey("And when the bucket is trained", func() {
+				bucket = p.trained(bucket)
+
+				Convey("Then class counts in the bucket should be cleared", func() {
+					So(len(bucket), ShouldEqual, 0)
+					st := p.stats()
+					So(st["class_counts"], ShouldResemble, data.Map{})
+					So(st["seen_class_counts"], ShouldResemble, data.Map{
+						"0": data.Int(9),
+						"1": data.Int(1),
+					})
+				})
+			})
+		})
+
+		Convey("When store a value without a label", func() {
+			_, _, err := p.store(bucket, data.Map{"id": data.Int(1)})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
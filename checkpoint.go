@@ -0,0 +1,413 @@
+package pymlstate
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	checkpointIntervalPath = data.MustCompilePath("checkpoint_interval")
+	checkpointDirPath      = data.MustCompilePath("checkpoint_dir")
+	checkpointKeepPath     = data.MustCompilePath("checkpoint_keep")
+
+	checkpointCompressionPath       = data.MustCompilePath("checkpoint_compression")
+	checkpointEncryptionKeyFilePath = data.MustCompilePath("checkpoint_encryption_key_file")
+)
+
+const (
+	defaultCheckpointKeep = 5
+
+	checkpointPrefix = "checkpoint-"
+	checkpointSuffix = ".state"
+
+	// tempCheckpointPrefix is a prefix of a temporary file to which a
+	// checkpoint is written before it's renamed.
+	tempCheckpointPrefix = "." + checkpointPrefix
+
+	// checkpointTimeFormat has a fixed width so that names of checkpoints are
+	// sorted by their timestamps.
+	checkpointTimeFormat = "20060102T150405.000000000Z"
+)
+
+// checkpointConfig is a configuration of periodic checkpoints.
+type checkpointConfig struct {
+	interval time.Duration
+	dir      string
+	keep     int
+
+	// compression and keyFile are options of SAVE STATE with which
+	// checkpoints are written, see saveOptions.
+	compression string
+	keyFile     string
+}
+
+// parseCheckpointConfig parses parameters of checkpoints and removes them
+// from params. It returns nil when checkpoint_interval isn't given.
+//
+// checkpoint_interval: an interval of checkpoints, e.g. "10m" or a number of
+// seconds
+//
+// checkpoint_dir: a directory where checkpoints are written, it's required
+// when checkpoint_interval is given
+//
+// checkpoint_keep: the number of checkpoints kept in checkpoint_dir, older
+// ones are removed (default: 5)
+//
+// checkpoint_compression: "none" or "gzip", checkpoints are compressed in the
+// same way as compression of SAVE STATE (default: "none")
+//
+// checkpoint_encryption_key_file: a path to a file having a key of AES-GCM,
+// checkpoints are encrypted with it and restored with it in the same way as
+// encryption_key_file of SAVE STATE and LOAD STATE, checkpoints aren't
+// encrypted by default
+func parseCheckpointConfig(params data.Map) (*checkpointConfig, error) {
+	ci, err := params.Get(checkpointIntervalPath)
+	if err != nil {
+		for _, k := range []string{"checkpoint_dir", "checkpoint_keep",
+			"checkpoint_compression", "checkpoint_encryption_key_file"} {
+			if _, ok := params[k]; ok {
+				return nil, fmt.Errorf("%v requires checkpoint_interval", k)
+			}
+		}
+		return nil, nil
+	}
+
+	c := &checkpointConfig{
+		keep: defaultCheckpointKeep,
+	}
+	if c.interval, err = data.ToDuration(ci); err != nil {
+		return nil, fmt.Errorf("checkpoint_interval is invalid: %v", err)
+	}
+	if c.interval <= 0 {
+		return nil, errors.New("checkpoint_interval must be greater than 0")
+	}
+
+	cd, err := params.Get(checkpointDirPath)
+	if err != nil {
+		return nil, errors.New("checkpoint_dir is required when checkpoint_interval is given")
+	}
+	if c.dir, err = data.AsString(cd); err != nil {
+		return nil, err
+	}
+	if c.dir == "" {
+		return nil, errors.New("checkpoint_dir must not be empty")
+	}
+
+	if ck, err := params.Get(checkpointKeepPath); err == nil {
+		keep, err := data.AsInt(ck)
+		if err != nil {
+			return nil, err
+		}
+		if keep <= 0 {
+			return nil, errors.New("checkpoint_keep must be greater than 0")
+		}
+		c.keep = int(keep)
+	}
+
+	if cc, err := params.Get(checkpointCompressionPath); err == nil {
+		if c.compression, err = data.AsString(cc); err != nil {
+			return nil, err
+		}
+	}
+	if kf, err := params.Get(checkpointEncryptionKeyFilePath); err == nil {
+		if c.keyFile, err = data.AsString(kf); err != nil {
+			return nil, err
+		}
+	}
+	// the key file is read again when a checkpoint is written, but the
+	// options are validated here so that a broken configuration isn't
+	// found only by the background checkpointer
+	if _, _, err := saveOptions(c.saveParams()); err != nil {
+		return nil, fmt.Errorf("checkpoint options are invalid: %v", err)
+	}
+
+	delete(params, "checkpoint_interval")
+	delete(params, "checkpoint_dir")
+	delete(params, "checkpoint_keep")
+	delete(params, "checkpoint_compression")
+	delete(params, "checkpoint_encryption_key_file")
+	return c, nil
+}
+
+// saveParams returns parameters of SAVE STATE with which checkpoints are
+// written.
+func (c *checkpointConfig) saveParams() data.Map {
+	params := data.Map{}
+	if c.compression != "" {
+		params["compression"] = data.String(c.compression)
+	}
+	if c.keyFile != "" {
+		params["encryption_key_file"] = data.String(c.keyFile)
+	}
+	return params
+}
+
+// loadParams returns parameters of LOAD STATE with which checkpoints are
+// restored.
+func (c *checkpointConfig) loadParams() data.Map {
+	params := data.Map{}
+	if c.keyFile != "" {
+		params["encryption_key_file"] = data.String(c.keyFile)
+	}
+	return params
+}
+
+// checkpointer saves the state every interval in the background.
+type checkpointer struct {
+	config *checkpointConfig
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startCheckpointer starts saving the state periodically. A running
+// checkpointer is stopped. The state must not be locked.
+func (s *State) startCheckpointer(ctx *core.Context, c *checkpointConfig) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	s.stopCheckpointer()
+	if err := removeTempCheckpoints(c.dir); err != nil {
+		ctx.ErrLog(err).WithField("checkpoint_dir", c.dir).
+			Warn("pymlstate cannot remove incomplete checkpoints")
+	}
+
+	cp := &checkpointer{
+		config: c,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.cpMu.Lock()
+	s.checkpointer = cp
+	s.cpMu.Unlock()
+	go s.runCheckpointer(ctx, cp, atomic.LoadUint64(&s.trained))
+	return nil
+}
+
+// stopCheckpointer stops the checkpointer and waits until it finishes the
+// current checkpoint. The state must not be locked because the checkpoint
+// acquires the read lock.
+func (s *State) stopCheckpointer() {
+	s.cpMu.Lock()
+	cp := s.checkpointer
+	s.checkpointer = nil
+	s.cpMu.Unlock()
+	if cp == nil {
+		return
+	}
+	close(cp.stop)
+	<-cp.done
+}
+
+func (s *State) checkpointing() *checkpointConfig {
+	s.cpMu.Lock()
+	defer s.cpMu.Unlock()
+	if s.checkpointer == nil {
+		return nil
+	}
+	return s.checkpointer.config
+}
+
+// runCheckpointer writes checkpoints until the checkpointer is stopped. A
+// checkpoint is skipped when the model hasn't been trained since the last
+// one. last is the number of trainings when the checkpointer is started.
+func (s *State) runCheckpointer(ctx *core.Context, cp *checkpointer, last uint64) {
+	defer close(cp.done)
+	t := time.NewTicker(cp.config.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case <-t.C:
+		}
+
+		trained := atomic.LoadUint64(&s.trained)
+		if trained == last {
+			continue
+		}
+		path, err := s.checkpoint(ctx, cp.config)
+		if err != nil {
+			ctx.ErrLog(err).WithField("checkpoint_dir", cp.config.dir).
+				Error("pymlstate cannot write a checkpoint")
+			continue
+		}
+		last = trained
+		ctx.Log().WithField("path", path).Debug("pymlstate wrote a checkpoint")
+	}
+}
+
+// Checkpoint saves the state to a new checkpoint in checkpoint_dir and removes
+// old checkpoints. It returns the path of the checkpoint.
+func (s *State) Checkpoint(ctx *core.Context) (string, error) {
+	c := s.checkpointing()
+	if c == nil {
+		return "", errors.New("checkpoints aren't enabled, checkpoint_interval and checkpoint_dir are required")
+	}
+	return s.checkpoint(ctx, c)
+}
+
+func (s *State) checkpoint(ctx *core.Context, c *checkpointConfig) (string, error) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	if err := s.base.CheckTermination(); err != nil {
+		return "", err
+	}
+
+	name := checkpointPrefix + time.Now().UTC().Format(checkpointTimeFormat) +
+		checkpointSuffix
+	path := filepath.Join(c.dir, name)
+	if err := s.writeCheckpoint(ctx, c, path); err != nil {
+		return "", err
+	}
+	if err := pruneCheckpoints(c.dir, c.keep); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeCheckpoint writes the state to a temporary file and renames it so that
+// an incomplete checkpoint isn't left at path. A temporary file left by a
+// crash is removed by removeTempCheckpoints.
+func (s *State) writeCheckpoint(ctx *core.Context, c *checkpointConfig, path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), tempCheckpointPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := s.saveState(ctx, w, c.saveParams()); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// listCheckpoints returns names of checkpoints in dir from the oldest one.
+func listCheckpoints(dir string) ([]string, error) {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range fs {
+		n := f.Name()
+		if f.Mode().IsRegular() && strings.HasPrefix(n, checkpointPrefix) &&
+			strings.HasSuffix(n, checkpointSuffix) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// removeTempCheckpoints removes temporary files of checkpoints in dir which
+// were left by crashes while they were written. It's called when the
+// checkpointer starts, before it writes any checkpoint.
+func removeTempCheckpoints(dir string) error {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if f.Mode().IsRegular() && strings.HasPrefix(f.Name(), tempCheckpointPrefix) {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pruneCheckpoints(dir string, keep int) error {
+	names, err := listCheckpoints(dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// RestoreCheckpoint loads the model from a checkpoint in checkpoint_dir. The
+// latest checkpoint is loaded when name is empty. It returns the path of the
+// checkpoint.
+func (s *State) RestoreCheckpoint(ctx *core.Context, name string) (string, error) {
+	c := s.checkpointing()
+	if c == nil {
+		return "", errors.New("checkpoints aren't enabled, checkpoint_interval and checkpoint_dir are required")
+	}
+
+	if name == "" {
+		names, err := listCheckpoints(c.dir)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", fmt.Errorf("no checkpoint is found in '%v'", c.dir)
+		}
+		name = names[len(names)-1]
+	} else if filepath.Base(name) != name {
+		return "", fmt.Errorf("checkpoint must be a name of a file in checkpoint_dir: '%v'", name)
+	}
+
+	path := filepath.Join(c.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := s.Load(ctx, bufio.NewReader(f), c.loadParams()); err != nil {
+		return "", fmt.Errorf("cannot restore checkpoint '%v': %v", path, err)
+	}
+	return path, nil
+}
+
+// RestoreCheckpoint rolls the state back to a checkpoint. It loads the latest
+// checkpoint when name isn't given. It returns the path of the checkpoint.
+func RestoreCheckpoint(ctx *core.Context, stateName string, name ...string) (data.Value, error) {
+	s, err := lookupState(ctx, stateName)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) > 1 {
+		return nil, errors.New("pymlstate_restore_checkpoint takes at most one checkpoint name")
+	}
+	n := ""
+	if len(name) == 1 {
+		n = name[0]
+	}
+	path, err := s.RestoreCheckpoint(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return data.String(path), nil
+}
@@ -0,0 +1,275 @@
+package pymlstate
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCheckpointConfig(t *testing.T) {
+	Convey("Given parameters of checkpoints", t, func() {
+		params := data.Map{
+			"checkpoint_interval": data.String("10m"),
+			"checkpoint_dir":      data.String("/tmp/checkpoints"),
+			"checkpoint_keep":     data.Int(3),
+			"other":               data.Int(1),
+		}
+
+		Convey("When parse them", func() {
+			c, err := parseCheckpointConfig(params)
+			So(err, ShouldBeNil)
+
+			Convey("Then the config should be returned", func() {
+				So(c.interval, ShouldEqual, 10*time.Minute)
+				So(c.dir, ShouldEqual, "/tmp/checkpoints")
+				So(c.keep, ShouldEqual, 3)
+			})
+
+			Convey("Then they should be removed from parameters", func() {
+				So(params, ShouldResemble, data.Map{"other": data.Int(1)})
+			})
+
+			Convey("Then checkpoints should be saved without options", func() {
+				So(c.saveParams(), ShouldResemble, data.Map{})
+				So(c.loadParams(), ShouldResemble, data.Map{})
+			})
+		})
+
+		Convey("When parse them with options of the container", func() {
+			dir, err := ioutil.TempDir("", "pymlstate_checkpoint_test")
+			So(err, ShouldBeNil)
+			Reset(func() {
+				os.RemoveAll(dir)
+			})
+			keyFile := filepath.Join(dir, "key")
+			So(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0600), ShouldBeNil)
+			params["checkpoint_compression"] = data.String("gzip")
+			params["checkpoint_encryption_key_file"] = data.String(keyFile)
+			c, err := parseCheckpointConfig(params)
+			So(err, ShouldBeNil)
+
+			Convey("Then they should be passed to SAVE STATE and LOAD STATE", func() {
+				So(c.saveParams(), ShouldResemble, data.Map{
+					"compression":         data.String("gzip"),
+					"encryption_key_file": data.String(keyFile),
+				})
+				So(c.loadParams(), ShouldResemble, data.Map{
+					"encryption_key_file": data.String(keyFile),
+				})
+				So(params, ShouldResemble, data.Map{"other": data.Int(1)})
+			})
+		})
+
+		Convey("When parse parameters without checkpoint_interval", func() {
+			c, err := parseCheckpointConfig(data.Map{"other": data.Int(1)})
+
+			Convey("Then checkpoints should be disabled", func() {
+				So(err, ShouldBeNil)
+				So(c, ShouldBeNil)
+			})
+		})
+
+		Convey("When parse invalid parameters", func() {
+			cases := map[string]data.Map{
+				"no checkpoint_dir": data.Map{
+					"checkpoint_interval": data.Int(1),
+				},
+				"no checkpoint_interval": data.Map{
+					"checkpoint_dir": data.String("/tmp/checkpoints"),
+				},
+				"non-positive checkpoint_interval": data.Map{
+					"checkpoint_interval": data.Int(0),
+					"checkpoint_dir":      data.String("/tmp/checkpoints"),
+				},
+				"non-positive checkpoint_keep": data.Map{
+					"checkpoint_interval": data.Int(1),
+					"checkpoint_dir":      data.String("/tmp/checkpoints"),
+					"checkpoint_keep":     data.Int(0),
+				},
+				"unsupported checkpoint_compression": data.Map{
+					"checkpoint_interval":    data.Int(1),
+					"checkpoint_dir":         data.String("/tmp/checkpoints"),
+					"checkpoint_compression": data.String("lz4"),
+				},
+				"missing checkpoint_encryption_key_file": data.Map{
+					"checkpoint_interval":            data.Int(1),
+					"checkpoint_dir":                 data.String("/tmp/checkpoints"),
+					"checkpoint_encryption_key_file": data.String("/nonexistent/key"),
+				},
+				"checkpoint_compression without checkpoint_interval": data.Map{
+					"checkpoint_dir":         data.String("/tmp/checkpoints"),
+					"checkpoint_compression": data.String("gzip"),
+				},
+			}
+			for name, params := range cases {
+				params := params
+				Convey("Then it should fail with "+name, func() {
+					_, err := parseCheckpointConfig(params)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
+
+func TestStateCheckpoint(t *testing.T) {
+	Convey("Given a pymlstate with checkpoints", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		dir, err := ioutil.TempDir("", "pymlstate_checkpoint_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		s, err := New(&pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "TestClass",
+		}, &MLParams{BatchSize: 10}, data.Map{})
+		So(err, ShouldBeNil)
+		So(s.startCheckpointer(ctx, &checkpointConfig{
+			interval: 10 * time.Millisecond,
+			dir:      dir,
+			keep:     2,
+		}), ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		So(ctx.SharedStates.Add("pystate_test", "py", s), ShouldBeNil)
+
+		Convey("When the model isn't trained", func() {
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Then no checkpoint should be written", func() {
+				names, err := listCheckpoints(dir)
+				So(err, ShouldBeNil)
+				So(names, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the model is trained", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+			So(err, ShouldBeNil)
+
+			Convey("Then a checkpoint should be written in the background", func() {
+				var names []string
+				for i := 0; i < 200 && len(names) == 0; i++ {
+					time.Sleep(10 * time.Millisecond)
+					names, err = listCheckpoints(dir)
+					So(err, ShouldBeNil)
+				}
+				So(len(names), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the checkpointer starts with temporary files left by a crash", func() {
+			temp := filepath.Join(dir, tempCheckpointPrefix+"123")
+			So(ioutil.WriteFile(temp, []byte("incomplete"), 0644), ShouldBeNil)
+			other := filepath.Join(dir, "other")
+			So(ioutil.WriteFile(other, []byte("other"), 0644), ShouldBeNil)
+			So(s.startCheckpointer(ctx, s.checkpointing()), ShouldBeNil)
+
+			Convey("Then they should be removed", func() {
+				_, err := os.Stat(temp)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("Then other files should be kept", func() {
+				_, err := os.Stat(other)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When write checkpoints more than checkpoint_keep", func() {
+			var paths []string
+			for i := 0; i < 3; i++ {
+				p, err := s.Checkpoint(ctx)
+				So(err, ShouldBeNil)
+				paths = append(paths, p)
+			}
+
+			Convey("Then only the last checkpoints should be kept", func() {
+				names, err := listCheckpoints(dir)
+				So(err, ShouldBeNil)
+				So(names, ShouldResemble, []string{
+					filepath.Base(paths[1]), filepath.Base(paths[2]),
+				})
+			})
+
+			Convey("Then no temporary file should be left", func() {
+				fs, err := ioutil.ReadDir(dir)
+				So(err, ShouldBeNil)
+				So(len(fs), ShouldEqual, 2)
+			})
+
+			Convey("And when restore the latest checkpoint", func() {
+				p, err := RestoreCheckpoint(ctx, "pystate_test")
+
+				Convey("Then it should be loaded", func() {
+					So(err, ShouldBeNil)
+					So(p, ShouldEqual, data.String(paths[2]))
+				})
+			})
+
+			Convey("And when restore a checkpoint by its name", func() {
+				p, err := RestoreCheckpoint(ctx, "pystate_test", filepath.Base(paths[1]))
+
+				Convey("Then it should be loaded", func() {
+					So(err, ShouldBeNil)
+					So(p, ShouldEqual, data.String(paths[1]))
+				})
+			})
+
+			Convey("And when restore a checkpoint outside the directory", func() {
+				_, err := RestoreCheckpoint(ctx, "pystate_test", paths[1])
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+
+		Convey("When write a checkpoint with options of the container", func() {
+			keyFile := filepath.Join(dir, "key")
+			So(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0600), ShouldBeNil)
+			So(s.startCheckpointer(ctx, &checkpointConfig{
+				interval:    time.Hour,
+				dir:         dir,
+				keep:        2,
+				compression: container.CompressionGzip,
+				keyFile:     keyFile,
+			}), ShouldBeNil)
+			p, err := s.Checkpoint(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be compressed and encrypted", func() {
+				_, err := archive.ReadFile(p, nil)
+				So(err, ShouldNotBeNil)
+				key, err := container.ReadKeyFile(keyFile)
+				So(err, ShouldBeNil)
+				a, err := archive.ReadFile(p, key)
+				So(err, ShouldBeNil)
+				for _, e := range a.Header.Entries {
+					So(e.Flags, ShouldEqual, container.FlagGzip|container.FlagAESGCM)
+				}
+			})
+
+			Convey("And when restore it", func() {
+				_, err := RestoreCheckpoint(ctx, "pystate_test")
+
+				Convey("Then it should be loaded with the key", func() {
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,69 @@
+// Command pymlstate-inspect inspects states saved by pymlstate without
+// starting Python. It validates the format version, checksums, and sizes of
+// sections against the size of the file, prints MLParams, and reports where a
+// state is truncated or corrupted.
+//
+// Usage:
+//
+//  pymlstate-inspect [-key-file file] state...
+//
+// It exits with 1 when a problem is found in any of states.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"io"
+	"os"
+)
+
+func main() {
+	ok, err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pymlstate-inspect:", err)
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// run inspects states and returns false when a problem is found.
+func run(args []string, out io.Writer) (bool, error) {
+	fs := flag.NewFlagSet("pymlstate-inspect", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "a key file of encrypted states")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() == 0 {
+		return false, errors.New("a state file is required")
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = container.ReadKeyFile(*keyFile); err != nil {
+			return false, err
+		}
+	}
+
+	ok := true
+	for i, path := range fs.Args() {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "%v:\n", path)
+		rep, err := archive.Inspect(path, key)
+		if err != nil {
+			fmt.Fprintf(out, "problems:\n  %v\n", err)
+			ok = false
+			continue
+		}
+		fmt.Fprint(out, rep)
+		ok = ok && rep.OK()
+	}
+	return ok, nil
+}
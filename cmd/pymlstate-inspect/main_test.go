@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectCommand(t *testing.T) {
+	Convey("Given saved states", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_inspect_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		params, err := data.MarshalMsgpack(data.Map{
+			"batch_train_size": data.Int(10),
+		})
+		So(err, ShouldBeNil)
+		buf := bytes.NewBuffer(nil)
+		So((&archive.Archive{
+			Params: params,
+			Model:  []byte("pickled model"),
+		}).Write(buf, nil), ShouldBeNil)
+		b := buf.Bytes()
+
+		valid := filepath.Join(dir, "valid")
+		So(ioutil.WriteFile(valid, b, 0644), ShouldBeNil)
+		truncated := filepath.Join(dir, "truncated")
+		So(ioutil.WriteFile(truncated, b[:len(b)-1], 0644), ShouldBeNil)
+
+		Convey("When inspect the valid state", func() {
+			out := bytes.NewBuffer(nil)
+			ok, err := run([]string{valid}, out)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should print the state", func() {
+				So(ok, ShouldBeTrue)
+				So(out.String(), ShouldContainSubstring, "batch_train_size: 10")
+				So(out.String(), ShouldContainSubstring, "status: ok")
+			})
+		})
+
+		Convey("When inspect both states", func() {
+			out := bytes.NewBuffer(nil)
+			ok, err := run([]string{valid, truncated}, out)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should report the truncated state", func() {
+				So(ok, ShouldBeFalse)
+				So(out.String(), ShouldContainSubstring, truncated+":")
+				So(out.String(), ShouldContainSubstring, "truncated in section 'model'")
+			})
+		})
+
+		Convey("When inspect a missing file", func() {
+			ok, err := run([]string{filepath.Join(dir, "missing")}, bytes.NewBuffer(nil))
+
+			Convey("Then it should report a problem", func() {
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When run it without states", func() {
+			_, err := run(nil, bytes.NewBuffer(nil))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,195 @@
+// Command pymlstate-tool inspects, extracts, and repackages states saved by
+// pymlstate outside SensorBee so that trained models can be moved between
+// environments. It doesn't start Python.
+//
+// Usage:
+//
+//  pymlstate-tool inspect [-key-file file] state...
+//  pymlstate-tool extract [-key-file file] [-params file] -model file state
+//  pymlstate-tool pack (-params file | -from state) [-from-key-file file]
+//      [-compression none|gzip] [-key-file file] -model file -o file
+//
+// inspect prints the format, sections, and MLParams of states without
+// loading models. It validates checksums and sizes of sections against the
+// size of the file, reports where a state is truncated or corrupted, and
+// fails when a problem is found in any of states, like pymlstate-inspect.
+//
+// extract writes the Python payload and MLParams encoded in msgpack to files.
+// pack builds a state container from a Python payload and MLParams, which are
+// read from a file written by extract or from an existing state.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "pymlstate-tool:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("a command is required: inspect, extract, or pack")
+	}
+	switch args[0] {
+	case "inspect":
+		return inspect(args[1:], out)
+	case "extract":
+		return extract(args[1:])
+	case "pack":
+		return pack(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+}
+
+func readKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return container.ReadKeyFile(path)
+}
+
+// readState reads the state given as the only argument of a command.
+func readState(fs *flag.FlagSet, keyFile string) (*archive.Archive, error) {
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("%v requires a state file", fs.Name())
+	}
+	key, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return archive.ReadFile(fs.Arg(0), key)
+}
+
+func inspect(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "a key file of encrypted states")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("inspect requires a state file")
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	var broken []string
+	for i, path := range fs.Args() {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "%v:\n", path)
+		rep, err := archive.Inspect(path, key)
+		if err != nil {
+			fmt.Fprintf(out, "problems:\n  %v\n", err)
+			broken = append(broken, path)
+			continue
+		}
+		fmt.Fprint(out, rep)
+		if !rep.OK() {
+			broken = append(broken, path)
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("problems are found in %v", strings.Join(broken, ", "))
+	}
+	return nil
+}
+
+func extract(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "a key file of an encrypted state")
+	paramsFile := fs.String("params", "", "a file to which MLParams are written")
+	modelFile := fs.String("model", "", "a file to which the Python payload is written")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *modelFile == "" {
+		return errors.New("extract requires -model")
+	}
+	a, err := readState(fs, *keyFile)
+	if err != nil {
+		return err
+	}
+
+	if *paramsFile != "" {
+		if err := ioutil.WriteFile(*paramsFile, a.Params, 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(*modelFile, a.Model, 0644)
+}
+
+func pack(args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ContinueOnError)
+	paramsFile := fs.String("params", "", "a file having MLParams written by extract")
+	from := fs.String("from", "", "a state whose MLParams are used")
+	fromKeyFile := fs.String("from-key-file", "", "a key file of the state given by -from")
+	modelFile := fs.String("model", "", "a file having the Python payload")
+	compression := fs.String("compression", container.CompressionNone,
+		"a compression method of the new state, none or gzip")
+	keyFile := fs.String("key-file", "", "a key file to encrypt the new state")
+	output := fs.String("o", "", "a file to which the new state is written")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *modelFile == "" || *output == "" {
+		return errors.New("pack requires -model and -o")
+	}
+	if (*paramsFile == "") == (*from == "") {
+		return errors.New("pack requires either -params or -from")
+	}
+
+	a := &archive.Archive{}
+	if *paramsFile != "" {
+		p, err := ioutil.ReadFile(*paramsFile)
+		if err != nil {
+			return err
+		}
+		a.Params = p
+	} else {
+		key, err := readKey(*fromKeyFile)
+		if err != nil {
+			return err
+		}
+		src, err := archive.ReadFile(*from, key)
+		if err != nil {
+			return err
+		}
+		a.Params = src.Params
+	}
+	if _, err := a.DecodeParams(); err != nil {
+		return err
+	}
+	m, err := ioutil.ReadFile(*modelFile)
+	if err != nil {
+		return err
+	}
+	a.Model = m
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	return a.WriteFile(*output, &container.Options{
+		Compression: *compression,
+		Key:         key,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTool(t *testing.T) {
+	Convey("Given a saved state", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_tool_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		params, err := data.MarshalMsgpack(data.Map{
+			"batch_train_size": data.Int(10),
+			"bucket_policy":    data.String("batch"),
+		})
+		So(err, ShouldBeNil)
+		state := filepath.Join(dir, "state")
+		So((&archive.Archive{
+			Params: params,
+			Model:  []byte("pickled model"),
+		}).WriteFile(state, nil), ShouldBeNil)
+		keyFile := filepath.Join(dir, "key")
+		So(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0600), ShouldBeNil)
+
+		Convey("When inspect it", func() {
+			out := bytes.NewBuffer(nil)
+			So(run([]string{"inspect", state}, out), ShouldBeNil)
+
+			Convey("Then it should print the format and MLParams", func() {
+				s := out.String()
+				So(s, ShouldContainSubstring, "format: container (version 2)")
+				So(s, ShouldContainSubstring, "size=13 decoded_size=13 flags=none crc32=")
+				So(s, ShouldContainSubstring, "batch_train_size: 10")
+				So(s, ShouldContainSubstring, "status: ok")
+			})
+		})
+
+		Convey("When inspect it with a truncated copy", func() {
+			b, err := ioutil.ReadFile(state)
+			So(err, ShouldBeNil)
+			truncated := filepath.Join(dir, "truncated")
+			So(ioutil.WriteFile(truncated, b[:len(b)-1], 0644), ShouldBeNil)
+			out := bytes.NewBuffer(nil)
+			err = run([]string{"inspect", state, truncated}, out)
+
+			Convey("Then it should report the truncated state", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, truncated)
+				So(err.Error(), ShouldNotContainSubstring, state+",")
+				So(out.String(), ShouldContainSubstring, truncated+":")
+				So(out.String(), ShouldContainSubstring, "truncated in section 'model'")
+			})
+		})
+
+		Convey("When inspect a missing file", func() {
+			out := bytes.NewBuffer(nil)
+			err := run([]string{"inspect", filepath.Join(dir, "missing")}, out)
+
+			Convey("Then it should report a problem", func() {
+				So(err, ShouldNotBeNil)
+				So(out.String(), ShouldContainSubstring, "problems:")
+			})
+		})
+
+		Convey("When extract it", func() {
+			model := filepath.Join(dir, "model")
+			paramsFile := filepath.Join(dir, "params")
+			So(run([]string{"extract", "-model", model, "-params", paramsFile, state},
+				nil), ShouldBeNil)
+
+			Convey("Then the payload and MLParams should be written", func() {
+				b, err := ioutil.ReadFile(model)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "pickled model")
+				p, err := ioutil.ReadFile(paramsFile)
+				So(err, ShouldBeNil)
+				So(p, ShouldResemble, params)
+			})
+
+			Convey("And when pack them encrypted", func() {
+				packed := filepath.Join(dir, "packed")
+				So(run([]string{"pack", "-params", paramsFile, "-model", model,
+					"-compression", "gzip", "-key-file", keyFile, "-o", packed}, nil),
+					ShouldBeNil)
+
+				Convey("Then the new state should be inspected with the key", func() {
+					out := bytes.NewBuffer(nil)
+					So(run([]string{"inspect", "-key-file", keyFile, packed}, out),
+						ShouldBeNil)
+					So(out.String(), ShouldContainSubstring, "flags=gzip,aes-gcm")
+					So(out.String(), ShouldContainSubstring, "batch_train_size: 10")
+				})
+
+				Convey("Then the new state should not be inspected without the key", func() {
+					So(run([]string{"inspect", packed}, bytes.NewBuffer(nil)),
+						ShouldNotBeNil)
+				})
+			})
+
+			Convey("And when pack them with MLParams of the state", func() {
+				packed := filepath.Join(dir, "packed")
+				So(run([]string{"pack", "-from", state, "-model", model, "-o", packed},
+					nil), ShouldBeNil)
+
+				Convey("Then the new state should have the same contents", func() {
+					a, err := archive.ReadFile(packed, nil)
+					So(err, ShouldBeNil)
+					So(a.Params, ShouldResemble, params)
+					So(string(a.Model), ShouldEqual, "pickled model")
+				})
+			})
+		})
+
+		Convey("When run invalid commands", func() {
+			cases := map[string][]string{
+				"no command":           {},
+				"inspect without file": {"inspect"},
+				"unknown command":      {"show", state},
+				"extract without file": {"extract", "-model", filepath.Join(dir, "m")},
+				"pack without params": {"pack", "-model", state,
+					"-o", filepath.Join(dir, "p")},
+			}
+			for name, args := range cases {
+				args := args
+				Convey("Then it should fail with "+name, func() {
+					So(run(args, bytes.NewBuffer(nil)), ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
@@ -0,0 +1,265 @@
+// Package container provides a checksummed and self-describing format of
+// saved states. A container has named sections, and each section has its
+// size, CRC32, and SHA-256 in a section table so that corrupted or truncated
+// containers are detected before their contents are used.
+//
+// The layout of a container is as follows. All integers are little endian.
+//
+//  magic         8 bytes, "\x89PYMLST\n"
+//  version       uint16
+//  section count uint32
+//  section table section count entries of
+//                  name size uint8
+//                  name      name size bytes
+//                  flags     uint8, encoding of data (since version 2)
+//                  data size uint64
+//                  CRC32     uint32 (IEEE)
+//                  SHA-256   32 bytes
+//  table CRC32   uint32, CRC32 of all preceding bytes
+//  sections      data of sections in the order of the section table
+//
+// Data of sections can be compressed and encrypted. Sizes and checksums in
+// the section table are those of encoded data.
+package container
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Magic is the magic number of containers. The first byte is different from
+// version bytes of formats preceding containers.
+var Magic = [8]byte{0x89, 'P', 'Y', 'M', 'L', 'S', 'T', '\n'}
+
+const (
+	// Version is the format version of containers written by Write.
+	Version uint16 = 2
+
+	maxSections       = 1024
+	maxSectionNameLen = 255
+)
+
+// Section is a named section of a container.
+type Section struct {
+	Name string
+	Data []byte
+}
+
+// Entry is an entry of the section table.
+type Entry struct {
+	Name   string
+	Flags  uint8
+	Size   uint64
+	CRC32  uint32
+	SHA256 [sha256.Size]byte
+}
+
+// Header is the header of a container.
+type Header struct {
+	Version uint16
+	Entries []Entry
+}
+
+// Write writes sections as a container. Sections are encoded as opts
+// specifies, and opts can be nil.
+func Write(w io.Writer, sections []Section, opts *Options) error {
+	if len(sections) > maxSections {
+		return fmt.Errorf("too many sections: %v", len(sections))
+	}
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	flags := opts.flags()
+	encoded := make([]Section, len(sections))
+	for i, s := range sections {
+		if len(s.Name) == 0 || len(s.Name) > maxSectionNameLen {
+			return fmt.Errorf("length of section name must be in [1, %v]: '%v'",
+				maxSectionNameLen, s.Name)
+		}
+		d, err := encode(s, flags, opts)
+		if err != nil {
+			return err
+		}
+		encoded[i] = Section{
+			Name: s.Name,
+			Data: d,
+		}
+	}
+	sections = encoded
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(Magic[:])
+	binary.Write(buf, binary.LittleEndian, Version)
+	binary.Write(buf, binary.LittleEndian, uint32(len(sections)))
+	for _, s := range sections {
+		buf.WriteByte(byte(len(s.Name)))
+		buf.WriteString(s.Name)
+		buf.WriteByte(flags)
+		binary.Write(buf, binary.LittleEndian, uint64(len(s.Data)))
+		binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(s.Data))
+		sum := sha256.Sum256(s.Data)
+		buf.Write(sum[:])
+	}
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		if _, err := w.Write(s.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadHeader reads the magic number and the section table.
+func ReadHeader(r io.Reader) (*Header, error) {
+	// all bytes of the header are kept to verify the CRC32 of the table
+	buf := bytes.NewBuffer(nil)
+	tr := io.TeeReader(r, buf)
+
+	var magic [8]byte
+	if err := readFull(tr, magic[:], "magic number"); err != nil {
+		return nil, err
+	}
+	if magic != Magic {
+		return nil, errors.New("not a state container: invalid magic number")
+	}
+
+	h := &Header{}
+	if err := readFull(tr, &h.Version, "version"); err != nil {
+		return nil, err
+	}
+	if h.Version < 1 || h.Version > Version {
+		return nil, fmt.Errorf("unsupported version of state container: %v", h.Version)
+	}
+
+	var n uint32
+	if err := readFull(tr, &n, "section count"); err != nil {
+		return nil, err
+	}
+	if n > maxSections {
+		return nil, fmt.Errorf("state container is corrupted: too many sections: %v", n)
+	}
+
+	h.Entries = make([]Entry, n)
+	for i := range h.Entries {
+		e := &h.Entries[i]
+		var l uint8
+		if err := readFull(tr, &l, "section table"); err != nil {
+			return nil, err
+		}
+		name := make([]byte, l)
+		if err := readFull(tr, name, "section table"); err != nil {
+			return nil, err
+		}
+		e.Name = string(name)
+		if h.Version >= 2 {
+			if err := readFull(tr, &e.Flags, "section table"); err != nil {
+				return nil, err
+			}
+		}
+		if err := readFull(tr, &e.Size, "section table"); err != nil {
+			return nil, err
+		}
+		if err := readFull(tr, &e.CRC32, "section table"); err != nil {
+			return nil, err
+		}
+		if err := readFull(tr, e.SHA256[:], "section table"); err != nil {
+			return nil, err
+		}
+	}
+
+	expected := crc32.ChecksumIEEE(buf.Bytes())
+	var sum uint32
+	if err := readFull(r, &sum, "CRC32 of section table"); err != nil {
+		return nil, err
+	}
+	if sum != expected {
+		return nil, errors.New("state container is corrupted: CRC32 of section table doesn't match")
+	}
+	return h, nil
+}
+
+// ReadSection reads data of the section described by e and verifies its
+// checksums. It returns encoded data, which can be decoded by Decode.
+func ReadSection(r io.Reader, e *Entry) ([]byte, error) {
+	// a buffer grows as data is read so that a corrupted size doesn't
+	// allocate a huge buffer at once
+	buf := bytes.NewBuffer(nil)
+	n, err := io.CopyN(buf, r, int64(e.Size))
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("state container is truncated: section '%v' has %v bytes but %v bytes are expected",
+				e.Name, n, e.Size)
+		}
+		return nil, err
+	}
+
+	d := buf.Bytes()
+	if crc32.ChecksumIEEE(d) != e.CRC32 {
+		return nil, fmt.Errorf("state container is corrupted: CRC32 of section '%v' doesn't match", e.Name)
+	}
+	if sha256.Sum256(d) != e.SHA256 {
+		return nil, fmt.Errorf("state container is corrupted: SHA-256 of section '%v' doesn't match", e.Name)
+	}
+	return d, nil
+}
+
+// Read reads and decodes all sections of a container. key is required when
+// sections are encrypted.
+func Read(r io.Reader, key []byte) ([]Section, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make([]Section, len(h.Entries))
+	for i := range h.Entries {
+		e := &h.Entries[i]
+		d, err := ReadSection(r, e)
+		if err != nil {
+			return nil, err
+		}
+		if d, err = Decode(e, d, key); err != nil {
+			return nil, err
+		}
+		sections[i] = Section{
+			Name: e.Name,
+			Data: d,
+		}
+	}
+	return sections, nil
+}
+
+// Find returns data of the section having the name.
+func Find(sections []Section, name string) ([]byte, bool) {
+	for _, s := range sections {
+		if s.Name == name {
+			return s.Data, true
+		}
+	}
+	return nil, false
+}
+
+// readFull reads binary data and reports truncation with the name of the
+// field.
+func readFull(r io.Reader, v interface{}, field string) error {
+	var err error
+	if b, ok := v.([]byte); ok {
+		_, err = io.ReadFull(r, b)
+	} else {
+		err = binary.Read(r, binary.LittleEndian, v)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("state container is truncated: cannot read %v", field)
+	}
+	return err
+}
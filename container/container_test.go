@@ -0,0 +1,91 @@
+package container
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestContainer(t *testing.T) {
+	Convey("Given a container having two sections", t, func() {
+		sections := []Section{
+			{Name: "params", Data: []byte("parameters")},
+			{Name: "model", Data: bytes.Repeat([]byte{1, 2, 3}, 100)},
+		}
+		buf := bytes.NewBuffer(nil)
+		So(Write(buf, sections, nil), ShouldBeNil)
+		b := buf.Bytes()
+
+		Convey("When read the container", func() {
+			actual, err := Read(bytes.NewReader(b), nil)
+
+			Convey("Then it should have the same sections", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, sections)
+
+				d, ok := Find(actual, "model")
+				So(ok, ShouldBeTrue)
+				So(d, ShouldResemble, sections[1].Data)
+				_, ok = Find(actual, "unknown")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When read the header", func() {
+			h, err := ReadHeader(bytes.NewReader(b))
+
+			Convey("Then it should describe the sections", func() {
+				So(err, ShouldBeNil)
+				So(h.Version, ShouldEqual, Version)
+				So(len(h.Entries), ShouldEqual, 2)
+				So(h.Entries[0].Name, ShouldEqual, "params")
+				So(h.Entries[0].Size, ShouldEqual, 10)
+				So(h.Entries[1].Name, ShouldEqual, "model")
+				So(h.Entries[1].Size, ShouldEqual, 300)
+			})
+		})
+
+		Convey("When read any truncated container", func() {
+			Convey("Then it should fail with a truncation error", func() {
+				for i := 0; i < len(b); i++ {
+					_, err := Read(bytes.NewReader(b[:i]), nil)
+					So(err, ShouldNotBeNil)
+					if i >= len(Magic) {
+						So(err.Error(), ShouldContainSubstring, "truncated")
+					}
+				}
+			})
+		})
+
+		Convey("When read a container having any corrupted byte", func() {
+			Convey("Then it should fail", func() {
+				for i := 0; i < len(b); i++ {
+					c := make([]byte, len(b))
+					copy(c, b)
+					c[i] ^= 0xff
+					_, err := Read(bytes.NewReader(c), nil)
+					So(err, ShouldNotBeNil)
+				}
+			})
+		})
+
+		Convey("When read data which isn't a container", func() {
+			_, err := Read(bytes.NewReader([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0}), nil)
+
+			Convey("Then it should fail with an invalid magic number error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "magic number")
+			})
+		})
+	})
+
+	Convey("Given sections having invalid names", t, func() {
+		Convey("When write them", func() {
+			err := Write(bytes.NewBuffer(nil), []Section{{Name: ""}}, nil)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
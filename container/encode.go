@@ -0,0 +1,166 @@
+package container
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Flags of sections describing how data is encoded. Data is compressed
+// before it's encrypted.
+const (
+	// FlagGzip means data is compressed by gzip.
+	FlagGzip uint8 = 1 << iota
+
+	// FlagAESGCM means data is encrypted by AES-GCM. Encrypted data has a
+	// nonce followed by a ciphertext, and the name of the section is
+	// authenticated as additional data.
+	FlagAESGCM
+
+	knownFlags = FlagGzip | FlagAESGCM
+)
+
+// Compression methods of sections.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Options has options to encode sections.
+type Options struct {
+	// Compression is a compression method of sections.
+	Compression string
+
+	// Key is a key of AES-GCM, which must have 16, 24, or 32 bytes. Sections
+	// aren't encrypted when it's empty.
+	Key []byte
+}
+
+// Validate validates options.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	switch o.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("unsupported compression: '%v'", o.Compression)
+	}
+	if len(o.Key) > 0 {
+		if _, err := aes.NewCipher(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Options) flags() uint8 {
+	if o == nil {
+		return 0
+	}
+	var f uint8
+	if o.Compression == CompressionGzip {
+		f |= FlagGzip
+	}
+	if len(o.Key) > 0 {
+		f |= FlagAESGCM
+	}
+	return f
+}
+
+func encode(s Section, flags uint8, opts *Options) ([]byte, error) {
+	d := s.Data
+	if flags&FlagGzip != 0 {
+		buf := bytes.NewBuffer(nil)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(d); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		d = buf.Bytes()
+	}
+	if flags&FlagAESGCM != 0 {
+		gcm, err := newGCM(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		d = gcm.Seal(nonce, nonce, d, []byte(s.Name))
+	}
+	return d, nil
+}
+
+// Decode decodes data of a section read by ReadSection. key is required
+// when the section is encrypted.
+func Decode(e *Entry, d []byte, key []byte) ([]byte, error) {
+	if e.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("section '%v' has unsupported flags: 0x%02x",
+			e.Name, e.Flags)
+	}
+	if e.Flags&FlagAESGCM != 0 {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("section '%v' is encrypted but no key is given",
+				e.Name)
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(d) < gcm.NonceSize() {
+			return nil, fmt.Errorf("encrypted section '%v' is too short", e.Name)
+		}
+		d, err = gcm.Open(nil, d[:gcm.NonceSize()], d[gcm.NonceSize():],
+			[]byte(e.Name))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt section '%v', the key may be wrong: %v",
+				e.Name, err)
+		}
+	}
+	if e.Flags&FlagGzip != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(d))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress section '%v': %v", e.Name, err)
+		}
+		if d, err = ioutil.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("cannot decompress section '%v': %v", e.Name, err)
+		}
+	}
+	return d, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("key of AES-GCM must have 16, 24, or 32 bytes")
+	}
+	return cipher.NewGCM(b)
+}
+
+// ReadKeyFile reads a key of AES-GCM. The file has a raw key having 16, 24,
+// or 32 bytes, or a hex-encoded key.
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := hex.DecodeString(string(bytes.TrimSpace(b))); err == nil {
+		b = k
+	}
+	switch len(b) {
+	case 16, 24, 32:
+		return b, nil
+	}
+	return nil, fmt.Errorf("key in '%v' must have 16, 24, or 32 bytes", path)
+}
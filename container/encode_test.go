@@ -0,0 +1,129 @@
+package container
+
+import (
+	"bytes"
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodedContainer(t *testing.T) {
+	Convey("Given sections", t, func() {
+		sections := []Section{
+			{Name: "params", Data: []byte("parameters")},
+			{Name: "model", Data: bytes.Repeat([]byte("weights"), 1000)},
+		}
+		key := bytes.Repeat([]byte{7}, 32)
+
+		cases := map[string]*Options{
+			"compressed":                {Compression: CompressionGzip},
+			"encrypted":                 {Key: key},
+			"compressed and encrypted":  {Compression: CompressionGzip, Key: key},
+			"written without any codec": {Compression: CompressionNone},
+		}
+		for name, opts := range cases {
+			opts := opts
+			Convey("When write them "+name, func() {
+				buf := bytes.NewBuffer(nil)
+				So(Write(buf, sections, opts), ShouldBeNil)
+				b := buf.Bytes()
+
+				Convey("Then they should be read with the key", func() {
+					actual, err := Read(bytes.NewReader(b), key)
+					So(err, ShouldBeNil)
+					So(actual, ShouldResemble, sections)
+				})
+
+				Convey("Then flags should be recorded in the header", func() {
+					h, err := ReadHeader(bytes.NewReader(b))
+					So(err, ShouldBeNil)
+					for _, e := range h.Entries {
+						So(e.Flags, ShouldEqual, opts.flags())
+					}
+				})
+			})
+		}
+
+		Convey("When write repetitive data compressed", func() {
+			buf := bytes.NewBuffer(nil)
+			So(Write(buf, sections, &Options{Compression: CompressionGzip}), ShouldBeNil)
+
+			Convey("Then the container should be smaller than data", func() {
+				So(buf.Len(), ShouldBeLessThan, len(sections[1].Data))
+			})
+		})
+
+		Convey("When write them with a key", func() {
+			buf := bytes.NewBuffer(nil)
+			So(Write(buf, sections, &Options{Key: key}), ShouldBeNil)
+			b := buf.Bytes()
+
+			Convey("Then data should not be in plain text", func() {
+				So(bytes.Contains(b, []byte("parameters")), ShouldBeFalse)
+			})
+
+			Convey("Then they should not be read with a wrong key", func() {
+				_, err := Read(bytes.NewReader(b), bytes.Repeat([]byte{8}, 32))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "key may be wrong")
+			})
+
+			Convey("Then they should not be read without a key", func() {
+				_, err := Read(bytes.NewReader(b), nil)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "no key")
+			})
+		})
+
+		Convey("When write them with invalid options", func() {
+			Convey("Then it should fail", func() {
+				So(Write(bytes.NewBuffer(nil), sections,
+					&Options{Compression: "zip"}), ShouldNotBeNil)
+				So(Write(bytes.NewBuffer(nil), sections,
+					&Options{Key: []byte("short")}), ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestReadKeyFile(t *testing.T) {
+	Convey("Given key files", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_container_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		key := bytes.Repeat([]byte{3}, 16)
+		files := map[string][]byte{
+			"raw_key":   key,
+			"hex_key":   []byte(hex.EncodeToString(key) + "\n"),
+			"short_key": []byte("short"),
+		}
+		for name, b := range files {
+			So(ioutil.WriteFile(filepath.Join(dir, name), b, 0600), ShouldBeNil)
+		}
+
+		Convey("When read raw and hex-encoded keys", func() {
+			raw, err := ReadKeyFile(filepath.Join(dir, "raw_key"))
+			So(err, ShouldBeNil)
+			hexed, err := ReadKeyFile(filepath.Join(dir, "hex_key"))
+			So(err, ShouldBeNil)
+
+			Convey("Then they should be the same key", func() {
+				So(raw, ShouldResemble, key)
+				So(hexed, ShouldResemble, key)
+			})
+		})
+
+		Convey("When read a key having an invalid length", func() {
+			_, err := ReadKeyFile(filepath.Join(dir, "short_key"))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
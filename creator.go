@@ -11,6 +11,17 @@ import (
 
 var (
 	batchTrainSizePath = data.MustCompilePath("batch_train_size")
+	preprocessPath     = data.MustCompilePath("preprocess")
+	bucketPolicyPath   = data.MustCompilePath("bucket_policy")
+	trainIntervalPath  = data.MustCompilePath("train_interval")
+	labelPathPath      = data.MustCompilePath("label_path")
+	maxPerClassPath    = data.MustCompilePath("max_per_class")
+	oversamplePath     = data.MustCompilePath("oversample")
+
+	workersPath            = data.MustCompilePath("workers")
+	workerSyncIntervalPath = data.MustCompilePath("worker_sync_interval")
+	predictTimeoutPath     = data.MustCompilePath("predict_timeout")
+	fitTimeoutPath         = data.MustCompilePath("fit_timeout")
 )
 
 // StateCreator is used by BQL to create or load Multiple Layer Classification
@@ -22,7 +33,10 @@ var _ udf.UDSLoader = &StateCreator{}
 
 // CreateState creates `core.SharedState`. Some parameters are from pystate
 // package. See the document of pystate.BaseParams for details. pymlstate has
-// its own parameters, which is defined at MLParams.
+// its own parameters, which is defined at MLParams. The state saves itself
+// periodically when checkpoint_interval and checkpoint_dir are given, see
+// parseCheckpointConfig for details. The Python model runs in a child process
+// when backend is "process", see parseBackendParams for details.
 func (c *StateCreator) CreateState(ctx *core.Context, params data.Map) (
 	core.SharedState, error) {
 	bp, err := pystate.ExtractBaseParams(params, true)
@@ -30,28 +44,220 @@ func (c *StateCreator) CreateState(ctx *core.Context, params data.Map) (
 		return nil, err
 	}
 
-	batchSize := 1
-	if bs, err := params.Get(batchTrainSizePath); err == nil {
-		var batchSize64 int64
-		if batchSize64, err = data.AsInt(bs); err != nil {
+	mlParams := &MLParams{
+		BatchSize:    1,
+		BucketPolicy: batchPolicy,
+	}
+	if err := parseMLParams(params, mlParams); err != nil {
+		return nil, err
+	}
+	if err := parseBackendParams(params, mlParams, false); err != nil {
+		return nil, err
+	}
+	cc, err := parseCheckpointConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := New(bp, mlParams, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resizeWorkers(ctx); err != nil {
+		s.Terminate(ctx)
+		return nil, err
+	}
+	if cc != nil {
+		if err := s.startCheckpointer(ctx, cc); err != nil {
+			s.Terminate(ctx)
 			return nil, err
 		}
+	}
+	return s, nil
+}
+
+// parseMLParams overrides mlParams with parameters given in params, and
+// removes them from params so that they aren't passed to Python. Parameters
+// are validated together with those which aren't given.
+func parseMLParams(params data.Map, mlParams *MLParams) error {
+	if bs, err := params.Get(batchTrainSizePath); err == nil {
+		batchSize64, err := data.AsInt(bs)
+		if err != nil {
+			return err
+		}
 		if batchSize64 <= 0 {
-			return nil, fmt.Errorf("batch_train_size must be greater than 0")
+			return fmt.Errorf("batch_train_size must be greater than 0")
 		}
-		batchSize = int(batchSize64)
+		mlParams.BatchSize = int(batchSize64)
 		delete(params, "batch_train_size")
 	}
 
-	return New(bp, &MLParams{BatchSize: batchSize}, params)
+	if bp, err := params.Get(bucketPolicyPath); err == nil {
+		bucketPolicy, err := data.AsString(bp)
+		if err != nil {
+			return err
+		}
+		switch bucketPolicy {
+		case batchPolicy, slidingWindowPolicy, reservoirPolicy, stratifiedPolicy:
+		default:
+			return fmt.Errorf("unsupported bucket_policy: %v", bucketPolicy)
+		}
+		if bucketPolicy != mlParams.BucketPolicy {
+			// parameters of the previous policy don't apply to the new one
+			mlParams.TrainInterval = 0
+			mlParams.LabelPath = ""
+			mlParams.MaxPerClass = 0
+			mlParams.Oversample = false
+		}
+		mlParams.BucketPolicy = bucketPolicy
+		delete(params, "bucket_policy")
+	}
+	bucketPolicy := mlParams.BucketPolicy
+	if bucketPolicy == "" {
+		bucketPolicy = batchPolicy
+	}
+
+	if ti, err := params.Get(trainIntervalPath); err == nil {
+		trainInterval64, err := data.AsInt(ti)
+		if err != nil {
+			return err
+		}
+		if trainInterval64 <= 0 {
+			return fmt.Errorf("train_interval must be greater than 0")
+		}
+		mlParams.TrainInterval = int(trainInterval64)
+		delete(params, "train_interval")
+	}
+	if mlParams.TrainInterval > 0 && bucketPolicy != slidingWindowPolicy &&
+		bucketPolicy != reservoirPolicy {
+		return fmt.Errorf("train_interval cannot be used with the %v bucket_policy",
+			bucketPolicy)
+	}
+
+	if lp, err := params.Get(labelPathPath); err == nil {
+		labelPath, err := data.AsString(lp)
+		if err != nil {
+			return err
+		}
+		if _, err := data.CompilePath(labelPath); err != nil {
+			return fmt.Errorf("label_path is invalid: %v", err)
+		}
+		mlParams.LabelPath = labelPath
+		delete(params, "label_path")
+	}
+	if bucketPolicy == stratifiedPolicy && mlParams.LabelPath == "" {
+		return fmt.Errorf("label_path is required by the stratified bucket_policy")
+	}
+
+	if mpc, err := params.Get(maxPerClassPath); err == nil {
+		maxPerClass64, err := data.AsInt(mpc)
+		if err != nil {
+			return err
+		}
+		if maxPerClass64 <= 0 {
+			return fmt.Errorf("max_per_class must be greater than 0")
+		}
+		mlParams.MaxPerClass = int(maxPerClass64)
+		delete(params, "max_per_class")
+	}
+
+	if ov, err := params.Get(oversamplePath); err == nil {
+		if mlParams.Oversample, err = data.AsBool(ov); err != nil {
+			return err
+		}
+		delete(params, "oversample")
+	}
+	if (mlParams.MaxPerClass > 0 || mlParams.Oversample) && bucketPolicy != stratifiedPolicy {
+		return fmt.Errorf("max_per_class and oversample can only be used with the stratified bucket_policy")
+	}
+
+	if w, err := params.Get(workersPath); err == nil {
+		workers64, err := data.AsInt(w)
+		if err != nil {
+			return err
+		}
+		if workers64 <= 0 {
+			return fmt.Errorf("workers must be greater than 0")
+		}
+		mlParams.Workers = int(workers64)
+		delete(params, "workers")
+	}
+
+	if wsi, err := params.Get(workerSyncIntervalPath); err == nil {
+		interval64, err := data.AsInt(wsi)
+		if err != nil {
+			return err
+		}
+		if interval64 <= 0 {
+			return fmt.Errorf("worker_sync_interval must be greater than 0")
+		}
+		mlParams.WorkerSyncInterval = int(interval64)
+		delete(params, "worker_sync_interval")
+	}
+
+	if pt, err := params.Get(predictTimeoutPath); err == nil {
+		timeout, err := data.ToDuration(pt)
+		if err != nil {
+			return fmt.Errorf("predict_timeout is invalid: %v", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("predict_timeout must be greater than 0")
+		}
+		mlParams.PredictTimeout = timeout
+		delete(params, "predict_timeout")
+	}
+
+	if ft, err := params.Get(fitTimeoutPath); err == nil {
+		timeout, err := data.ToDuration(ft)
+		if err != nil {
+			return fmt.Errorf("fit_timeout is invalid: %v", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("fit_timeout must be greater than 0")
+		}
+		mlParams.FitTimeout = timeout
+		delete(params, "fit_timeout")
+	}
+
+	if err := parseBreakerParams(params, mlParams); err != nil {
+		return err
+	}
+	if err := parsePredictFallback(params, mlParams); err != nil {
+		return err
+	}
+
+	if pp, err := params.Get(preprocessPath); err == nil {
+		spec, err := data.AsArray(pp)
+		if err != nil {
+			return fmt.Errorf("preprocess must be an array: %v", err)
+		}
+		if mlParams.Preprocess, err = NewPreprocessor(spec); err != nil {
+			return err
+		}
+		delete(params, "preprocess")
+	}
+	return nil
 }
 
-// LoadState is same as CREATE STATE.
+// LoadState is same as CREATE STATE. Parameters of MLParams given in params
+// override saved ones.
 func (c *StateCreator) LoadState(ctx *core.Context, r io.Reader, params data.Map) (
 	core.SharedState, error) {
+	params = params.Copy()
+	cc, err := parseCheckpointConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &State{}
 	if err := s.load(ctx, r, params); err != nil {
 		return nil, err
 	}
+	if cc != nil {
+		if err := s.startCheckpointer(ctx, cc); err != nil {
+			s.Terminate(ctx)
+			return nil, err
+		}
+	}
 	return s, nil
 }
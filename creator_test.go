@@ -3,8 +3,12 @@ package pymlstate
 import (
 	"bytes"
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
 	"gopkg.in/sensorbee/sensorbee.v0/core"
 	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -58,6 +62,107 @@ func TestCreatePyMLState(t *testing.T) {
 				So(cap(ps.bucket), ShouldEqual, 50)
 			})
 		})
+
+		Convey("When create a pymlstate with a sliding window bucket policy", func() {
+			params := data.Map{
+				"module_path":      data.String("./"),
+				"module_name":      data.String("_test_pymlstate"),
+				"class_name":       data.String("TestClass"),
+				"batch_train_size": data.Int(50),
+				"bucket_policy":    data.String("sliding_window"),
+				"train_interval":   data.Int(5),
+			}
+			s, err := sc.CreateState(ctx, params)
+			So(err, ShouldBeNil)
+			Reset(func() {
+				s.Terminate(ctx)
+			})
+			Convey("Then the state should be set up with the policy", func() {
+				ps, ok := s.(*State)
+				So(ok, ShouldBeTrue)
+				So(ps.params.BucketPolicy, ShouldEqual, "sliding_window")
+				So(ps.params.TrainInterval, ShouldEqual, 5)
+				_, ok = ps.policy.(*slidingWindowBucket)
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		invalidBucketParams := map[string]data.Map{
+			"an unsupported bucket_policy": data.Map{
+				"bucket_policy": data.String("fifo"),
+			},
+			"a non-positive train_interval": data.Map{
+				"bucket_policy":  data.String("reservoir"),
+				"train_interval": data.Int(0),
+			},
+			"train_interval with the batch policy": data.Map{
+				"train_interval": data.Int(5),
+			},
+			"the stratified policy without label_path": data.Map{
+				"bucket_policy": data.String("stratified"),
+			},
+			"max_per_class with the batch policy": data.Map{
+				"max_per_class": data.Int(5),
+			},
+			"a non-positive max_per_class": data.Map{
+				"bucket_policy": data.String("stratified"),
+				"label_path":    data.String("label"),
+				"max_per_class": data.Int(0),
+			},
+		}
+		for name, ps := range invalidBucketParams {
+			ps := ps
+			Convey("When create a pymlstate with "+name, func() {
+				params := data.Map{
+					"module_path": data.String("./"),
+					"module_name": data.String("_test_pymlstate"),
+					"class_name":  data.String("TestClass"),
+				}
+				for k, v := range ps {
+					params[k] = v
+				}
+				_, err := sc.CreateState(ctx, params)
+				Convey("Then creator should return an error", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+
+		Convey("When create a pymlstate with preprocess parameter", func() {
+			params := data.Map{
+				"module_path": data.String("./"),
+				"module_name": data.String("_test_pymlstate"),
+				"class_name":  data.String("TestClass"),
+				"preprocess": data.Array{
+					data.Map{"path": data.String("x"), "type": data.String("standard")},
+				},
+			}
+			s, err := sc.CreateState(ctx, params)
+			So(err, ShouldBeNil)
+			Reset(func() {
+				s.Terminate(ctx)
+			})
+			Convey("Then the state should have the preprocessor", func() {
+				ps, ok := s.(*State)
+				So(ok, ShouldBeTrue)
+				So(ps.params.Preprocess, ShouldNotBeNil)
+				So(len(ps.params.Preprocess.Steps), ShouldEqual, 1)
+				So(ps.params.Preprocess.Steps[0].Type, ShouldEqual, "standard")
+			})
+		})
+
+		Convey("When create a pymlstate with invalid preprocess parameter", func() {
+			params := data.Map{
+				"module_path": data.String("./"),
+				"module_name": data.String("_test_pymlstate"),
+				"class_name":  data.String("TestClass"),
+				"preprocess":  data.String("standard"),
+			}
+			_, err := sc.CreateState(ctx, params)
+			Convey("Then creator should return an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
 	})
 }
 
@@ -100,6 +205,230 @@ func TestLoadPyMLState(t *testing.T) {
 						So(ps2.params.BatchSize, ShouldEqual, 50)
 					})
 				})
+
+				Convey("And when load the state with parameters", func() {
+					s2, err := sc.LoadState(ctx, buf, data.Map{
+						"batch_train_size": data.Int(100),
+						"bucket_policy":    data.String("sliding_window"),
+					})
+					So(err, ShouldBeNil)
+					Reset(func() {
+						s2.Terminate(ctx)
+					})
+					Convey("Then the parameters should override saved ones", func() {
+						ps2, ok := s2.(*State)
+						So(ok, ShouldBeTrue)
+						So(ps2.params.BatchSize, ShouldEqual, 100)
+						So(ps2.params.BucketPolicy, ShouldEqual, "sliding_window")
+					})
+				})
+			})
+
+			Convey("And when save the state compressed and encrypted", func() {
+				dir, err := ioutil.TempDir("", "pymlstate_creator_test")
+				So(err, ShouldBeNil)
+				Reset(func() {
+					os.RemoveAll(dir)
+				})
+				keyFile := filepath.Join(dir, "key")
+				So(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0600), ShouldBeNil)
+
+				ps, ok := s.(*State)
+				So(ok, ShouldBeTrue)
+				buf := bytes.NewBuffer(nil)
+				err = ps.Save(ctx, buf, data.Map{
+					"compression":         data.String("gzip"),
+					"encryption_key_file": data.String(keyFile),
+				})
+				So(err, ShouldBeNil)
+
+				Convey("And when load the state with the key", func() {
+					s2, err := sc.LoadState(ctx, buf, data.Map{
+						"encryption_key_file": data.String(keyFile),
+					})
+					So(err, ShouldBeNil)
+					Reset(func() {
+						s2.Terminate(ctx)
+					})
+					Convey("Then the state should be loaded validly", func() {
+						ps2, ok := s2.(*State)
+						So(ok, ShouldBeTrue)
+						So(ps2.params.BatchSize, ShouldEqual, 50)
+					})
+				})
+			})
+		})
+	})
+}
+
+func TestParseMLParams(t *testing.T) {
+	Convey("Given saved parameters of the stratified policy", t, func() {
+		mp := MLParams{
+			BatchSize:    10,
+			BucketPolicy: stratifiedPolicy,
+			LabelPath:    "label",
+			MaxPerClass:  5,
+			Oversample:   true,
+		}
+
+		Convey("When parse parameters overriding some of them", func() {
+			params := data.Map{
+				"batch_train_size": data.Int(20),
+				"max_per_class":    data.Int(7),
+				"other":            data.Int(1),
+			}
+			err := parseMLParams(params, &mp)
+
+			Convey("Then only given parameters should be overridden", func() {
+				So(err, ShouldBeNil)
+				So(mp.BatchSize, ShouldEqual, 20)
+				So(mp.BucketPolicy, ShouldEqual, stratifiedPolicy)
+				So(mp.LabelPath, ShouldEqual, "label")
+				So(mp.MaxPerClass, ShouldEqual, 7)
+				So(mp.Oversample, ShouldBeTrue)
+			})
+
+			Convey("Then parsed parameters should be removed", func() {
+				So(params, ShouldResemble, data.Map{"other": data.Int(1)})
+			})
+		})
+
+		Convey("When parse parameters changing the policy", func() {
+			err := parseMLParams(data.Map{
+				"bucket_policy":  data.String("reservoir"),
+				"train_interval": data.Int(4),
+			}, &mp)
+
+			Convey("Then parameters of the previous policy should be cleared", func() {
+				So(err, ShouldBeNil)
+				So(mp.BucketPolicy, ShouldEqual, reservoirPolicy)
+				So(mp.TrainInterval, ShouldEqual, 4)
+				So(mp.LabelPath, ShouldBeBlank)
+				So(mp.MaxPerClass, ShouldEqual, 0)
+				So(mp.Oversample, ShouldBeFalse)
+			})
+		})
+
+		Convey("When parse parameters invalid with saved ones", func() {
+			err := parseMLParams(data.Map{
+				"train_interval": data.Int(4),
+			}, &mp)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "train_interval")
+			})
+		})
+	})
+}
+
+func TestLoadBrokenPyMLState(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a saved state container", t, func() {
+		sc := StateCreator{}
+		s := &State{
+			params: MLParams{
+				BatchSize: 10,
+			},
+		}
+		out, err := s.encodeParams()
+		So(err, ShouldBeNil)
+		buf := bytes.NewBuffer(nil)
+		So(container.Write(buf, []container.Section{
+			{Name: paramsSection, Data: out},
+			{Name: modelSection, Data: []byte("pickled model")},
+		}, nil), ShouldBeNil)
+		b := buf.Bytes()
+
+		Convey("When load the truncated container", func() {
+			_, err := sc.LoadState(ctx, bytes.NewReader(b[:len(b)-1]), data.Map{})
+
+			Convey("Then it should fail before loading the model", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "truncated")
+			})
+		})
+
+		Convey("When load the corrupted container", func() {
+			b[len(b)-1] ^= 0xff
+			_, err := sc.LoadState(ctx, bytes.NewReader(b), data.Map{})
+
+			Convey("Then it should fail before loading the model", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "corrupted")
+			})
+		})
+
+		Convey("When load a container without the model", func() {
+			buf := bytes.NewBuffer(nil)
+			So(container.Write(buf, []container.Section{
+				{Name: paramsSection, Data: out},
+			}, nil), ShouldBeNil)
+			_, err := sc.LoadState(ctx, buf, data.Map{})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, modelSection)
+			})
+		})
+
+		Convey("When load a truncated state of the previous format", func() {
+			v1 := []byte{pyMLStateFormatVersion, byte(len(out)), 0, 0, 0}
+			v1 = append(v1, out[:len(out)-1]...)
+			_, err := sc.LoadState(ctx, bytes.NewReader(v1), data.Map{})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When load the container with invalid parameters", func() {
+			cases := map[string]data.Map{
+				"non-positive batch_train_size": data.Map{"batch_train_size": data.Int(0)},
+				"unsupported bucket_policy":     data.Map{"bucket_policy": data.String("unknown")},
+				"train_interval with batch":     data.Map{"train_interval": data.Int(3)},
+				"stratified without label_path": data.Map{"bucket_policy": data.String("stratified")},
+			}
+			for name, params := range cases {
+				name, params := name, params
+				Convey("Then it should fail with "+name, func() {
+					_, err := sc.LoadState(ctx, bytes.NewReader(b), params)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+
+		Convey("When load an encrypted container", func() {
+			dir, err := ioutil.TempDir("", "pymlstate_creator_test")
+			So(err, ShouldBeNil)
+			Reset(func() {
+				os.RemoveAll(dir)
+			})
+			keyFile := filepath.Join(dir, "key")
+			So(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 16), 0600), ShouldBeNil)
+			wrongKeyFile := filepath.Join(dir, "wrong_key")
+			So(ioutil.WriteFile(wrongKeyFile, bytes.Repeat([]byte{2}, 16), 0600), ShouldBeNil)
+
+			buf := bytes.NewBuffer(nil)
+			So(container.Write(buf, []container.Section{
+				{Name: paramsSection, Data: out},
+				{Name: modelSection, Data: []byte("pickled model")},
+			}, &container.Options{Key: bytes.Repeat([]byte{1}, 16)}), ShouldBeNil)
+			b := buf.Bytes()
+
+			Convey("Then it should fail with a wrong key", func() {
+				_, err := sc.LoadState(ctx, bytes.NewReader(b), data.Map{
+					"encryption_key_file": data.String(wrongKeyFile),
+				})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "key may be wrong")
+			})
+
+			Convey("Then it should fail without a key", func() {
+				_, err := sc.LoadState(ctx, bytes.NewReader(b), data.Map{})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "no key")
 			})
 		})
 	})
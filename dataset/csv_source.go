@@ -0,0 +1,429 @@
+package dataset
+
+import (
+	"encoding/csv"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	fileNamePath       = data.MustCompilePath("file_name")
+	delimiterPath      = data.MustCompilePath("delimiter")
+	headerPath         = data.MustCompilePath("header")
+	featureColumnsPath = data.MustCompilePath("feature_columns")
+	labelColumnPath    = data.MustCompilePath("label_column")
+	columnTypesPath    = data.MustCompilePath("column_types")
+	featuresFieldPath  = data.MustCompilePath("features_field")
+	labelFieldPath     = data.MustCompilePath("label_field")
+)
+
+// Types of CSV columns.
+const (
+	csvFloat  = "float"
+	csvInt    = "int"
+	csvBool   = "bool"
+	csvString = "string"
+	csvAuto   = "auto"
+)
+
+// CSVSourceCreator is a creator of a source reading CSV or TSV files.
+type CSVSourceCreator struct{}
+
+// CreateSource returns a source which emits rows of a CSV or TSV file as
+// feature arrays and labels. The file is parsed when the source is created,
+// and it can be compressed by gzip.
+//
+// Columns are specified by names in the header or by zero-origin indices.
+// Values are converted to the types of columns. An empty value is converted
+// to null except for string columns.
+//
+// WITH parameters
+//
+// file_name: CSV or TSV file path [required]
+//
+// delimiter: a delimiter of fields (default: "\t" when file_name ends with
+// ".tsv" or ".tsv.gz", "," otherwise)
+//
+// header: the first row is a header or not (default: detected from the first
+// two rows, which is a header when all fields of the first row aren't numbers
+// and the second row has a number)
+//
+// feature_columns: an array of columns of features (default: all columns
+// except the label column)
+//
+// label_column: a column of labels, tuples don't have labels when it's
+// omitted
+//
+// column_types: a map from columns to types, "float", "int", "bool",
+// "string", or "auto" which converts a value to int, float, or string in
+// that order (default: "float" for features, "auto" for labels)
+//
+// features_field: a field name of features (default: "data")
+//
+// label_field: a field name of labels (default: "label")
+//
+// rewind: the source can be rewound (default: false)
+//
+// Parameters of NewGenerator are also available.
+//
+// Output:
+//  data.Map{
+//    "data":  [features] (data.Array),
+//    "label": [label] (only when label_column is given),
+//  }
+func (c *CSVSourceCreator) CreateSource(ctx *core.Context, ioParams *bql.IOParams,
+	params data.Map) (core.Source, error) {
+	s, err := createCSVSource(params)
+	if err != nil {
+		return nil, err
+	}
+
+	rewind := false
+	if rf, err := params.Get(rewindPath); err == nil {
+		if rewind, err = data.AsBool(rf); err != nil {
+			return nil, err
+		}
+	}
+
+	if rewind {
+		return core.NewRewindableSource(s), nil
+	}
+	return s, nil
+}
+
+// csvColumn is a column converted to a value of a tuple.
+type csvColumn struct {
+	index int
+	typ   string
+}
+
+func createCSVSource(params data.Map) (*csvSource, error) {
+	fileName := ""
+	if fn, err := params.Get(fileNamePath); err != nil {
+		return nil, err
+	} else if fileName, err = data.AsString(fn); err != nil {
+		return nil, err
+	}
+
+	delimiter := ','
+	if strings.HasSuffix(fileName, ".tsv") || strings.HasSuffix(fileName, ".tsv.gz") {
+		delimiter = '\t'
+	}
+	if d, err := params.Get(delimiterPath); err == nil {
+		ds, err := data.AsString(d)
+		if err != nil {
+			return nil, err
+		}
+		if utf8.RuneCountInString(ds) != 1 {
+			return nil, fmt.Errorf("delimiter must be a character: '%v'", ds)
+		}
+		delimiter, _ = utf8.DecodeRuneInString(ds)
+	}
+
+	rows, err := readCSVFile(fileName, delimiter)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("CSV file '%v' has no rows", fileName)
+	}
+
+	hasHeader := false
+	if h, err := params.Get(headerPath); err == nil {
+		if hasHeader, err = data.AsBool(h); err != nil {
+			return nil, err
+		}
+	} else {
+		hasHeader = detectCSVHeader(rows)
+	}
+	var header []string
+	if hasHeader {
+		header, rows = rows[0], rows[1:]
+	}
+	numColumns := len(header)
+	if header == nil {
+		numColumns = len(rows[0])
+	}
+	resolve := func(v data.Value) (int, error) {
+		return resolveCSVColumn(v, header, numColumns)
+	}
+
+	types := map[int]string{}
+	if ct, err := params.Get(columnTypesPath); err == nil {
+		m, err := data.AsMap(ct)
+		if err != nil {
+			return nil, err
+		}
+		for k, t := range m {
+			var col data.Value = data.String(k)
+			if header == nil {
+				// columns are indices when there's no header
+				i, err := strconv.Atoi(k)
+				if err != nil {
+					return nil, fmt.Errorf("column must be an index when the file doesn't have a header: '%v'", k)
+				}
+				col = data.Int(i)
+			}
+			i, err := resolve(col)
+			if err != nil {
+				return nil, err
+			}
+			typ, err := data.AsString(t)
+			if err != nil {
+				return nil, err
+			}
+			switch typ {
+			case csvFloat, csvInt, csvBool, csvString, csvAuto:
+			default:
+				return nil, fmt.Errorf("unsupported column type: '%v'", typ)
+			}
+			types[i] = typ
+		}
+	}
+	typeOf := func(i int, def string) string {
+		if t, ok := types[i]; ok {
+			return t
+		}
+		return def
+	}
+
+	var label *csvColumn
+	if lc, err := params.Get(labelColumnPath); err == nil {
+		i, err := resolve(lc)
+		if err != nil {
+			return nil, err
+		}
+		label = &csvColumn{
+			index: i,
+			typ:   typeOf(i, csvAuto),
+		}
+	}
+
+	var features []csvColumn
+	if fc, err := params.Get(featureColumnsPath); err == nil {
+		cols, err := data.AsArray(fc)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cols {
+			i, err := resolve(c)
+			if err != nil {
+				return nil, err
+			}
+			features = append(features, csvColumn{
+				index: i,
+				typ:   typeOf(i, csvFloat),
+			})
+		}
+	} else {
+		for i := 0; i < numColumns; i++ {
+			if label != nil && label.index == i {
+				continue
+			}
+			features = append(features, csvColumn{
+				index: i,
+				typ:   typeOf(i, csvFloat),
+			})
+		}
+	}
+	if len(features) == 0 {
+		return nil, fmt.Errorf("no feature columns")
+	}
+
+	featuresField := "data"
+	if ff, err := params.Get(featuresFieldPath); err == nil {
+		if featuresField, err = data.AsString(ff); err != nil {
+			return nil, err
+		}
+	}
+	labelField := "label"
+	if lf, err := params.Get(labelFieldPath); err == nil {
+		if labelField, err = data.AsString(lf); err != nil {
+			return nil, err
+		}
+	}
+	if featuresField == "" || labelField == "" || featuresField == labelField {
+		return nil, fmt.Errorf("features_field and label_field must be different non-empty names")
+	}
+
+	line := 1
+	if hasHeader {
+		line++
+	}
+	s := &csvSource{
+		rows: make([]data.Map, len(rows)),
+	}
+	for r, row := range rows {
+		if len(row) != numColumns {
+			return nil, fmt.Errorf("line %v of '%v' has %v fields but %v fields are expected",
+				line+r, fileName, len(row), numColumns)
+		}
+		fs := make(data.Array, len(features))
+		for j, c := range features {
+			v, err := coerceCSVValue(row[c.index], c.typ)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert column %v at line %v of '%v': %v",
+					c.index, line+r, fileName, err)
+			}
+			fs[j] = v
+		}
+		m := data.Map{
+			featuresField: fs,
+		}
+		if label != nil {
+			v, err := coerceCSVValue(row[label.index], label.typ)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert column %v at line %v of '%v': %v",
+					label.index, line+r, fileName, err)
+			}
+			m[labelField] = v
+		}
+		s.rows[r] = m
+	}
+	if s.Generator, err = NewGenerator("csv_source", s, params); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readCSVFile(path string, delimiter rune) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(br)
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1
+	if delimiter == '\t' {
+		r.LazyQuotes = true
+	}
+
+	var rows [][]string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CSV file '%v': %v", path, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// detectCSVHeader returns true when all fields of the first row aren't
+// numbers and the second row has a number.
+func detectCSVHeader(rows [][]string) bool {
+	if len(rows) < 2 {
+		return false
+	}
+	for _, f := range rows[0] {
+		if isCSVNumber(f) {
+			return false
+		}
+	}
+	for _, f := range rows[1] {
+		if isCSVNumber(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCSVNumber(s string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return err == nil
+}
+
+func resolveCSVColumn(v data.Value, header []string, numColumns int) (int, error) {
+	switch v.Type() {
+	case data.TypeInt:
+		i, _ := data.AsInt(v)
+		if i < 0 || int(i) >= numColumns {
+			return 0, fmt.Errorf("column index is out of range: %v", i)
+		}
+		return int(i), nil
+	case data.TypeString:
+		name, _ := data.AsString(v)
+		for i, h := range header {
+			if h == name {
+				return i, nil
+			}
+		}
+		if header == nil {
+			return 0, fmt.Errorf("column must be an index when the file doesn't have a header: '%v'", name)
+		}
+		return 0, fmt.Errorf("column '%v' is not found in the header", name)
+	}
+	return 0, fmt.Errorf("column must be a name or an index: %v", v)
+}
+
+func coerceCSVValue(s string, typ string) (data.Value, error) {
+	if typ == csvString {
+		return data.String(s), nil
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return data.Null{}, nil
+	}
+
+	switch typ {
+	case csvFloat:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return data.Float(f), nil
+	case csvInt:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return data.Int(i), nil
+	case csvBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+		return data.Bool(b), nil
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return data.Int(i), nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return data.Float(f), nil
+	}
+	return data.String(s), nil
+}
+
+// csvSource is a source emitting rows of a CSV file.
+type csvSource struct {
+	*Generator
+
+	rows []data.Map
+}
+
+// Len returns the number of rows.
+func (s *csvSource) Len() int {
+	return len(s.rows)
+}
+
+// Record returns the i-th row.
+func (s *csvSource) Record(i int) (data.Map, error) {
+	return s.rows[i].Copy(), nil
+}
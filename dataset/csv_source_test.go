@@ -0,0 +1,184 @@
+package dataset
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSVSource(t *testing.T) {
+	ctx := core.NewContext(&core.ContextConfig{})
+	ioParams := &bql.IOParams{}
+	Convey("Given CSV and TSV files", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_csv_source_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		write := func(name string, b []byte) string {
+			path := filepath.Join(dir, name)
+			So(ioutil.WriteFile(path, b, 0644), ShouldBeNil)
+			return path
+		}
+		withHeader := write("header.csv", []byte(
+			"height,weight,name,class\n1.5,60,a,cat\n,70,b,dog\n"))
+		noHeader := write("no_header.tsv.gz", gzipBytes([]byte(
+			"1\t0.5\tyes\n2\t1.5\tno\n")))
+
+		c := &CSVSourceCreator{}
+		generate := func(s core.Source) []data.Map {
+			var ts []data.Map
+			w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				ts = append(ts, t.Data)
+				return nil
+			})
+			So(s.GenerateStream(ctx, w), ShouldBeNil)
+			return ts
+		}
+
+		Convey("When create a source with column names", func() {
+			s, err := c.CreateSource(ctx, ioParams, data.Map{
+				"file_name":       data.String(withHeader),
+				"feature_columns": data.Array{data.String("height"), data.String("weight")},
+				"label_column":    data.String("class"),
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then the header should be detected and rows should be emitted", func() {
+				So(generate(s), ShouldResemble, []data.Map{
+					{
+						"data":  data.Array{data.Float(1.5), data.Float(60)},
+						"label": data.String("cat"),
+					},
+					{
+						"data":  data.Array{data.Null{}, data.Float(70)},
+						"label": data.String("dog"),
+					},
+				})
+			})
+		})
+
+		Convey("When create a source of a gzip-compressed TSV file with column indices", func() {
+			s, err := c.CreateSource(ctx, ioParams, data.Map{
+				"file_name":      data.String(noHeader),
+				"label_column":   data.Int(0),
+				"column_types":   data.Map{"2": data.String("string")},
+				"features_field": data.String("x"),
+				"label_field":    data.String("y"),
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then other columns should be features with their types", func() {
+				So(generate(s), ShouldResemble, []data.Map{
+					{
+						"x": data.Array{data.Float(0.5), data.String("yes")},
+						"y": data.Int(1),
+					},
+					{
+						"x": data.Array{data.Float(1.5), data.String("no")},
+						"y": data.Int(2),
+					},
+				})
+			})
+		})
+
+		Convey("When create a source treating the header as data", func() {
+			s, err := createCSVSource(data.Map{
+				"file_name":       data.String(withHeader),
+				"header":          data.Bool(false),
+				"feature_columns": data.Array{data.Int(2)},
+				"column_types":    data.Map{"2": data.String("string")},
+			})
+
+			Convey("Then all rows should be data", func() {
+				So(err, ShouldBeNil)
+				So(len(s.rows), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When create a source with a value which cannot be converted", func() {
+			_, err := c.CreateSource(ctx, ioParams, data.Map{
+				"file_name":       data.String(withHeader),
+				"feature_columns": data.Array{data.String("name")},
+			})
+
+			Convey("Then it should fail with the line number", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "line 2")
+			})
+		})
+
+		Convey("When create a source with invalid parameters", func() {
+			cases := map[string]data.Map{
+				"unknown column": {
+					"file_name":    data.String(withHeader),
+					"label_column": data.String("age"),
+				},
+				"column index out of range": {
+					"file_name":    data.String(withHeader),
+					"label_column": data.Int(4),
+				},
+				"column name without header": {
+					"file_name":    data.String(noHeader),
+					"label_column": data.String("class"),
+				},
+				"unknown type": {
+					"file_name":    data.String(withHeader),
+					"column_types": data.Map{"height": data.String("double")},
+				},
+				"long delimiter": {
+					"file_name": data.String(withHeader),
+					"delimiter": data.String(",,"),
+				},
+				"no file name": {},
+			}
+			for name, params := range cases {
+				params := params
+				Convey("Then it should fail with "+name, func() {
+					_, err := c.CreateSource(ctx, ioParams, params)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
+
+func TestCoerceCSVValue(t *testing.T) {
+	Convey("Given CSV values", t, func() {
+		Convey("When convert them with auto type", func() {
+			Convey("Then they should be converted to int, float, or string", func() {
+				cases := map[string]data.Value{
+					"1":   data.Int(1),
+					"1.5": data.Float(1.5),
+					"a":   data.String("a"),
+					" ":   data.Null{},
+				}
+				for s, v := range cases {
+					actual, err := coerceCSVValue(s, csvAuto)
+					So(err, ShouldBeNil)
+					So(actual, ShouldResemble, v)
+				}
+			})
+		})
+
+		Convey("When convert them with explicit types", func() {
+			Convey("Then they should be converted to the types", func() {
+				v, err := coerceCSVValue("true", csvBool)
+				So(err, ShouldBeNil)
+				So(v, ShouldEqual, data.Bool(true))
+
+				v, err = coerceCSVValue("", csvString)
+				So(err, ShouldBeNil)
+				So(v, ShouldEqual, data.String(""))
+
+				_, err = coerceCSVValue("1.5", csvInt)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
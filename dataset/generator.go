@@ -0,0 +1,295 @@
+package dataset
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	tuplesPerSecondPath = data.MustCompilePath("tuples_per_second")
+	shuffleOnRewindPath = data.MustCompilePath("shuffle_on_rewind")
+	shufflePath         = data.MustCompilePath("shuffle")
+	seedPath            = data.MustCompilePath("seed")
+	shardIndexPath      = data.MustCompilePath("shard_index")
+	shardCountPath      = data.MustCompilePath("shard_count")
+	offsetPath          = data.MustCompilePath("offset")
+	limitPath           = data.MustCompilePath("limit")
+)
+
+// Records is a dataset emitted by Generator. When it implements io.Closer,
+// it's closed after the generator is stopped and GenerateStream returns.
+type Records interface {
+	// Len returns the number of records.
+	Len() int
+
+	// Record returns the i-th record as data of a tuple.
+	Record(i int) (data.Map, error)
+}
+
+// Generator generates a stream of records. Sources of datasets embed it to
+// implement core.Source. GenerateStream can be called again after the source
+// is rewound.
+type Generator struct {
+	sourceType      string
+	records         Records
+	tuplesPerSecond float64
+	shuffleOnRewind bool
+	rand            *rand.Rand
+
+	// indices has indices of records emitted by the generator in the order
+	// of the first emission.
+	indices []int
+
+	mu        sync.Mutex
+	stop      chan struct{}
+	stopped   bool
+	running   int
+	generated int
+}
+
+// NewGenerator returns a generator of records. sourceType is used for logs.
+//
+// Records to be emitted are selected by offset and limit first. Then, they're
+// shuffled when shuffle is true, and split into shard_count shards. Sources
+// having the same offset, limit, seed, and shard_count emit disjoint records
+// when they have different shard_index.
+//
+// WITH parameters
+//
+// offset: the index of the first record (default: 0)
+//
+// limit: the maximum number of records, no limit when it's omitted
+//
+// shuffle: emit records in random order (default: false)
+//
+// seed: a seed of shuffling, a random seed when it's omitted. It's required
+// when shuffle is true and shard_count is greater than 1
+//
+// shard_count: the number of shards (default: 1)
+//
+// shard_index: the zero-origin index of the shard emitted by the source
+// (default: 0)
+//
+// tuples_per_second: the maximum number of tuples emitted in a second, no
+// limit when it's 0 (default: 0)
+//
+// shuffle_on_rewind: shuffle records of the shard each time the source is
+// rewound (default: false)
+func NewGenerator(sourceType string, records Records, params data.Map) (*Generator, error) {
+	g := &Generator{
+		sourceType: sourceType,
+		records:    records,
+		stop:       make(chan struct{}),
+	}
+
+	if tps, err := params.Get(tuplesPerSecondPath); err == nil {
+		if g.tuplesPerSecond, err = data.ToFloat(tps); err != nil {
+			return nil, err
+		}
+		if g.tuplesPerSecond < 0 {
+			return nil, fmt.Errorf("tuples_per_second must not be negative")
+		}
+	}
+
+	if sr, err := params.Get(shuffleOnRewindPath); err == nil {
+		if g.shuffleOnRewind, err = data.AsBool(sr); err != nil {
+			return nil, err
+		}
+	}
+
+	shuffle := false
+	if sh, err := params.Get(shufflePath); err == nil {
+		if shuffle, err = data.AsBool(sh); err != nil {
+			return nil, err
+		}
+	}
+	seed := time.Now().UnixNano()
+	hasSeed := false
+	if sd, err := params.Get(seedPath); err == nil {
+		if seed, err = data.AsInt(sd); err != nil {
+			return nil, err
+		}
+		hasSeed = true
+	}
+	g.rand = rand.New(rand.NewSource(seed))
+
+	shardCount := int64(1)
+	if sc, err := params.Get(shardCountPath); err == nil {
+		if shardCount, err = data.AsInt(sc); err != nil {
+			return nil, err
+		}
+		if shardCount <= 0 {
+			return nil, fmt.Errorf("shard_count must be greater than 0")
+		}
+	}
+	shardIndex := int64(0)
+	if si, err := params.Get(shardIndexPath); err == nil {
+		if shardIndex, err = data.AsInt(si); err != nil {
+			return nil, err
+		}
+		if shardIndex < 0 || shardIndex >= shardCount {
+			return nil, fmt.Errorf("shard_index must be in [0, %v)", shardCount)
+		}
+	}
+	if shuffle && shardCount > 1 && !hasSeed {
+		return nil, fmt.Errorf("seed is required to shuffle sharded records")
+	}
+
+	n := int64(records.Len())
+	offset := int64(0)
+	if of, err := params.Get(offsetPath); err == nil {
+		if offset, err = data.AsInt(of); err != nil {
+			return nil, err
+		}
+		if offset < 0 || offset > n {
+			return nil, fmt.Errorf("offset must be in [0, %v]", n)
+		}
+	}
+	end := n
+	if li, err := params.Get(limitPath); err == nil {
+		limit, err := data.AsInt(li)
+		if err != nil {
+			return nil, err
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("limit must not be negative")
+		}
+		if offset+limit < end {
+			end = offset + limit
+		}
+	}
+
+	selected := make([]int, end-offset)
+	for i := range selected {
+		selected[i] = int(offset) + i
+	}
+	if shuffle {
+		shuffleIndices(selected, g.rand)
+	}
+	for i := int(shardIndex); i < len(selected); i += int(shardCount) {
+		g.indices = append(g.indices, selected[i])
+	}
+	return g, nil
+}
+
+// order returns indices of records in the order of emission.
+func (g *Generator) order() []int {
+	ord := make([]int, len(g.indices))
+	copy(ord, g.indices)
+	if g.shuffleOnRewind && g.generated > 0 {
+		shuffleIndices(ord, g.rand)
+	}
+	g.generated++
+	return ord
+}
+
+func shuffleIndices(ind []int, r *rand.Rand) {
+	for i := len(ind) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		ind[i], ind[j] = ind[j], ind[i]
+	}
+}
+
+// GenerateStream emits records until all records are emitted or the source
+// is stopped.
+func (g *Generator) GenerateStream(ctx *core.Context, w core.Writer) error {
+	g.mu.Lock()
+	if g.stopped {
+		g.mu.Unlock()
+		return nil
+	}
+	g.running++
+	stop := g.stop
+	ord := g.order()
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.running--
+		g.closeRecords(ctx)
+	}()
+
+	var interval time.Duration
+	if g.tuplesPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / g.tuplesPerSecond)
+	}
+	next := time.Now()
+	for _, i := range ord {
+		if interval > 0 {
+			now := time.Now()
+			if next.After(now) {
+				select {
+				case <-stop:
+					return nil
+				case <-time.After(next.Sub(now)):
+				}
+			} else if now.Sub(next) > interval {
+				// don't emit a burst of tuples after a slow write
+				next = now
+			}
+			next = next.Add(interval)
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		m, err := g.records.Record(i)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		t := &core.Tuple{
+			Data:          m,
+			Timestamp:     now,
+			ProcTimestamp: now,
+			Trace:         []core.TraceEvent{},
+		}
+		if err := w.Write(ctx, t); err != nil {
+			if err == core.ErrSourceRewound || err == core.ErrSourceStopped ||
+				core.IsFatalError(err) {
+				return err
+			}
+			ctx.ErrLog(err).WithField("source_type", g.sourceType).
+				Warn("Cannot write a tuple")
+		}
+	}
+
+	ctx.Log().WithField("source_type", g.sourceType).Info(
+		"All tuples have been emitted")
+	return nil
+}
+
+// Stop stops generating stream. GenerateStream returns before emitting the
+// next tuple.
+func (g *Generator) Stop(ctx *core.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.stopped {
+		close(g.stop)
+		g.stopped = true
+	}
+	g.closeRecords(ctx)
+	return nil
+}
+
+// closeRecords closes records when the generator is stopped and no
+// GenerateStream is running. g.mu must be locked.
+func (g *Generator) closeRecords(ctx *core.Context) {
+	if !g.stopped || g.running > 0 || g.records == nil {
+		return
+	}
+	if c, ok := g.records.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			ctx.ErrLog(err).WithField("source_type", g.sourceType).
+				Warn("Cannot close records")
+		}
+	}
+	g.records = nil
+}
@@ -0,0 +1,232 @@
+package dataset
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"sort"
+	"testing"
+	"time"
+)
+
+type intRecords int
+
+func (r intRecords) Len() int {
+	return int(r)
+}
+
+func (r intRecords) Record(i int) (data.Map, error) {
+	return data.Map{"id": data.Int(i)}, nil
+}
+
+func TestGenerator(t *testing.T) {
+	ctx := core.NewContext(&core.ContextConfig{})
+	Convey("Given a generator of 5 records", t, func() {
+		var ids []int
+		w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			id, _ := data.AsInt(t.Data["id"])
+			ids = append(ids, int(id))
+			return nil
+		})
+
+		Convey("When generate a stream", func() {
+			g, err := NewGenerator("test", intRecords(5), data.Map{})
+			So(err, ShouldBeNil)
+			So(g.GenerateStream(ctx, w), ShouldBeNil)
+
+			Convey("Then all records should be emitted in order", func() {
+				So(ids, ShouldResemble, []int{0, 1, 2, 3, 4})
+			})
+		})
+
+		Convey("When generate a stream with shuffle_on_rewind", func() {
+			g, err := NewGenerator("test", intRecords(100), data.Map{
+				"shuffle_on_rewind": data.Bool(true),
+			})
+			So(err, ShouldBeNil)
+			So(g.GenerateStream(ctx, w), ShouldBeNil)
+			first := ids
+			ids = nil
+			So(g.GenerateStream(ctx, w), ShouldBeNil)
+
+			Convey("Then the first stream should be in order", func() {
+				for i, id := range first {
+					So(id, ShouldEqual, i)
+				}
+			})
+
+			Convey("Then the rewound stream should be a shuffled permutation", func() {
+				So(ids, ShouldNotResemble, first)
+				sorted := append([]int{}, ids...)
+				sort.Ints(sorted)
+				So(sorted, ShouldResemble, first)
+			})
+		})
+
+		Convey("When generate a stream with tuples_per_second", func() {
+			g, err := NewGenerator("test", intRecords(5), data.Map{
+				"tuples_per_second": data.Int(100),
+			})
+			So(err, ShouldBeNil)
+			start := time.Now()
+			So(g.GenerateStream(ctx, w), ShouldBeNil)
+
+			Convey("Then emission should be rate limited", func() {
+				So(len(ids), ShouldEqual, 5)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+			})
+		})
+
+		Convey("When stop a rate limited generator", func() {
+			g, err := NewGenerator("test", intRecords(1000), data.Map{
+				"tuples_per_second": data.Int(10),
+			})
+			So(err, ShouldBeNil)
+			done := make(chan error, 1)
+			go func() {
+				done <- g.GenerateStream(ctx, core.WriterFunc(
+					func(ctx *core.Context, t *core.Tuple) error {
+						return nil
+					}))
+			}()
+			time.Sleep(50 * time.Millisecond)
+			So(g.Stop(ctx), ShouldBeNil)
+
+			Convey("Then GenerateStream should return promptly", func() {
+				select {
+				case err := <-done:
+					So(err, ShouldBeNil)
+				case <-time.After(time.Second):
+					So("GenerateStream didn't return", ShouldBeNil)
+				}
+				So(g.Stop(ctx), ShouldBeNil)
+			})
+		})
+
+		Convey("When a write fails", func() {
+			g, err := NewGenerator("test", intRecords(5), data.Map{})
+			So(err, ShouldBeNil)
+
+			Convey("Then a temporary error should be ignored", func() {
+				err := g.GenerateStream(ctx, core.WriterFunc(
+					func(ctx *core.Context, t *core.Tuple) error {
+						ids = append(ids, 0)
+						return errors.New("temporary")
+					}))
+				So(err, ShouldBeNil)
+				So(len(ids), ShouldEqual, 5)
+			})
+
+			Convey("Then a fatal error should stop the stream", func() {
+				err := g.GenerateStream(ctx, core.WriterFunc(
+					func(ctx *core.Context, t *core.Tuple) error {
+						ids = append(ids, 0)
+						return core.FatalError(errors.New("fatal"))
+					}))
+				So(err, ShouldNotBeNil)
+				So(len(ids), ShouldEqual, 1)
+			})
+
+			Convey("Then ErrSourceStopped should be returned", func() {
+				err := g.GenerateStream(ctx, core.WriterFunc(
+					func(ctx *core.Context, t *core.Tuple) error {
+						return core.ErrSourceStopped
+					}))
+				So(err, ShouldEqual, core.ErrSourceStopped)
+			})
+		})
+
+		Convey("When generate a stream with offset and limit", func() {
+			g, err := NewGenerator("test", intRecords(5), data.Map{
+				"offset": data.Int(1),
+				"limit":  data.Int(3),
+			})
+			So(err, ShouldBeNil)
+			So(g.GenerateStream(ctx, w), ShouldBeNil)
+
+			Convey("Then only the selected records should be emitted", func() {
+				So(ids, ShouldResemble, []int{1, 2, 3})
+			})
+		})
+
+		Convey("When generate shuffled streams with the same seed", func() {
+			params := data.Map{
+				"shuffle": data.Bool(true),
+				"seed":    data.Int(7),
+			}
+			g1, err := NewGenerator("test", intRecords(100), params)
+			So(err, ShouldBeNil)
+			g2, err := NewGenerator("test", intRecords(100), params)
+			So(err, ShouldBeNil)
+			So(g1.GenerateStream(ctx, w), ShouldBeNil)
+			first := ids
+			ids = nil
+			So(g2.GenerateStream(ctx, w), ShouldBeNil)
+
+			Convey("Then they should be the same shuffled permutation", func() {
+				So(ids, ShouldResemble, first)
+				sorted := append([]int{}, ids...)
+				sort.Ints(sorted)
+				So(sorted, ShouldNotResemble, ids)
+				So(len(sorted), ShouldEqual, 100)
+			})
+		})
+
+		Convey("When generate all shards of a shuffled dataset", func() {
+			var all []int
+			for i := 0; i < 3; i++ {
+				ids = nil
+				g, err := NewGenerator("test", intRecords(10), data.Map{
+					"shuffle":     data.Bool(true),
+					"seed":        data.Int(1),
+					"shard_count": data.Int(3),
+					"shard_index": data.Int(i),
+					"offset":      data.Int(2),
+				})
+				So(err, ShouldBeNil)
+				So(g.GenerateStream(ctx, w), ShouldBeNil)
+				all = append(all, ids...)
+			}
+
+			Convey("Then shards should be disjoint and cover the selected records", func() {
+				sort.Ints(all)
+				So(all, ShouldResemble, []int{2, 3, 4, 5, 6, 7, 8, 9})
+			})
+		})
+
+		Convey("When create a generator with invalid selection parameters", func() {
+			cases := map[string]data.Map{
+				"negative offset":  {"offset": data.Int(-1)},
+				"too large offset": {"offset": data.Int(6)},
+				"negative limit":   {"limit": data.Int(-1)},
+				"zero shard_count": {"shard_count": data.Int(0)},
+				"shard_index out of range": {
+					"shard_count": data.Int(2),
+					"shard_index": data.Int(2),
+				},
+				"sharded shuffle without seed": {
+					"shuffle":     data.Bool(true),
+					"shard_count": data.Int(2),
+				},
+			}
+			for name, params := range cases {
+				params := params
+				Convey("Then it should fail with "+name, func() {
+					_, err := NewGenerator("test", intRecords(5), params)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+
+		Convey("When create a generator with a negative rate", func() {
+			_, err := NewGenerator("test", intRecords(5), data.Map{
+				"tuples_per_second": data.Int(-1),
+			})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
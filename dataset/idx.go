@@ -0,0 +1,359 @@
+// Package dataset provides sources which read datasets from files to train
+// pymlstate.
+package dataset
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Type codes of IDX files. See http://yann.lecun.com/exdb/mnist/
+const (
+	IDXUnsignedByte byte = 0x08
+	IDXSignedByte   byte = 0x09
+	IDXShort        byte = 0x0B
+	IDXInt          byte = 0x0C
+	IDXFloat        byte = 0x0D
+	IDXDouble       byte = 0x0E
+)
+
+// IDXHeader is a header of an IDX file.
+type IDXHeader struct {
+	// TypeCode is a type of elements.
+	TypeCode byte
+
+	// Dims has sizes of all dimensions. The first dimension is the number
+	// of records.
+	Dims []int
+}
+
+// Count returns the number of records.
+func (h *IDXHeader) Count() int {
+	return h.Dims[0]
+}
+
+// Shape returns dimensions of a record.
+func (h *IDXHeader) Shape() []int {
+	return h.Dims[1:]
+}
+
+// ElemSize returns the number of elements in a record.
+func (h *IDXHeader) ElemSize() int {
+	n := 1
+	for _, d := range h.Shape() {
+		n *= d
+	}
+	return n
+}
+
+// RecordSize returns the byte size of a record.
+func (h *IDXHeader) RecordSize() int {
+	return h.ElemSize() * idxTypeSize(h.TypeCode)
+}
+
+// Decode converts a raw record read by IDXReader to values.
+func (h *IDXHeader) Decode(rec []byte) ([]float64, error) {
+	if len(rec) != h.RecordSize() {
+		return nil, fmt.Errorf("record size must be %v bytes but %v",
+			h.RecordSize(), len(rec))
+	}
+
+	vs := make([]float64, h.ElemSize())
+	for i := range vs {
+		switch h.TypeCode {
+		case IDXUnsignedByte:
+			vs[i] = float64(rec[i])
+		case IDXSignedByte:
+			vs[i] = float64(int8(rec[i]))
+		case IDXShort:
+			vs[i] = float64(int16(binary.BigEndian.Uint16(rec[i*2:])))
+		case IDXInt:
+			vs[i] = float64(int32(binary.BigEndian.Uint32(rec[i*4:])))
+		case IDXFloat:
+			vs[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(rec[i*4:])))
+		case IDXDouble:
+			vs[i] = math.Float64frombits(binary.BigEndian.Uint64(rec[i*8:]))
+		}
+	}
+	return vs, nil
+}
+
+func idxTypeSize(typeCode byte) int {
+	switch typeCode {
+	case IDXUnsignedByte, IDXSignedByte:
+		return 1
+	case IDXShort:
+		return 2
+	case IDXInt, IDXFloat:
+		return 4
+	case IDXDouble:
+		return 8
+	}
+	return 0
+}
+
+// maxIDXRecordSize is the limit of the byte size of a record to avoid
+// allocating a huge buffer from a broken header.
+const maxIDXRecordSize = 1 << 30
+
+// IDXReader reads records from an IDX file.
+type IDXReader struct {
+	Header IDXHeader
+
+	r    *bufio.Reader
+	c    io.Closer
+	read int
+}
+
+// OpenIDX opens an IDX file and reads its header. The file can be compressed
+// by gzip.
+func OpenIDX(path string) (*IDXReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewIDXReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read IDX file '%v': %v", path, err)
+	}
+	r.c = f
+	return r, nil
+}
+
+// NewIDXReader reads an IDX header from r. It detects gzip compression from
+// the leading bytes.
+func NewIDXReader(r io.Reader) (*IDXReader, error) {
+	br, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := readIDXHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &IDXReader{
+		Header: *h,
+		r:      br,
+	}, nil
+}
+
+// decompress returns a reader decompressing r when r is compressed by gzip.
+// Otherwise, it returns a buffered reader of r.
+func decompress(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil {
+		if err == io.EOF {
+			// too short to be compressed
+			return br, nil
+		}
+		return nil, err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(gr), nil
+	}
+	return br, nil
+}
+
+func readIDXHeader(r io.Reader) (*IDXHeader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if magic[0] != 0 || magic[1] != 0 {
+		return nil, errors.New("invalid magic number of IDX file")
+	}
+	h := &IDXHeader{
+		TypeCode: magic[2],
+	}
+	if idxTypeSize(h.TypeCode) == 0 {
+		return nil, fmt.Errorf("unsupported type code of IDX file: 0x%02x",
+			h.TypeCode)
+	}
+	rank := int(magic[3])
+	if rank == 0 {
+		return nil, errors.New("rank of IDX file must be greater than 0")
+	}
+
+	dims := make([]uint32, rank)
+	if err := binary.Read(r, binary.BigEndian, dims); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size := int64(idxTypeSize(h.TypeCode))
+	h.Dims = make([]int, rank)
+	for i, d := range dims {
+		h.Dims[i] = int(d)
+		if i > 0 {
+			size *= int64(d)
+			if size > maxIDXRecordSize {
+				return nil, fmt.Errorf("record of IDX file is too large: %v",
+					dims[1:])
+			}
+		}
+	}
+	return h, nil
+}
+
+// Next reads a raw record. It returns io.EOF after all records are read, and
+// io.ErrUnexpectedEOF when the file is shorter than its header says.
+func (r *IDXReader) Next() ([]byte, error) {
+	if r.read >= r.Header.Count() {
+		return nil, io.EOF
+	}
+	rec := make([]byte, r.Header.RecordSize())
+	if _, err := io.ReadFull(r.r, rec); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	r.read++
+	return rec, nil
+}
+
+// Close closes the file opened by OpenIDX.
+func (r *IDXReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
+
+// ReadIDXFile reads the header and the first n records of an IDX file. All
+// records are read when n is negative.
+func ReadIDXFile(path string, n int) (*IDXHeader, [][]byte, error) {
+	r, err := OpenIDX(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	if n < 0 {
+		n = r.Header.Count()
+	} else if n > r.Header.Count() {
+		return nil, nil, fmt.Errorf("IDX file '%v' has only %v records but %v records are required",
+			path, r.Header.Count(), n)
+	}
+
+	recs := make([][]byte, n)
+	for i := range recs {
+		if recs[i], err = r.Next(); err != nil {
+			return nil, nil, fmt.Errorf("cannot read record %v of IDX file '%v': %v",
+				i, path, err)
+		}
+	}
+	return &r.Header, recs, nil
+}
+
+// IDXFile reads records of an uncompressed IDX file on demand.
+type IDXFile struct {
+	Header IDXHeader
+
+	f          *os.File
+	n          int
+	dataOffset int64
+}
+
+// OpenIDXFile opens an IDX file to read records on demand. The file must have
+// at least n records, or all records when n is negative. Compressed files
+// aren't supported because they cannot be read at random.
+func OpenIDXFile(path string, n int) (*IDXFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := newIDXFile(f, n)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read IDX file '%v': %v", path, err)
+	}
+	return idx, nil
+}
+
+func newIDXFile(f *os.File, n int) (*IDXFile, error) {
+	var magic [2]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return nil, errors.New("compressed files cannot be read on demand")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h, err := readIDXHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 0 {
+		n = h.Count()
+	} else if n > h.Count() {
+		return nil, fmt.Errorf("only %v records but %v records are required",
+			h.Count(), n)
+	}
+	dataOffset := int64(4 + 4*len(h.Dims))
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if size := int64(h.RecordSize()); size > 0 {
+		if available := (st.Size() - dataOffset) / size; available < int64(n) {
+			return nil, fmt.Errorf("only %v records are in the file but %v records are required",
+				available, n)
+		}
+	}
+	return &IDXFile{
+		Header:     *h,
+		f:          f,
+		n:          n,
+		dataOffset: dataOffset,
+	}, nil
+}
+
+// Len returns the number of records which can be read.
+func (f *IDXFile) Len() int {
+	return f.n
+}
+
+// ReadRecord reads the i-th raw record.
+func (f *IDXFile) ReadRecord(i int) ([]byte, error) {
+	if i < 0 || i >= f.n {
+		return nil, fmt.Errorf("record index is out of range: %v", i)
+	}
+	size := f.Header.RecordSize()
+	rec := make([]byte, size)
+	if _, err := f.f.ReadAt(rec, f.dataOffset+int64(i)*int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Close closes the file.
+func (f *IDXFile) Close() error {
+	return f.f.Close()
+}
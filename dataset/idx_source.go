@@ -0,0 +1,223 @@
+package dataset
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+var (
+	dataFileNamePath   = data.MustCompilePath("data_file_name")
+	labelsFileNamePath = data.MustCompilePath("labels_file_name")
+	scalePath          = data.MustCompilePath("scale")
+	rewindPath         = data.MustCompilePath("rewind")
+	lazyPath           = data.MustCompilePath("lazy")
+)
+
+// IDXSourceCreator is a creator of a source reading IDX files.
+type IDXSourceCreator struct{}
+
+// CreateSource returns a source which emits records of an IDX file. The IDX
+// format is described in "THE MNIST DATABASE of handwritten digits", see
+// http://yann.lecun.com/exdb/mnist/
+//
+// Files are parsed when the source is created. Sizes of records are inferred
+// from headers of files, and files can be compressed by gzip. In lazy mode,
+// records are read from the file on demand so that memory usage doesn't
+// depend on the size of the file, but the file must not be compressed.
+//
+// WITH parameters
+//
+// data_file_name: IDX file path of data [required]
+//
+// labels_file_name: IDX file path of labels, the number of labels must be
+// the same as the number of data
+//
+// scale: a multiplier of data values (default: 1.0)
+//
+// lazy: read records on demand (default: false)
+//
+// rewind: the source can be rewound (default: false)
+//
+// Parameters of NewGenerator are also available.
+//
+// Output:
+//  data.Map{
+//    "data":  [flattened record] (data.Array of data.Float),
+//    "shape": [dimensions of a record] (data.Array of data.Int),
+//    "label": [label] (data.Int, only when labels_file_name is given),
+//  }
+func (c *IDXSourceCreator) CreateSource(ctx *core.Context, ioParams *bql.IOParams,
+	params data.Map) (core.Source, error) {
+	s, err := createIDXSource(params)
+	if err != nil {
+		return nil, err
+	}
+
+	rewind := false
+	if rf, err := params.Get(rewindPath); err == nil {
+		if rewind, err = data.AsBool(rf); err != nil {
+			return nil, err
+		}
+	}
+
+	if rewind {
+		return core.NewRewindableSource(s), nil
+	}
+	return s, nil
+}
+
+func createIDXSource(params data.Map) (*idxSource, error) {
+	dataFileName := ""
+	if dfn, err := params.Get(dataFileNamePath); err != nil {
+		return nil, err
+	} else if dataFileName, err = data.AsString(dfn); err != nil {
+		return nil, err
+	}
+
+	scale := 1.0
+	if sc, err := params.Get(scalePath); err == nil {
+		if scale, err = data.ToFloat(sc); err != nil {
+			return nil, err
+		}
+	}
+
+	lazy := false
+	if lz, err := params.Get(lazyPath); err == nil {
+		if lazy, err = data.AsBool(lz); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &idxSource{
+		scale: scale,
+	}
+	if lazy {
+		f, err := OpenIDXFile(dataFileName, -1)
+		if err != nil {
+			return nil, err
+		}
+		s.header = f.Header
+		s.file = f
+	} else {
+		h, recs, err := ReadIDXFile(dataFileName, -1)
+		if err != nil {
+			return nil, err
+		}
+		s.header = *h
+		s.records = recs
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			s.Close()
+		}
+	}()
+
+	if lfn, err := params.Get(labelsFileNamePath); err == nil {
+		labelsFileName, err := data.AsString(lfn)
+		if err != nil {
+			return nil, err
+		}
+		if s.labels, err = readIDXLabels(labelsFileName); err != nil {
+			return nil, err
+		}
+		if len(s.labels) != s.Len() {
+			return nil, fmt.Errorf("the number of labels (%v) doesn't match the number of data (%v)",
+				len(s.labels), s.Len())
+		}
+	}
+	g, err := NewGenerator("idx_source", s, params)
+	if err != nil {
+		return nil, err
+	}
+	s.Generator = g
+	succeeded = true
+	return s, nil
+}
+
+func readIDXLabels(path string) ([]int64, error) {
+	h, recs, err := ReadIDXFile(path, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Shape()) != 0 {
+		return nil, fmt.Errorf("IDX file of labels must have one dimension but %v",
+			len(h.Dims))
+	}
+
+	labels := make([]int64, len(recs))
+	for i, rec := range recs {
+		vs, err := h.Decode(rec)
+		if err != nil {
+			return nil, err
+		}
+		labels[i] = int64(vs[0])
+	}
+	return labels, nil
+}
+
+// idxSource is a source emitting records of an IDX file.
+type idxSource struct {
+	*Generator
+
+	header  IDXHeader
+	records [][]byte
+	labels  []int64
+	scale   float64
+
+	// file is used instead of records in lazy mode.
+	file *IDXFile
+}
+
+// Len returns the number of records.
+func (s *idxSource) Len() int {
+	if s.file != nil {
+		return s.file.Len()
+	}
+	return len(s.records)
+}
+
+// Record returns the i-th record with its shape and label.
+func (s *idxSource) Record(i int) (data.Map, error) {
+	rec, err := s.rawRecord(i)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := s.header.Decode(rec)
+	if err != nil {
+		return nil, err
+	}
+	d := make(data.Array, len(vs))
+	for j, v := range vs {
+		d[j] = data.Float(v * s.scale)
+	}
+	shape := make(data.Array, len(s.header.Shape()))
+	for j, l := range s.header.Shape() {
+		shape[j] = data.Int(l)
+	}
+	m := data.Map{
+		"data":  d,
+		"shape": shape,
+	}
+	if s.labels != nil {
+		m["label"] = data.Int(s.labels[i])
+	}
+	return m, nil
+}
+
+func (s *idxSource) rawRecord(i int) ([]byte, error) {
+	if s.file != nil {
+		return s.file.ReadRecord(i)
+	}
+	return s.records[i], nil
+}
+
+// Close closes the IDX file in lazy mode.
+func (s *idxSource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
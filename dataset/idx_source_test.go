@@ -0,0 +1,146 @@
+package dataset
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIDXSource(t *testing.T) {
+	ctx := core.NewContext(&core.ContextConfig{})
+	ioParams := &bql.IOParams{}
+	Convey("Given IDX files of two 1x2 images and labels", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_idx_source_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		images := filepath.Join(dir, "images.idx.gz")
+		So(ioutil.WriteFile(images, gzipBytes(idxBytes(IDXUnsignedByte,
+			[]uint32{2, 1, 2}, []byte{0, 255, 51, 102})), 0644), ShouldBeNil)
+		labels := filepath.Join(dir, "labels.idx")
+		So(ioutil.WriteFile(labels, idxBytes(IDXUnsignedByte, []uint32{2},
+			[]byte{3, 1}), 0644), ShouldBeNil)
+		shortLabels := filepath.Join(dir, "short_labels.idx")
+		So(ioutil.WriteFile(shortLabels, idxBytes(IDXUnsignedByte, []uint32{1},
+			[]byte{3}), 0644), ShouldBeNil)
+
+		c := &IDXSourceCreator{}
+
+		Convey("When create a source with labels", func() {
+			s, err := c.CreateSource(ctx, ioParams, data.Map{
+				"data_file_name":   data.String(images),
+				"labels_file_name": data.String(labels),
+				"scale":            data.Float(1.0 / 255),
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then the source should emit images with shapes and labels", func() {
+				var ts []data.Map
+				w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+					ts = append(ts, t.Data)
+					return nil
+				})
+				So(s.GenerateStream(ctx, w), ShouldBeNil)
+				So(ts, ShouldResemble, []data.Map{
+					{
+						"data":  data.Array{data.Float(0), data.Float(1)},
+						"shape": data.Array{data.Int(1), data.Int(2)},
+						"label": data.Int(3),
+					},
+					{
+						"data":  data.Array{data.Float(0.2), data.Float(0.4)},
+						"shape": data.Array{data.Int(1), data.Int(2)},
+						"label": data.Int(1),
+					},
+				})
+			})
+		})
+
+		Convey("When create a lazy source of an uncompressed file", func() {
+			raw := filepath.Join(dir, "images.idx")
+			So(ioutil.WriteFile(raw, idxBytes(IDXUnsignedByte,
+				[]uint32{2, 1, 2}, []byte{0, 255, 51, 102}), 0644), ShouldBeNil)
+			s, err := createIDXSource(data.Map{
+				"data_file_name":   data.String(raw),
+				"labels_file_name": data.String(labels),
+				"lazy":             data.Bool(true),
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then records should be read from the file", func() {
+				So(s.records, ShouldBeNil)
+				So(s.Len(), ShouldEqual, 2)
+				m, err := s.Record(1)
+				So(err, ShouldBeNil)
+				So(m["data"], ShouldResemble, data.Array{data.Float(51), data.Float(102)})
+				So(m["label"], ShouldEqual, data.Int(1))
+			})
+
+			Convey("Then the file should be closed after the source is stopped", func() {
+				So(s.Stop(ctx), ShouldBeNil)
+				_, err := s.Record(0)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When create a lazy source of a compressed file", func() {
+			_, err := createIDXSource(data.Map{
+				"data_file_name": data.String(images),
+				"lazy":           data.Bool(true),
+			})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When create a source without labels", func() {
+			s, err := createIDXSource(data.Map{
+				"data_file_name": data.String(images),
+			})
+
+			Convey("Then the source should not have labels", func() {
+				So(err, ShouldBeNil)
+				So(s.labels, ShouldBeNil)
+				So(len(s.records), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When create a source with mismatched labels", func() {
+			_, err := c.CreateSource(ctx, ioParams, data.Map{
+				"data_file_name":   data.String(images),
+				"labels_file_name": data.String(shortLabels),
+			})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When create a source with a multi-dimensional labels file", func() {
+			_, err := c.CreateSource(ctx, ioParams, data.Map{
+				"data_file_name":   data.String(images),
+				"labels_file_name": data.String(images),
+			})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When create a source without data_file_name", func() {
+			_, err := c.CreateSource(ctx, ioParams, data.Map{})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "data_file_name")
+			})
+		})
+	})
+}
@@ -0,0 +1,268 @@
+package dataset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// idxBytes returns an IDX file having the given type code, dimensions, and
+// body.
+func idxBytes(typeCode byte, dims []uint32, body []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{0, 0, typeCode, byte(len(dims))})
+	binary.Write(buf, binary.BigEndian, dims)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func gzipBytes(b []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestIDXReader(t *testing.T) {
+	Convey("Given an IDX file having two 2x3 ubyte records", t, func() {
+		b := idxBytes(IDXUnsignedByte, []uint32{2, 2, 3},
+			[]byte{0, 1, 2, 3, 4, 5, 255, 254, 253, 252, 251, 250})
+
+		for _, c := range []struct {
+			name string
+			b    []byte
+		}{
+			{"raw", b},
+			{"gzip-compressed", gzipBytes(b)},
+		} {
+			c := c
+			Convey("When read the "+c.name+" file", func() {
+				r, err := NewIDXReader(bytes.NewReader(c.b))
+				So(err, ShouldBeNil)
+
+				Convey("Then the header should be parsed", func() {
+					So(r.Header.TypeCode, ShouldEqual, IDXUnsignedByte)
+					So(r.Header.Count(), ShouldEqual, 2)
+					So(r.Header.Shape(), ShouldResemble, []int{2, 3})
+					So(r.Header.ElemSize(), ShouldEqual, 6)
+					So(r.Header.RecordSize(), ShouldEqual, 6)
+				})
+
+				Convey("Then all records should be read", func() {
+					rec, err := r.Next()
+					So(err, ShouldBeNil)
+					vs, err := r.Header.Decode(rec)
+					So(err, ShouldBeNil)
+					So(vs, ShouldResemble, []float64{0, 1, 2, 3, 4, 5})
+
+					rec, err = r.Next()
+					So(err, ShouldBeNil)
+					vs, err = r.Header.Decode(rec)
+					So(err, ShouldBeNil)
+					So(vs, ShouldResemble, []float64{255, 254, 253, 252, 251, 250})
+
+					_, err = r.Next()
+					So(err, ShouldEqual, io.EOF)
+				})
+			})
+		}
+
+		Convey("When read a truncated file", func() {
+			r, err := NewIDXReader(bytes.NewReader(b[:len(b)-1]))
+			So(err, ShouldBeNil)
+
+			Convey("Then the last record should fail", func() {
+				_, err := r.Next()
+				So(err, ShouldBeNil)
+				_, err = r.Next()
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+
+		Convey("When read a file whose header is truncated", func() {
+			_, err := NewIDXReader(bytes.NewReader(b[:6]))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+	})
+
+	Convey("Given IDX files having invalid headers", t, func() {
+		cases := map[string][]byte{
+			"invalid magic number": {1, 0, IDXUnsignedByte, 1, 0, 0, 0, 0},
+			"unknown type code":    {0, 0, 0x0A, 1, 0, 0, 0, 0},
+			"zero rank":            {0, 0, IDXUnsignedByte, 0},
+			"too large record":     idxBytes(IDXDouble, []uint32{1, 1 << 16, 1 << 16}, nil),
+		}
+		for name, b := range cases {
+			b := b
+			Convey("When read a file having "+name, func() {
+				_, err := NewIDXReader(bytes.NewReader(b))
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+	})
+
+	Convey("Given IDX files having multi-byte types", t, func() {
+		Convey("When decode a short record", func() {
+			h := IDXHeader{TypeCode: IDXShort, Dims: []int{1, 2}}
+			vs, err := h.Decode([]byte{0xff, 0xfe, 0x01, 0x00})
+
+			Convey("Then values should be big-endian signed integers", func() {
+				So(err, ShouldBeNil)
+				So(vs, ShouldResemble, []float64{-2, 256})
+			})
+		})
+
+		Convey("When decode a float record", func() {
+			h := IDXHeader{TypeCode: IDXFloat, Dims: []int{1, 1}}
+			rec := make([]byte, 4)
+			binary.BigEndian.PutUint32(rec, math.Float32bits(1.5))
+			vs, err := h.Decode(rec)
+
+			Convey("Then the value should be decoded", func() {
+				So(err, ShouldBeNil)
+				So(vs, ShouldResemble, []float64{1.5})
+			})
+		})
+
+		Convey("When decode a record having a wrong size", func() {
+			h := IDXHeader{TypeCode: IDXInt, Dims: []int{1, 2}}
+			_, err := h.Decode([]byte{0, 0, 0, 1})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestReadIDXFile(t *testing.T) {
+	Convey("Given an IDX file having three records", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_idx_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		path := filepath.Join(dir, "data.idx")
+		So(ioutil.WriteFile(path, idxBytes(IDXUnsignedByte, []uint32{3},
+			[]byte{7, 8, 9}), 0644), ShouldBeNil)
+
+		Convey("When read all records", func() {
+			h, recs, err := ReadIDXFile(path, -1)
+
+			Convey("Then all records should be returned", func() {
+				So(err, ShouldBeNil)
+				So(h.Count(), ShouldEqual, 3)
+				So(recs, ShouldResemble, [][]byte{{7}, {8}, {9}})
+			})
+		})
+
+		Convey("When read the first two records", func() {
+			_, recs, err := ReadIDXFile(path, 2)
+
+			Convey("Then two records should be returned", func() {
+				So(err, ShouldBeNil)
+				So(recs, ShouldResemble, [][]byte{{7}, {8}})
+			})
+		})
+
+		Convey("When read more records than the file has", func() {
+			_, _, err := ReadIDXFile(path, 4)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When read a file which doesn't exist", func() {
+			_, _, err := ReadIDXFile(path+"_", -1)
+
+			Convey("Then it should fail with not found error", func() {
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestIDXFile(t *testing.T) {
+	Convey("Given an IDX file having three 1x2 short records", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_idx_file_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		b := idxBytes(IDXShort, []uint32{3, 1, 2},
+			[]byte{0, 1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6})
+		path := filepath.Join(dir, "data.idx")
+		So(ioutil.WriteFile(path, b, 0644), ShouldBeNil)
+
+		Convey("When open the file", func() {
+			f, err := OpenIDXFile(path, -1)
+			So(err, ShouldBeNil)
+			Reset(func() {
+				f.Close()
+			})
+
+			Convey("Then records should be read at random", func() {
+				So(f.Len(), ShouldEqual, 3)
+				for _, i := range []int{2, 0, 1, 2} {
+					rec, err := f.ReadRecord(i)
+					So(err, ShouldBeNil)
+					vs, err := f.Header.Decode(rec)
+					So(err, ShouldBeNil)
+					So(vs, ShouldResemble, []float64{float64(2*i + 1), float64(2*i + 2)})
+				}
+			})
+
+			Convey("Then a record out of range should not be read", func() {
+				_, err := f.ReadRecord(3)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When open the file requiring the first two records", func() {
+			f, err := OpenIDXFile(path, 2)
+			So(err, ShouldBeNil)
+			Reset(func() {
+				f.Close()
+			})
+
+			Convey("Then only two records should be available", func() {
+				So(f.Len(), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When open a truncated file", func() {
+			truncated := filepath.Join(dir, "truncated.idx")
+			So(ioutil.WriteFile(truncated, b[:len(b)-1], 0644), ShouldBeNil)
+			_, err := OpenIDXFile(truncated, -1)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When open a compressed file", func() {
+			compressed := filepath.Join(dir, "data.idx.gz")
+			So(ioutil.WriteFile(compressed, gzipBytes(b), 0644), ShouldBeNil)
+			_, err := OpenIDXFile(compressed, -1)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
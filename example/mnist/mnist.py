@@ -84,6 +84,24 @@ class MNIST(object):
 
         return int(pred[0])
 
+    def score(self, xys):
+        x_valid = []
+        y_valid = []
+        for d in xys:
+            x_valid.append(d['data'])
+            y_valid.append(d['label'])
+
+        nx = np.array(x_valid, dtype=np.float32)
+        ny = np.array(y_valid, dtype=np.int32)
+        x = chainer.Variable(self.xp.asarray(nx), volatile='on')
+        t = chainer.Variable(self.xp.asarray(ny), volatile='on')
+
+        loss = self.model(x, t)
+        return {
+            'loss': float(loss.data),
+            'accuracy': float(self.model.accuracy.data),
+        }
+
     def save(self, filepath, *args, **kwargs):
         serializers.save_npz(filepath, self.model)
 
@@ -1,13 +1,11 @@
 package mnist
 
 import (
-	"bufio"
+	"fmt"
+	"gopkg.in/sensorbee/pymlstate.v0/dataset"
 	"gopkg.in/sensorbee/sensorbee.v0/bql"
 	"gopkg.in/sensorbee/sensorbee.v0/core"
 	"gopkg.in/sensorbee/sensorbee.v0/data"
-	"io"
-	"os"
-	"time"
 )
 
 // DataSourceCreator is a creator for MNIST data source.
@@ -15,10 +13,15 @@ type DataSourceCreator struct{}
 
 // mnistDataSource is a source to generate MNIST data stream.
 type mnistDataSource struct {
+	*dataset.Generator
+
 	data          [][]float32
 	target        []int32
 	dataSize      int
 	imageElemSize int
+
+	// images is used instead of data in lazy mode.
+	images *dataset.IDXFile
 }
 
 var (
@@ -27,14 +30,16 @@ var (
 	dataSizePath       = data.MustCompilePath("data_size")
 	imageElemSizePath  = data.MustCompilePath("image_element_size")
 	rewindPath         = data.MustCompilePath("rewind")
+	lazyPath           = data.MustCompilePath("lazy")
 )
 
 // CreateSource returns a source which generate MNIST data stream. The MNIST
 // data spec is depended on "THE MNIST DATABASE of handwritten digits", see
 // http://yann.lecun.com/exdb/mnist/
 //
-// MNIST data is ubyte data, and parse when the source is created. Returns
-// an error when cannot load MNIST file or parsing error.
+// MNIST data is IDX data, and parse when the source is created. Returns
+// an error when cannot load MNIST file or parsing error. Files can be
+// compressed by gzip. See idx_source for other IDX files.
 //
 // WITH parameters
 //
@@ -45,6 +50,15 @@ var (
 // data_size: MNIST data size [required]
 //
 // image_element_size: MNIST image element size (default: 784=28*28)
+//
+// lazy: read images from the file on demand instead of decoding all images
+// when the source is created, the images file must not be compressed
+// (default: false)
+//
+// rewind: the source can be rewound (default: false)
+//
+// Parameters of dataset.NewGenerator, e.g. shuffle, seed, shard_index,
+// shard_count, offset, limit, and tuples_per_second, are also available.
 func (s *DataSourceCreator) CreateSource(ctx *core.Context, ioParams *bql.IOParams,
 	params data.Map) (core.Source, error) {
 	ms, err := createMNISTDataSource(ctx, ioParams, params)
@@ -100,126 +114,171 @@ func createMNISTDataSource(ctx *core.Context, ioParams *bql.IOParams,
 		imageElemSize = int(iesInt)
 	}
 
-	target, data, err := getMNISTRawData(imagesDataName, labelsDataName, dataSize,
-		imageElemSize)
-	if err != nil {
-		return nil, err
+	lazy := false
+	if lz, err := params.Get(lazyPath); err == nil {
+		if lazy, err = data.AsBool(lz); err != nil {
+			return nil, err
+		}
 	}
 
 	ms := &mnistDataSource{
-		data:          data,
-		target:        target,
 		dataSize:      dataSize,
 		imageElemSize: imageElemSize,
 	}
+	var err error
+	if lazy {
+		ms.target, ms.images, err = openMNISTData(imagesDataName, labelsDataName,
+			dataSize, imageElemSize)
+	} else {
+		ms.target, ms.data, err = getMNISTRawData(imagesDataName, labelsDataName,
+			dataSize, imageElemSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ms.Generator, err = dataset.NewGenerator("mnist_source", ms, params); err != nil {
+		ms.Close()
+		return nil, err
+	}
 
 	return ms, nil
 }
 
-const (
-	imagesDataOffsetSize = 16
-	labelsDataOffsetSize = 8
-)
-
 func getMNISTRawData(imagesDataName string, labelsDataName string, dataSize int,
 	imageElemSize int) ([]int32, [][]float32, error) {
 
-	imagesData := dataSource{path: imagesDataName}
-	ir, ic, err := imagesData.reader()
+	ih, images, err := dataset.ReadIDXFile(imagesDataName, dataSize)
 	if err != nil {
 		return []int32{}, [][]float32{}, err
 	}
-	defer ic.Close()
+	if err := validateMNISTImages(ih, imageElemSize); err != nil {
+		return []int32{}, [][]float32{}, err
+	}
 
-	labelsData := dataSource{path: labelsDataName}
-	lr, lc, err := labelsData.reader()
+	target, err := getMNISTLabels(labelsDataName, dataSize, ih.Count())
 	if err != nil {
 		return []int32{}, [][]float32{}, err
 	}
-	defer lc.Close()
 
 	data := make([][]float32, dataSize, dataSize)
-	for i := range data {
-		data[i] = make([]float32, imageElemSize, imageElemSize)
+	for i := 0; i < dataSize; i++ {
+		if data[i], err = decodeMNISTImage(ih, images[i], imageElemSize); err != nil {
+			return []int32{}, [][]float32{}, err
+		}
 	}
-	target := make([]int32, dataSize, dataSize)
 
-	for i := 0; i < imagesDataOffsetSize; i++ {
-		ir.ReadByte()
+	return target, data, nil
+}
+
+// openMNISTData reads labels and opens the images file to read images on
+// demand.
+func openMNISTData(imagesDataName string, labelsDataName string, dataSize int,
+	imageElemSize int) ([]int32, *dataset.IDXFile, error) {
+
+	images, err := dataset.OpenIDXFile(imagesDataName, dataSize)
+	if err != nil {
+		return nil, nil, err
 	}
-	for i := 0; i < labelsDataOffsetSize; i++ {
-		lr.ReadByte()
+	if err := validateMNISTImages(&images.Header, imageElemSize); err != nil {
+		images.Close()
+		return nil, nil, err
 	}
-	for i := 0; i < dataSize; i++ {
-		lb, _ := lr.ReadByte()
-		target[i] = int32(lb)
-		for j := 0; j < imageElemSize; j++ {
-			ib, _ := ir.ReadByte()
-			data[i][j] = float32(ib) / 255
+
+	target, err := getMNISTLabels(labelsDataName, dataSize, images.Header.Count())
+	if err != nil {
+		images.Close()
+		return nil, nil, err
+	}
+	return target, images, nil
+}
+
+func validateMNISTImages(h *dataset.IDXHeader, imageElemSize int) error {
+	if imageElemSize > h.ElemSize() {
+		return fmt.Errorf(
+			"image_element_size (%v) is larger than the size of images (%v)",
+			imageElemSize, h.ElemSize())
+	}
+	return nil
+}
+
+func getMNISTLabels(labelsDataName string, dataSize int, imagesCount int) (
+	[]int32, error) {
+	lh, labels, err := dataset.ReadIDXFile(labelsDataName, dataSize)
+	if err != nil {
+		return nil, err
+	}
+	if imagesCount != lh.Count() {
+		return nil, fmt.Errorf(
+			"the number of images (%v) doesn't match the number of labels (%v)",
+			imagesCount, lh.Count())
+	}
+
+	target := make([]int32, dataSize, dataSize)
+	for i := range target {
+		lb, err := lh.Decode(labels[i])
+		if err != nil {
+			return nil, err
 		}
+		target[i] = int32(lb[0])
 	}
+	return target, nil
+}
 
-	return target, data, nil
+func decodeMNISTImage(h *dataset.IDXHeader, rec []byte, imageElemSize int) (
+	[]float32, error) {
+	im, err := h.Decode(rec)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]float32, imageElemSize, imageElemSize)
+	for j := range d {
+		d[j] = float32(im[j]) / 255
+	}
+	return d, nil
 }
 
-// GenerateStream generates MNIST data stream.
-//
-// The MNIST data is randomized when random flag is true, a seed of
-// randomizing is not fixed.
+// Len returns the number of MNIST data.
+func (s *mnistDataSource) Len() int {
+	return len(s.target)
+}
+
+// Record returns the i-th MNIST data.
 //
 // Output:
 //  data.Map{
 //    "label": [correct data] (data.Int),
 //    "data":  [image data (28*28)] (data.Array),
 //  }
-func (s *mnistDataSource) GenerateStream(ctx *core.Context, w core.Writer) error {
-	perm := make([]int, s.dataSize, s.dataSize)
-	for i := range perm {
-		perm[i] = i
+func (s *mnistDataSource) Record(i int) (data.Map, error) {
+	d, err := s.image(i)
+	if err != nil {
+		return nil, err
 	}
-
-	for i, l := range s.target {
-		im := make(data.Array, len(s.data[i]), len(s.data[i]))
-		for j, d := range s.data[i] {
-			im[j] = data.Float(d)
-		}
-		dm := data.Map{
-			"label": data.Int(l),
-			"data":  im,
-		}
-
-		now := time.Now()
-		tu := core.Tuple{
-			Data:          dm,
-			Timestamp:     now,
-			ProcTimestamp: now,
-			Trace:         []core.TraceEvent{},
-		}
-		err := w.Write(ctx, &tu)
-		if err == core.ErrSourceRewound || err == core.ErrSourceStopped {
-			return err
-		}
+	im := make(data.Array, len(d), len(d))
+	for j, v := range d {
+		im[j] = data.Float(v)
 	}
-
-	ctx.Log().WithField("source_type", "mnist_source").Info(
-		"All tuples have been emitted")
-	return nil
+	return data.Map{
+		"label": data.Int(s.target[i]),
+		"data":  im,
+	}, nil
 }
 
-// Stop stops generating stream. TODO forced stop
-func (s *mnistDataSource) Stop(ctx *core.Context) error {
-	return nil
-}
-
-type dataSource struct {
-	path string
+func (s *mnistDataSource) image(i int) ([]float32, error) {
+	if s.images == nil {
+		return s.data[i], nil
+	}
+	rec, err := s.images.ReadRecord(i)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMNISTImage(&s.images.Header, rec, s.imageElemSize)
 }
 
-func (s *dataSource) reader() (*bufio.Reader, io.Closer, error) {
-	f, err := os.Open(s.path)
-	if err != nil {
-		return nil, nil, err
+// Close closes the images file in lazy mode.
+func (s *mnistDataSource) Close() error {
+	if s.images == nil {
+		return nil
 	}
-	r := bufio.NewReader(f)
-	return r, f, nil
+	return s.images.Close()
 }
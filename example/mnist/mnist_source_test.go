@@ -108,5 +108,43 @@ func TestCreateSource(t *testing.T) {
 				So(ms.dataSize, ShouldEqual, 1)
 			})
 		})
+		Convey("When get parameters with lazy mode", func() {
+			params := data.Map{
+				"images_file_name":   data.String("_test_train_image"),
+				"labels_file_name":   data.String("_test_train_label"),
+				"data_size":          data.Int(1),
+				"image_element_size": data.Int(2),
+				"lazy":               data.Bool(true),
+			}
+			Convey("Then the creator should return a source reading images on demand", func() {
+				s, err := createMNISTDataSource(ctx, ioParams, params)
+				So(err, ShouldBeNil)
+
+				ms, ok := s.(*mnistDataSource)
+				So(ok, ShouldBeTrue)
+				So(ms.data, ShouldBeNil)
+				So(ms.images, ShouldNotBeNil)
+				So(ms.Len(), ShouldEqual, 1)
+
+				m, err := ms.Record(0)
+				So(err, ShouldBeNil)
+				So(m["label"], ShouldEqual, data.Int(5))
+				So(m["data"], ShouldResemble, data.Array{data.Float(0), data.Float(0)})
+				So(ms.Close(), ShouldBeNil)
+			})
+		})
+		Convey("When get parameters with lazy mode requiring more data than the file has", func() {
+			params := data.Map{
+				"images_file_name": data.String("_test_train_image"),
+				"labels_file_name": data.String("_test_train_label"),
+				"data_size":        data.Int(2),
+				"lazy":             data.Bool(true),
+			}
+			Convey("Then the creator should return an error", func() {
+				s, err := createMNISTDataSource(ctx, ioParams, params)
+				So(err, ShouldNotBeNil)
+				So(s, ShouldBeNil)
+			})
+		})
 	})
 }
@@ -0,0 +1,123 @@
+package pymlstate
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+var (
+	predictFallbackPath     = data.MustCompilePath("predict_fallback")
+	predictFallbackTypePath = data.MustCompilePath("predict_fallback_type")
+)
+
+// Types of predict_fallback.
+const (
+	fallbackValue = "value"
+	fallbackState = "state"
+)
+
+// parsePredictFallback parses parameters of the fallback prediction and
+// removes them from params. They're validated together with saved ones.
+//
+// predict_fallback: a value returned by Predict when the prediction fails,
+// or the name of another pymlstate which predicts instead when
+// predict_fallback_type is "state". See parseBreakerParams for its use while
+// the circuit breaker is open.
+//
+// predict_fallback_type: "value" or "state" (default: "value")
+func parsePredictFallback(params data.Map, mlParams *MLParams) error {
+	if pf, err := params.Get(predictFallbackPath); err == nil {
+		b, err := encodeValue(pf)
+		if err != nil {
+			return err
+		}
+		mlParams.PredictFallback = b
+		delete(params, "predict_fallback")
+	}
+
+	if pft, err := params.Get(predictFallbackTypePath); err == nil {
+		t, err := data.AsString(pft)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case fallbackValue, fallbackState:
+		default:
+			return fmt.Errorf("unsupported predict_fallback_type: %v", t)
+		}
+		mlParams.PredictFallbackType = t
+		delete(params, "predict_fallback_type")
+	}
+
+	if mlParams.PredictFallbackType == fallbackState {
+		if mlParams.PredictFallback == nil {
+			return errors.New("predict_fallback is required when predict_fallback_type is state")
+		}
+		v, err := decodeValue(mlParams.PredictFallback)
+		if err != nil {
+			return err
+		}
+		if _, err := data.AsString(v); err != nil {
+			return fmt.Errorf("predict_fallback must be a name of a state: %v", err)
+		}
+	}
+	return nil
+}
+
+// fallbackResult annotates result as a fallback prediction replacing the
+// prediction which failed with err.
+func fallbackResult(result data.Value, err error) data.Map {
+	return data.Map{
+		"fallback": data.Bool(true),
+		"result":   result,
+		"error":    data.String(err.Error()),
+	}
+}
+
+// fallback returns the fallback prediction when Predict fails with err. The
+// fallback prediction is annotated as follows:
+//
+//	{
+//		"fallback": true,
+//		"result": the fallback value or the prediction of the fallback state,
+//		"error": the error of the prediction,
+//		"fallback_state": the name of the fallback state if it's used
+//	}
+//
+// err is returned as is when predict_fallback isn't given.
+func (s *State) fallback(ctx *core.Context, dt data.Value, err error) (data.Value, error) {
+	s.rwm.RLock()
+	encoded := s.params.PredictFallback
+	typ := s.params.PredictFallbackType
+	s.rwm.RUnlock()
+	if encoded == nil {
+		return nil, err
+	}
+	v, derr := decodeValue(encoded)
+	if derr != nil {
+		return nil, fmt.Errorf("%v, and predict_fallback is broken: %v", err, derr)
+	}
+
+	res := fallbackResult(v, err)
+	if typ == fallbackState {
+		// the lock of this state is released so that states falling back to
+		// each other don't deadlock
+		name, _ := data.AsString(v)
+		other, ferr := lookupState(ctx, name)
+		if ferr == nil && other == s {
+			ferr = errors.New("the state cannot fall back to itself")
+		}
+		if ferr == nil {
+			// the fallback state doesn't fall back further
+			res["result"], ferr = other.predict(ctx, dt)
+		}
+		if ferr != nil {
+			return nil, fmt.Errorf("%v, and the fallback state '%v' failed: %v", err, name, ferr)
+		}
+		res["fallback_state"] = data.String(name)
+	}
+	ctx.ErrLog(err).Debug("pymlstate used the fallback prediction")
+	return res, nil
+}
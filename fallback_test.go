@@ -0,0 +1,212 @@
+package pymlstate
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+)
+
+func TestParsePredictFallback(t *testing.T) {
+	Convey("Given parameters of the fallback prediction", t, func() {
+		Convey("When parse a fallback value", func() {
+			params := data.Map{"predict_fallback": data.String("unknown")}
+			mp := &MLParams{}
+			So(parsePredictFallback(params, mp), ShouldBeNil)
+
+			Convey("Then MLParams should have it", func() {
+				v, err := decodeValue(mp.PredictFallback)
+				So(err, ShouldBeNil)
+				So(v, ShouldEqual, data.String("unknown"))
+				So(params, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When parse a fallback state", func() {
+			mp := &MLParams{}
+			So(parsePredictFallback(data.Map{
+				"predict_fallback":      data.String("backup"),
+				"predict_fallback_type": data.String("state"),
+			}, mp), ShouldBeNil)
+
+			Convey("Then MLParams should have it", func() {
+				So(mp.PredictFallbackType, ShouldEqual, fallbackState)
+			})
+		})
+
+		Convey("When parse invalid parameters", func() {
+			cases := map[string]data.Map{
+				"unknown type": data.Map{
+					"predict_fallback":      data.String("backup"),
+					"predict_fallback_type": data.String("model"),
+				},
+				"state without predict_fallback": data.Map{
+					"predict_fallback_type": data.String("state"),
+				},
+				"state whose name isn't a string": data.Map{
+					"predict_fallback":      data.Int(1),
+					"predict_fallback_type": data.String("state"),
+				},
+			}
+
+			for title, params := range cases {
+				Convey("Then "+title+" should fail", func() {
+					So(parsePredictFallback(params, &MLParams{}), ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
+
+func TestPyMLStatePredictFallback(t *testing.T) {
+	Convey("Given a pymlstate with a fallback value", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		mp := &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+		}
+		So(parsePredictFallback(data.Map{
+			"predict_fallback": data.Map{"label": data.String("unknown")},
+		}, mp), ShouldBeNil)
+		s, err := New(processTestBaseParams, mp, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When the prediction succeeds", func() {
+			res, err := s.Predict(ctx, data.String("a"))
+
+			Convey("Then the prediction should be returned as is", func() {
+				So(err, ShouldBeNil)
+				So(res, ShouldEqual, data.String("a"))
+			})
+		})
+
+		Convey("When the prediction fails", func() {
+			res, err := s.Predict(ctx, data.String("error"))
+			So(err, ShouldBeNil)
+
+			Convey("Then the annotated fallback value should be returned", func() {
+				m, err := data.AsMap(res)
+				So(err, ShouldBeNil)
+				So(m["fallback"], ShouldEqual, data.Bool(true))
+				So(m["result"], ShouldResemble, data.Map{"label": data.String("unknown")})
+				So(m["error"], ShouldNotBeNil)
+				So(m["error"].String(), ShouldContainSubstring, "ValueError")
+			})
+		})
+	})
+
+	Convey("Given a pymlstate falling back to another state", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		mp := &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+		}
+		So(parsePredictFallback(data.Map{
+			"predict_fallback":      data.String("backup_state"),
+			"predict_fallback_type": data.String("state"),
+		}, mp), ShouldBeNil)
+		s, err := New(processTestBaseParams, mp, data.Map{})
+		So(err, ShouldBeNil)
+		So(ctx.SharedStates.Add("primary_state", "pymlstate", s), ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When the fallback state exists", func() {
+			backup, err := New(processTestBaseParams, &MLParams{
+				BatchSize: 1,
+				Backend:   processBackend,
+			}, data.Map{"failing_input": data.String("none")})
+			So(err, ShouldBeNil)
+			So(ctx.SharedStates.Add("backup_state", "pymlstate", backup), ShouldBeNil)
+			Reset(func() {
+				backup.Terminate(ctx)
+			})
+
+			Convey("And the prediction fails", func() {
+				res, err := Predict(ctx, "primary_state", data.String("error"))
+				So(err, ShouldBeNil)
+
+				Convey("Then the prediction of the fallback state should be returned", func() {
+					m, err := data.AsMap(res)
+					So(err, ShouldBeNil)
+					So(m["fallback"], ShouldEqual, data.Bool(true))
+					So(m["fallback_state"], ShouldEqual, data.String("backup_state"))
+					So(m["result"], ShouldEqual, data.String("error"))
+				})
+			})
+		})
+
+		Convey("When the fallback state doesn't exist", func() {
+			_, err := s.Predict(ctx, data.String("error"))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "backup_state")
+			})
+		})
+	})
+
+	Convey("Given a pymlstate with both breaker_fallback and predict_fallback", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		mp := &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+		}
+		So(parseBreakerParams(data.Map{
+			"breaker_threshold": data.Int(1),
+			"breaker_cooldown":  data.String("1h"),
+			"breaker_fallback":  data.String("breaker"),
+		}, mp), ShouldBeNil)
+		So(parsePredictFallback(data.Map{
+			"predict_fallback": data.String("predict"),
+		}, mp), ShouldBeNil)
+		s, err := New(processTestBaseParams, mp, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When the prediction fails and opens the breaker", func() {
+			res, err := s.Predict(ctx, data.String("error"))
+			So(err, ShouldBeNil)
+
+			Convey("Then predict_fallback should be returned for the failure", func() {
+				m, err := data.AsMap(res)
+				So(err, ShouldBeNil)
+				So(m["result"], ShouldEqual, data.String("predict"))
+				So(m["error"].String(), ShouldContainSubstring, "ValueError")
+			})
+
+			Convey("And predict while the breaker is open", func() {
+				res, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+
+				Convey("Then breaker_fallback should take precedence", func() {
+					So(res, ShouldResemble, data.Map{
+						"fallback": data.Bool(true),
+						"result":   data.String("breaker"),
+						"error":    data.String(errBreakerOpen.Error()),
+					})
+				})
+			})
+
+			Convey("And predict while the breaker is open without breaker_fallback", func() {
+				s.params.BreakerFallback = nil
+				res, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+
+				Convey("Then predict_fallback should be returned", func() {
+					So(res, ShouldResemble, data.Map{
+						"fallback": data.Bool(true),
+						"result":   data.String("predict"),
+						"error":    data.String(errBreakerOpen.Error()),
+					})
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,37 @@
+//go:build ignore
+// +build ignore
+
+// gen_process_bridge generates process_bridge.go from process_bridge.py so
+// that the script of the "process" backend is built into the binary. It's
+// run by "go generate".
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+func main() {
+	script, err := ioutil.ReadFile("process_bridge.py")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bytes.IndexByte(script, '`') >= 0 {
+		log.Fatal("process_bridge.py must not have backquotes")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintln(buf, "// Code generated by gen_process_bridge.go from process_bridge.py. DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package pymlstate")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// processBridge is process_bridge.py, which is run by the \"process\"")
+	fmt.Fprintln(buf, "// backend. See the file for details.")
+	fmt.Fprintf(buf, "const processBridge = `%v`\n", strings.TrimSuffix(string(script), "\n")+"\n")
+	if err := ioutil.WriteFile("process_bridge.go", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package pymlstate
+
+import (
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"time"
+)
+
+// healthWindow is the number of recent calls to "fit" or "predict" whose
+// results are reported by Health.
+const healthWindow = 5
+
+// callStats has results of recent calls to a method of Python.
+type callStats struct {
+	// failed is a ring buffer of the last healthWindow results.
+	failed      [healthWindow]bool
+	n           int
+	next        int
+	consecutive int
+}
+
+func (c *callStats) record(err error) {
+	c.failed[c.next] = err != nil
+	c.next = (c.next + 1) % healthWindow
+	if c.n < healthWindow {
+		c.n++
+	}
+	if err != nil {
+		c.consecutive++
+	} else {
+		c.consecutive = 0
+	}
+}
+
+// failing returns true when all of the last healthWindow calls failed.
+func (c *callStats) failing() bool {
+	return c.consecutive >= healthWindow
+}
+
+func (c *callStats) toMap() data.Map {
+	failures := 0
+	for i := 0; i < c.n; i++ {
+		if c.failed[i] {
+			failures++
+		}
+	}
+	return data.Map{
+		"recent_calls":         data.Int(c.n),
+		"recent_failures":      data.Int(failures),
+		"consecutive_failures": data.Int(c.consecutive),
+		"failing":              data.Bool(c.failing()),
+	}
+}
+
+// restarter is implemented by models which restart Python after it exits.
+type restarter interface {
+	// restartCount returns the number of restarts.
+	restartCount() uint64
+
+	// logRestarts logs restarts which haven't been logged yet.
+	logRestarts(ctx *core.Context)
+}
+
+var _ restarter = &processModel{}
+
+// restarts returns the number of restarts of Python of the primary model and
+// replicas. The state must be locked.
+func (s *State) restarts() uint64 {
+	var n uint64
+	for _, m := range append([]model{s.base}, s.replicas...) {
+		if r, ok := m.(restarter); ok {
+			n += r.restartCount()
+		}
+	}
+	return n
+}
+
+// recordCall records the result of a call to "fit" or "predict".
+func (s *State) recordCall(name string, err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	switch name {
+	case "fit":
+		s.fitStats.record(err)
+	case "predict":
+		s.predictStats.record(err)
+		if err == nil {
+			s.lastPredict = time.Now()
+		}
+	}
+}
+
+// Health reports whether the state is ready to serve predictions. The
+// returned map has following fields:
+//
+//	ready: true when the state isn't terminated, the last call didn't time
+//	out, the last calls to "predict" didn't all fail, and the circuit
+//	breaker isn't open
+//	terminated: true when the state is terminated
+//	timed_out: true when a call timed out and neither a call has succeeded
+//	nor a model has been loaded since
+//	loaded: true when the model was loaded by LOAD STATE or other ways, and
+//	false when it was only created
+//	fit, predict: results of the last calls to the method, which have
+//	"recent_calls", "recent_failures", "consecutive_failures", and "failing"
+//	last_successful_predict: the time of the last successful prediction,
+//	which is null when no prediction has succeeded
+//	since_last_successful_predict: seconds since last_successful_predict
+//	breaker: the state of the circuit breaker, "closed", "open", or
+//	"half_open"
+//	restarts: the number of restarts of Python processes of the "process"
+//	backend, each of which rolled the model back to the last save or load
+func (s *State) Health(ctx *core.Context) (data.Map, error) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	terminated := s.base.CheckTermination() != nil
+	timedOut := !s.healthy()
+	restarts := s.restarts()
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	breaker := s.breaker.stateName()
+	ready := !terminated && !timedOut && !s.predictStats.failing() &&
+		breaker != breakerStateNames[breakerOpen]
+	m := data.Map{
+		"ready":                         data.Bool(ready),
+		"terminated":                    data.Bool(terminated),
+		"timed_out":                     data.Bool(timedOut),
+		"loaded":                        data.Bool(s.loaded),
+		"fit":                           s.fitStats.toMap(),
+		"predict":                       s.predictStats.toMap(),
+		"last_successful_predict":       data.Null{},
+		"since_last_successful_predict": data.Null{},
+		"breaker":                       data.String(breaker),
+		"restarts":                      data.Int(restarts),
+	}
+	if !s.lastPredict.IsZero() {
+		m["last_successful_predict"] = data.Timestamp(s.lastPredict)
+		m["since_last_successful_predict"] = data.Float(time.Since(s.lastPredict).Seconds())
+	}
+	return m, nil
+}
+
+// Health reports whether the state is ready to serve predictions. See
+// State.Health for details of the returned map.
+func Health(ctx *core.Context, stateName string) (data.Value, error) {
+	s, err := lookupState(ctx, stateName)
+	if err != nil {
+		return nil, err
+	}
+	return s.Health(ctx)
+}
@@ -0,0 +1,157 @@
+package pymlstate
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+	"time"
+)
+
+func TestCallStats(t *testing.T) {
+	Convey("Given stats of calls", t, func() {
+		c := &callStats{}
+
+		Convey("When calls fail fewer times than the window", func() {
+			c.record(nil)
+			for i := 0; i < healthWindow-1; i++ {
+				c.record(errors.New("failed"))
+			}
+
+			Convey("Then it should not be failing", func() {
+				So(c.failing(), ShouldBeFalse)
+				So(c.toMap(), ShouldResemble, data.Map{
+					"recent_calls":         data.Int(healthWindow),
+					"recent_failures":      data.Int(healthWindow - 1),
+					"consecutive_failures": data.Int(healthWindow - 1),
+					"failing":              data.Bool(false),
+				})
+			})
+
+			Convey("And a call fails again", func() {
+				c.record(errors.New("failed"))
+
+				Convey("Then it should be failing", func() {
+					So(c.failing(), ShouldBeTrue)
+				})
+			})
+
+			Convey("And a call succeeds", func() {
+				c.record(nil)
+
+				Convey("Then consecutive failures should be reset", func() {
+					So(c.consecutive, ShouldEqual, 0)
+					So(c.toMap()["recent_failures"], ShouldEqual, data.Int(healthWindow-1))
+				})
+			})
+		})
+	})
+}
+
+func TestPyMLStateHealth(t *testing.T) {
+	Convey("Given a created pymlstate", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When get its health", func() {
+			h, err := s.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be ready but not loaded", func() {
+				So(h["ready"], ShouldEqual, data.Bool(true))
+				So(h["terminated"], ShouldEqual, data.Bool(false))
+				So(h["loaded"], ShouldEqual, data.Bool(false))
+				So(h["last_successful_predict"], ShouldResemble, data.Null{})
+			})
+		})
+
+		Convey("When predict successfully", func() {
+			_, err := s.Predict(ctx, data.String("a"))
+			So(err, ShouldBeNil)
+			h, err := s.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should have the time of the prediction", func() {
+				So(h["last_successful_predict"], ShouldHaveSameTypeAs, data.Timestamp{})
+				So(h["since_last_successful_predict"], ShouldHaveSameTypeAs, data.Float(0))
+			})
+		})
+
+		Convey("When predictions keep failing", func() {
+			for i := 0; i < healthWindow; i++ {
+				_, err := s.Predict(ctx, data.String("error"))
+				So(err, ShouldNotBeNil)
+			}
+			h, err := s.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should not be ready", func() {
+				So(h["ready"], ShouldEqual, data.Bool(false))
+				p := h["predict"].(data.Map)
+				So(p["failing"], ShouldEqual, data.Bool(true))
+				So(p["consecutive_failures"], ShouldEqual, data.Int(healthWindow))
+			})
+		})
+
+		Convey("When save and load it", func() {
+			buf := bytes.NewBuffer(nil)
+			So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			So(s.Load(ctx, buf, data.Map{}), ShouldBeNil)
+			h, err := s.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be loaded", func() {
+				So(h["loaded"], ShouldEqual, data.Bool(true))
+			})
+		})
+
+		Convey("When load a model after a prediction times out", func() {
+			slow, err := New(processTestBaseParams, &MLParams{
+				BatchSize:      1,
+				Backend:        processBackend,
+				PredictTimeout: 100 * time.Millisecond,
+			}, data.Map{"delay": data.Int(10)})
+			So(err, ShouldBeNil)
+			Reset(func() {
+				slow.Terminate(ctx)
+			})
+			_, err = slow.Predict(ctx, data.String("a"))
+			So(err, ShouldNotBeNil)
+			waitAbandonedCalls(slow)
+			h, err := slow.Health(ctx)
+			So(err, ShouldBeNil)
+			So(h["timed_out"], ShouldEqual, data.Bool(true))
+
+			buf := bytes.NewBuffer(nil)
+			So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			So(slow.Load(ctx, buf, data.Map{}), ShouldBeNil)
+			h, err = slow.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should not be timed out", func() {
+				So(h["timed_out"], ShouldEqual, data.Bool(false))
+				So(h["ready"], ShouldEqual, data.Bool(true))
+			})
+		})
+
+		Convey("When terminate it", func() {
+			So(s.Terminate(ctx), ShouldBeNil)
+			h, err := s.Health(ctx)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be terminated", func() {
+				So(h["ready"], ShouldEqual, data.Bool(false))
+				So(h["terminated"], ShouldEqual, data.Bool(true))
+			})
+		})
+	})
+}
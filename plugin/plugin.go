@@ -2,6 +2,9 @@ package plugin
 
 import (
 	"gopkg.in/sensorbee/pymlstate.v0"
+	"gopkg.in/sensorbee/pymlstate.v0/batch"
+	"gopkg.in/sensorbee/pymlstate.v0/dataset"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
 	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
 )
 
@@ -12,6 +15,32 @@ func init() {
 		udf.MustConvertGeneric(pymlstate.Fit))
 	udf.MustRegisterGlobalUDF("pymlstate_predict",
 		udf.MustConvertGeneric(pymlstate.Predict))
+	udf.MustRegisterGlobalUDF("pymlstate_score",
+		udf.MustConvertGeneric(pymlstate.Score))
 	udf.MustRegisterGlobalUDF("pymlstate_flush",
 		udf.MustConvertGeneric(pymlstate.Flush))
+	udf.MustRegisterGlobalUDF("pymlstate_bucket_stats",
+		udf.MustConvertGeneric(pymlstate.BucketStats))
+	udf.MustRegisterGlobalUDF("pymlstate_set_params",
+		udf.MustConvertGeneric(pymlstate.SetParams))
+	udf.MustRegisterGlobalUDF("pymlstate_restore_checkpoint",
+		udf.MustConvertGeneric(pymlstate.RestoreCheckpoint))
+	udf.MustRegisterGlobalUDF("pymlstate_health",
+		udf.MustConvertGeneric(pymlstate.Health))
+
+	udf.MustRegisterGlobalUDSCreator("pymlstate_bucket", &batch.BucketStateCreator{})
+	udf.MustRegisterGlobalUDSFCreator("pymlstate_batch",
+		udf.MustConvertToUDSFCreator(batch.CreateBucketStoreUDSF))
+	udf.MustRegisterGlobalUDF("pymlstate_bucket_flush",
+		udf.MustConvertGeneric(batch.FlushBucket))
+
+	udf.MustRegisterGlobalUDSFCreator("pymlstate_epoch",
+		udf.MustConvertToUDSFCreator(batch.CreateEpochUDSF))
+	udf.MustRegisterGlobalUDSFCreator("pymlstate_disk_epoch",
+		udf.MustConvertToUDSFCreator(batch.CreateDiskEpochUDSF))
+	udf.MustRegisterGlobalUDSFCreator("pymlstate_train_epoch",
+		udf.MustConvertToUDSFCreator(batch.CreateTrainEpochUDSF))
+
+	bql.MustRegisterGlobalSourceCreator("idx_source", &dataset.IDXSourceCreator{})
+	bql.MustRegisterGlobalSourceCreator("csv_source", &dataset.CSVSourceCreator{})
 }
@@ -0,0 +1,642 @@
+package pymlstate
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+const (
+	standardScaling = "standard"
+	minMaxScaling   = "min_max"
+	oneHotEncoding  = "one_hot"
+	featureHashing  = "hash"
+	imputation      = "impute"
+
+	imputeMean     = "mean"
+	imputeConstant = "constant"
+
+	defaultHashFeatures = 32
+)
+
+var (
+	prepPathPath        = data.MustCompilePath("path")
+	prepTypePath        = data.MustCompilePath("type")
+	prepCategoriesPath  = data.MustCompilePath("categories")
+	prepNumFeaturesPath = data.MustCompilePath("num_features")
+	prepStrategyPath    = data.MustCompilePath("strategy")
+	prepValuePath       = data.MustCompilePath("value")
+)
+
+// Preprocessor transforms features of data.Map inputs in Go before they're
+// passed to "fit" or "predict" of Python. Statistics needed by the steps,
+// such as a mean of standard scaling, are updated every time the state is
+// trained and saved with MLParams.
+type Preprocessor struct {
+	Steps []*PreprocessStep `codec:"steps"`
+
+	// mu protects statistics. FitTransform and Transform only read them, so
+	// they run concurrently, and only Commit takes the write lock.
+	mu sync.RWMutex
+}
+
+// PreprocessStep is a single transformation applied to a value at Path. Steps
+// are applied in order, so an "impute" step has to precede scaling steps
+// of the same path to fill missing values.
+type PreprocessStep struct {
+	// Path is a path to the value to be transformed.
+	Path string `codec:"path"`
+
+	// Type is one of "standard", "min_max", "one_hot", "hash", and "impute".
+	Type string `codec:"type"`
+
+	// Categories is a list of categories of "one_hot". When it isn't given
+	// by the parameter, categories are collected from training data in the
+	// order of appearance and the number of features grows as new categories
+	// are found.
+	Categories []string `codec:"categories,omitempty"`
+
+	// FixedCategories is true when Categories is given by the parameter.
+	FixedCategories bool `codec:"fixed_categories,omitempty"`
+
+	// NumFeatures is the number of features "hash" generates.
+	NumFeatures int `codec:"num_features,omitempty"`
+
+	// Strategy is "mean" or "constant" and only used by "impute".
+	Strategy string `codec:"strategy,omitempty"`
+
+	// Value is a value to fill with when Strategy is "constant".
+	Value float64 `codec:"value,omitempty"`
+
+	// Counts, Means, M2s, Mins, and Maxes are fitted statistics. They have
+	// one element for a scalar feature and one element per dimension for
+	// an array feature.
+	Counts []int64    `codec:"counts,omitempty"`
+	Means  []float64  `codec:"means,omitempty"`
+	M2s    []float64  `codec:"m2s,omitempty"`
+	Mins   []float64  `codec:"mins,omitempty"`
+	Maxes  []float64  `codec:"maxes,omitempty"`
+	path   data.Path  // compiled Path
+	catIdx categories // index of Categories
+}
+
+type categories map[string]int
+
+// NewPreprocessor creates a Preprocessor from the "preprocess" parameter,
+// which is an array of maps. Each map has "path" and "type" keys and options
+// of the type:
+//
+//	[{"path": "age", "type": "impute", "strategy": "mean"},
+//	 {"path": "age", "type": "standard"},
+//	 {"path": "pixels", "type": "min_max"},
+//	 {"path": "color", "type": "one_hot", "categories": ["red", "blue"]},
+//	 {"path": "words", "type": "hash", "num_features": 64}]
+func NewPreprocessor(spec data.Array) (*Preprocessor, error) {
+	p := &Preprocessor{}
+	for i, sv := range spec {
+		m, err := data.AsMap(sv)
+		if err != nil {
+			return nil, fmt.Errorf("preprocess[%v] must be a map: %v", i, err)
+		}
+		st, err := newPreprocessStep(m)
+		if err != nil {
+			return nil, fmt.Errorf("preprocess[%v] is invalid: %v", i, err)
+		}
+		p.Steps = append(p.Steps, st)
+	}
+	return p, nil
+}
+
+func newPreprocessStep(m data.Map) (*PreprocessStep, error) {
+	st := &PreprocessStep{}
+	if v, err := m.Get(prepPathPath); err != nil {
+		return nil, err
+	} else if st.Path, err = data.AsString(v); err != nil {
+		return nil, err
+	}
+	if v, err := m.Get(prepTypePath); err != nil {
+		return nil, err
+	} else if st.Type, err = data.AsString(v); err != nil {
+		return nil, err
+	}
+
+	switch st.Type {
+	case standardScaling, minMaxScaling:
+	case oneHotEncoding:
+		if v, err := m.Get(prepCategoriesPath); err == nil {
+			cs, err := data.AsArray(v)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range cs {
+				s, err := data.AsString(c)
+				if err != nil {
+					return nil, err
+				}
+				st.Categories = append(st.Categories, s)
+			}
+			st.FixedCategories = true
+		}
+	case featureHashing:
+		st.NumFeatures = defaultHashFeatures
+		if v, err := m.Get(prepNumFeaturesPath); err == nil {
+			n, err := data.AsInt(v)
+			if err != nil {
+				return nil, err
+			}
+			if n <= 0 {
+				return nil, errors.New("num_features must be greater than 0")
+			}
+			st.NumFeatures = int(n)
+		}
+	case imputation:
+		st.Strategy = imputeMean
+		if v, err := m.Get(prepStrategyPath); err == nil {
+			if st.Strategy, err = data.AsString(v); err != nil {
+				return nil, err
+			}
+		}
+		switch st.Strategy {
+		case imputeMean:
+		case imputeConstant:
+			v, err := m.Get(prepValuePath)
+			if err != nil {
+				return nil, err
+			}
+			if st.Value, err = data.ToFloat(v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported impute strategy: %v", st.Strategy)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported preprocess type: %v", st.Type)
+	}
+
+	if err := st.compile(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// compile initializes unexported fields. It must be called after the step is
+// decoded from a saved state.
+func (st *PreprocessStep) compile() error {
+	p, err := data.CompilePath(st.Path)
+	if err != nil {
+		return err
+	}
+	st.path = p
+	st.catIdx = categories{}
+	for i, c := range st.Categories {
+		st.catIdx[c] = i
+	}
+	return nil
+}
+
+func (p *Preprocessor) compile() error {
+	for _, st := range p.Steps {
+		if err := st.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreprocessFit has statistics fitted by FitTransform. They aren't applied to
+// the Preprocessor until Commit is called so that a failed training doesn't
+// leave partially updated statistics.
+type PreprocessFit struct {
+	deltas []*PreprocessStep
+}
+
+// FitTransform fits statistics of all steps with the sample and returns
+// transformed copies of values in the bucket. Statistics of a step are fitted
+// with values transformed by preceding steps. The sample is the bucket when
+// it's nil. It's different from the bucket when the bucket has values which
+// must not be counted twice, e.g. oversampled ones or ones which the model has
+// already been trained with.
+//
+// Values are transformed with statistics of the Preprocessor updated by the
+// sample, but the Preprocessor itself isn't modified. The returned
+// PreprocessFit has to be passed to Commit after the training succeeds.
+func (p *Preprocessor) FitTransform(bucket, sample []data.Value) ([]data.Value,
+	*PreprocessFit, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ms, err := copyMaps(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	ss := ms
+	if sample != nil {
+		if ss, err = copyMaps(sample); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f := &PreprocessFit{}
+	for _, st := range p.Steps {
+		d := st.newDelta()
+		for _, m := range ss {
+			if err := d.update(m); err != nil {
+				return nil, nil, err
+			}
+		}
+		fitted := st.clone()
+		if err := fitted.merge(d); err != nil {
+			return nil, nil, err
+		}
+		for _, m := range ms {
+			if err := fitted.apply(m); err != nil {
+				return nil, nil, err
+			}
+		}
+		if sample != nil {
+			for _, m := range ss {
+				if err := fitted.apply(m); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		f.deltas = append(f.deltas, d)
+	}
+
+	res := make([]data.Value, len(ms))
+	for i, m := range ms {
+		res[i] = m
+	}
+	return res, f, nil
+}
+
+// Commit updates statistics of the Preprocessor with those fitted by
+// FitTransform. Statistics fitted concurrently are merged.
+func (p *Preprocessor) Commit(f *PreprocessFit) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(f.deltas) != len(p.Steps) {
+		return errors.New("fitted statistics don't match steps of preprocess")
+	}
+	for i, st := range p.Steps {
+		if err := st.merge(f.deltas[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyMaps(vs []data.Value) ([]data.Map, error) {
+	ms := make([]data.Map, len(vs))
+	for i, v := range vs {
+		m, err := data.AsMap(v)
+		if err != nil {
+			return nil, fmt.Errorf("preprocess requires map data: %v", err)
+		}
+		ms[i] = m.Copy()
+	}
+	return ms, nil
+}
+
+// Transform returns a transformed copy of the value with fitted statistics.
+func (p *Preprocessor) Transform(v data.Value) (data.Value, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	m, err := data.AsMap(v)
+	if err != nil {
+		return nil, fmt.Errorf("preprocess requires map data: %v", err)
+	}
+	m = m.Copy()
+	for _, st := range p.Steps {
+		if err := st.apply(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// update updates statistics of the step with the value in m.
+func (st *PreprocessStep) update(m data.Map) error {
+	switch st.Type {
+	case oneHotEncoding:
+		if st.FixedCategories {
+			return nil
+		}
+		v, err := m.Get(st.path)
+		if err != nil || v.Type() == data.TypeNull {
+			return nil
+		}
+		s, err := data.ToString(v)
+		if err != nil {
+			return err
+		}
+		if _, ok := st.catIdx[s]; !ok {
+			st.catIdx[s] = len(st.Categories)
+			st.Categories = append(st.Categories, s)
+		}
+		return nil
+
+	case featureHashing:
+		return nil
+	}
+
+	v, err := m.Get(st.path)
+	if err != nil {
+		if st.Type == imputation {
+			return nil
+		}
+		return fmt.Errorf("'%v' is missing", st.Path)
+	}
+	xs, _, err := toVector(v)
+	if err != nil {
+		return fmt.Errorf("'%v' is invalid: %v", st.Path, err)
+	}
+	if err := st.initStats(len(xs)); err != nil {
+		return err
+	}
+	for i, x := range xs {
+		if math.IsNaN(x) {
+			if st.Type == imputation {
+				continue
+			}
+			return fmt.Errorf("'%v' has a missing value", st.Path)
+		}
+		st.Counts[i]++
+		delta := x - st.Means[i]
+		st.Means[i] += delta / float64(st.Counts[i])
+		st.M2s[i] += delta * (x - st.Means[i])
+		if st.Counts[i] == 1 || x < st.Mins[i] {
+			st.Mins[i] = x
+		}
+		if st.Counts[i] == 1 || x > st.Maxes[i] {
+			st.Maxes[i] = x
+		}
+	}
+	return nil
+}
+
+// newDelta returns a step having the same configuration as st and empty
+// statistics, which are fitted with a new batch.
+func (st *PreprocessStep) newDelta() *PreprocessStep {
+	d := &PreprocessStep{
+		Path:            st.Path,
+		Type:            st.Type,
+		FixedCategories: st.FixedCategories,
+		NumFeatures:     st.NumFeatures,
+		Strategy:        st.Strategy,
+		Value:           st.Value,
+		path:            st.path,
+		catIdx:          categories{},
+	}
+	if st.FixedCategories {
+		d.Categories = st.Categories
+		d.catIdx = st.catIdx
+	}
+	return d
+}
+
+// clone returns a deep copy of st.
+func (st *PreprocessStep) clone() *PreprocessStep {
+	c := *st
+	c.Categories = append([]string(nil), st.Categories...)
+	c.Counts = append([]int64(nil), st.Counts...)
+	c.Means = append([]float64(nil), st.Means...)
+	c.M2s = append([]float64(nil), st.M2s...)
+	c.Mins = append([]float64(nil), st.Mins...)
+	c.Maxes = append([]float64(nil), st.Maxes...)
+	c.catIdx = categories{}
+	for k, v := range st.catIdx {
+		c.catIdx[k] = v
+	}
+	return &c
+}
+
+// merge adds statistics of d, which is created by newDelta, to st. New
+// categories are appended in the order of appearance.
+func (st *PreprocessStep) merge(d *PreprocessStep) error {
+	if !st.FixedCategories {
+		for _, c := range d.Categories {
+			if _, ok := st.catIdx[c]; !ok {
+				st.catIdx[c] = len(st.Categories)
+				st.Categories = append(st.Categories, c)
+			}
+		}
+	}
+	if len(d.Counts) == 0 {
+		return nil
+	}
+	if err := st.initStats(len(d.Counts)); err != nil {
+		return err
+	}
+	for i, nb := range d.Counts {
+		na := st.Counts[i]
+		if nb == 0 {
+			continue
+		}
+		if na == 0 {
+			st.Counts[i] = nb
+			st.Means[i] = d.Means[i]
+			st.M2s[i] = d.M2s[i]
+			st.Mins[i] = d.Mins[i]
+			st.Maxes[i] = d.Maxes[i]
+			continue
+		}
+		// parallel algorithm of the variance
+		n := float64(na + nb)
+		delta := d.Means[i] - st.Means[i]
+		st.Counts[i] = na + nb
+		st.Means[i] += delta * float64(nb) / n
+		st.M2s[i] += d.M2s[i] + delta*delta*float64(na)*float64(nb)/n
+		st.Mins[i] = math.Min(st.Mins[i], d.Mins[i])
+		st.Maxes[i] = math.Max(st.Maxes[i], d.Maxes[i])
+	}
+	return nil
+}
+
+func (st *PreprocessStep) initStats(n int) error {
+	if len(st.Counts) == 0 {
+		st.Counts = make([]int64, n)
+		st.Means = make([]float64, n)
+		st.M2s = make([]float64, n)
+		st.Mins = make([]float64, n)
+		st.Maxes = make([]float64, n)
+		return nil
+	}
+	if len(st.Counts) != n {
+		return fmt.Errorf("'%v' must have %v elements but has %v",
+			st.Path, len(st.Counts), n)
+	}
+	return nil
+}
+
+// apply replaces the value in m with the transformed one.
+func (st *PreprocessStep) apply(m data.Map) error {
+	v, err := m.Get(st.path)
+	missing := err != nil || v.Type() == data.TypeNull
+
+	var res data.Value
+	switch st.Type {
+	case oneHotEncoding:
+		arr := make(data.Array, len(st.Categories))
+		for i := range arr {
+			arr[i] = data.Float(0)
+		}
+		if !missing {
+			s, err := data.ToString(v)
+			if err != nil {
+				return err
+			}
+			if i, ok := st.catIdx[s]; ok {
+				arr[i] = data.Float(1)
+			}
+		}
+		res = arr
+
+	case featureHashing:
+		arr := make(data.Array, st.NumFeatures)
+		for i := range arr {
+			arr[i] = data.Float(0)
+		}
+		if !missing {
+			words := data.Array{v}
+			if v.Type() == data.TypeArray {
+				words, _ = data.AsArray(v)
+			}
+			for _, w := range words {
+				s, err := data.ToString(w)
+				if err != nil {
+					return err
+				}
+				h := fnv.New32a()
+				h.Write([]byte(s))
+				i := int(h.Sum32() % uint32(st.NumFeatures))
+				arr[i] = arr[i].(data.Float) + 1
+			}
+		}
+		res = arr
+
+	case imputation:
+		if len(st.Counts) == 0 && st.Strategy == imputeMean {
+			return fmt.Errorf("impute of '%v' hasn't been fitted yet", st.Path)
+		}
+		if missing {
+			if len(st.Means) > 1 {
+				xs := make([]float64, len(st.Means))
+				for i := range xs {
+					xs[i] = st.fillValue(i)
+				}
+				res = fromVector(xs, true)
+			} else {
+				res = data.Float(st.fillValue(0))
+			}
+			break
+		}
+		xs, isArray, err := toVector(v)
+		if err != nil {
+			return fmt.Errorf("'%v' is invalid: %v", st.Path, err)
+		}
+		for i, x := range xs {
+			if math.IsNaN(x) {
+				xs[i] = st.fillValue(i)
+			}
+		}
+		res = fromVector(xs, isArray)
+
+	case standardScaling, minMaxScaling:
+		if missing {
+			return fmt.Errorf("'%v' is missing", st.Path)
+		}
+		if len(st.Counts) == 0 {
+			return fmt.Errorf("%v scaling of '%v' hasn't been fitted yet",
+				st.Type, st.Path)
+		}
+		xs, isArray, err := toVector(v)
+		if err != nil {
+			return fmt.Errorf("'%v' is invalid: %v", st.Path, err)
+		}
+		if len(xs) != len(st.Counts) {
+			return fmt.Errorf("'%v' must have %v elements but has %v",
+				st.Path, len(st.Counts), len(xs))
+		}
+		for i, x := range xs {
+			if math.IsNaN(x) {
+				return fmt.Errorf("'%v' has a missing value", st.Path)
+			}
+			xs[i] = st.scale(i, x)
+		}
+		res = fromVector(xs, isArray)
+	}
+	return m.Set(st.path, res)
+}
+
+func (st *PreprocessStep) fillValue(i int) float64 {
+	if st.Strategy == imputeConstant || i >= len(st.Means) {
+		return st.Value
+	}
+	return st.Means[i]
+}
+
+func (st *PreprocessStep) scale(i int, x float64) float64 {
+	if st.Type == minMaxScaling {
+		r := st.Maxes[i] - st.Mins[i]
+		if r == 0 {
+			return 0
+		}
+		return (x - st.Mins[i]) / r
+	}
+
+	std := math.Sqrt(st.M2s[i] / float64(st.Counts[i]))
+	if std == 0 {
+		return x - st.Means[i]
+	}
+	return (x - st.Means[i]) / std
+}
+
+// toVector converts a numeric value or an array of numeric values to a slice.
+// A null is converted to NaN.
+func toVector(v data.Value) ([]float64, bool, error) {
+	if v.Type() != data.TypeArray {
+		x, err := toFloatOrNaN(v)
+		if err != nil {
+			return nil, false, err
+		}
+		return []float64{x}, false, nil
+	}
+
+	arr, _ := data.AsArray(v)
+	xs := make([]float64, len(arr))
+	for i, e := range arr {
+		x, err := toFloatOrNaN(e)
+		if err != nil {
+			return nil, false, err
+		}
+		xs[i] = x
+	}
+	return xs, true, nil
+}
+
+func toFloatOrNaN(v data.Value) (float64, error) {
+	switch v.Type() {
+	case data.TypeNull:
+		return math.NaN(), nil
+	case data.TypeInt, data.TypeFloat:
+		return data.ToFloat(v)
+	default:
+		return 0, fmt.Errorf("%v isn't a number", v)
+	}
+}
+
+func fromVector(xs []float64, isArray bool) data.Value {
+	if !isArray {
+		return data.Float(xs[0])
+	}
+	arr := make(data.Array, len(xs))
+	for i, x := range xs {
+		arr[i] = data.Float(x)
+	}
+	return arr
+}
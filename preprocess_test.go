@@ -0,0 +1,377 @@
+package pymlstate
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+	"time"
+)
+
+func TestNewPreprocessor(t *testing.T) {
+	Convey("Given preprocess specs", t, func() {
+		Convey("When create a preprocessor with valid specs", func() {
+			spec := data.Array{
+				data.Map{"path": data.String("a"), "type": data.String("standard")},
+				data.Map{"path": data.String("b"), "type": data.String("min_max")},
+				data.Map{
+					"path":       data.String("c"),
+					"type":       data.String("one_hot"),
+					"categories": data.Array{data.String("x"), data.String("y")},
+				},
+				data.Map{"path": data.String("d"), "type": data.String("hash")},
+				data.Map{
+					"path":     data.String("e"),
+					"type":     data.String("impute"),
+					"strategy": data.String("constant"),
+					"value":    data.Int(-1),
+				},
+			}
+			p, err := NewPreprocessor(spec)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should have steps with default options", func() {
+				So(len(p.Steps), ShouldEqual, 5)
+				So(p.Steps[2].Categories, ShouldResemble, []string{"x", "y"})
+				So(p.Steps[2].FixedCategories, ShouldBeTrue)
+				So(p.Steps[3].NumFeatures, ShouldEqual, defaultHashFeatures)
+				So(p.Steps[4].Strategy, ShouldEqual, imputeConstant)
+				So(p.Steps[4].Value, ShouldEqual, -1)
+			})
+		})
+
+		invalids := map[string]data.Value{
+			"a non-map step":        data.String("standard"),
+			"a step without path":   data.Map{"type": data.String("standard")},
+			"an unsupported type":   data.Map{"path": data.String("a"), "type": data.String("log")},
+			"a zero hash dimension": data.Map{"path": data.String("a"), "type": data.String("hash"), "num_features": data.Int(0)},
+			"an unknown strategy":   data.Map{"path": data.String("a"), "type": data.String("impute"), "strategy": data.String("median")},
+			"a constant w/o value":  data.Map{"path": data.String("a"), "type": data.String("impute"), "strategy": data.String("constant")},
+		}
+		for name, st := range invalids {
+			st := st
+			Convey("When create a preprocessor with "+name, func() {
+				_, err := NewPreprocessor(data.Array{st})
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+	})
+}
+
+func TestPreprocessorFitTransform(t *testing.T) {
+	Convey("Given a preprocessor with all types of steps", t, func() {
+		p, err := NewPreprocessor(data.Array{
+			data.Map{"path": data.String("age"), "type": data.String("impute")},
+			data.Map{"path": data.String("age"), "type": data.String("standard")},
+			data.Map{"path": data.String("px"), "type": data.String("min_max")},
+			data.Map{"path": data.String("color"), "type": data.String("one_hot")},
+			data.Map{"path": data.String("words"), "type": data.String("hash"),
+				"num_features": data.Int(4)},
+		})
+		So(err, ShouldBeNil)
+
+		bucket := []data.Value{
+			data.Map{
+				"age":   data.Int(10),
+				"px":    data.Array{data.Int(0), data.Int(10)},
+				"color": data.String("red"),
+				"words": data.Array{data.String("a"), data.String("b")},
+			},
+			data.Map{
+				"age":   data.Null{},
+				"px":    data.Array{data.Int(5), data.Int(20)},
+				"color": data.String("blue"),
+				"words": data.String("a"),
+			},
+			data.Map{
+				"age":   data.Int(30),
+				"px":    data.Array{data.Int(10), data.Int(30)},
+				"color": data.String("red"),
+				"words": data.Array{},
+			},
+		}
+
+		Convey("When fit the bucket", func() {
+			res, f, err := p.FitTransform(bucket, nil)
+			So(err, ShouldBeNil)
+			So(len(res), ShouldEqual, 3)
+			So(p.Commit(f), ShouldBeNil)
+
+			Convey("Then values should be transformed", func() {
+				m0 := res[0].(data.Map)
+				m1 := res[1].(data.Map)
+				So(m0["age"], ShouldAlmostEqual, -1.2247, 0.0001)
+				So(m1["age"], ShouldEqual, data.Float(0))
+				So(m0["px"], ShouldResemble, data.Array{data.Float(0), data.Float(0)})
+				So(m1["px"], ShouldResemble, data.Array{data.Float(0.5), data.Float(0.5)})
+				So(m0["color"], ShouldResemble, data.Array{data.Float(1), data.Float(0)})
+				So(m1["color"], ShouldResemble, data.Array{data.Float(0), data.Float(1)})
+
+				ws, ok := m0["words"].(data.Array)
+				So(ok, ShouldBeTrue)
+				So(len(ws), ShouldEqual, 4)
+				sum := 0.0
+				for _, w := range ws {
+					sum += float64(w.(data.Float))
+				}
+				So(sum, ShouldEqual, 2)
+			})
+
+			Convey("Then the input should not be modified", func() {
+				So(bucket[0].(data.Map)["age"], ShouldEqual, data.Int(10))
+			})
+
+			Convey("And when transform a new value", func() {
+				v, err := p.Transform(data.Map{
+					"age":   data.Int(20),
+					"px":    data.Array{data.Int(20), data.Int(20)},
+					"color": data.String("green"),
+					"words": data.String("b"),
+				})
+				So(err, ShouldBeNil)
+
+				Convey("Then it should be transformed with fitted statistics", func() {
+					m := v.(data.Map)
+					So(m["age"], ShouldEqual, data.Float(0))
+					So(m["px"], ShouldResemble, data.Array{data.Float(2), data.Float(0.5)})
+					So(m["color"], ShouldResemble, data.Array{data.Float(0), data.Float(0)})
+				})
+			})
+
+			Convey("And when the preprocessor is encoded and decoded", func() {
+				var b []byte
+				h := &codec.MsgpackHandle{}
+				So(codec.NewEncoderBytes(&b, h).Encode(p), ShouldBeNil)
+				p2 := &Preprocessor{}
+				So(codec.NewDecoderBytes(b, h).Decode(p2), ShouldBeNil)
+				So(p2.compile(), ShouldBeNil)
+
+				Convey("Then it should transform values in the same way", func() {
+					in := data.Map{
+						"age":   data.Int(25),
+						"px":    data.Array{data.Int(1), data.Int(2)},
+						"color": data.String("blue"),
+						"words": data.String("c"),
+					}
+					v1, err := p.Transform(in)
+					So(err, ShouldBeNil)
+					v2, err := p2.Transform(in)
+					So(err, ShouldBeNil)
+					So(v2, ShouldResemble, v1)
+				})
+			})
+		})
+
+		Convey("When transform a value before fit", func() {
+			_, err := p.Transform(bucket[0])
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When fit a non-map value", func() {
+			_, _, err := p.FitTransform([]data.Value{data.Int(1)}, nil)
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When fit arrays having different lengths", func() {
+			_, _, err := p.FitTransform([]data.Value{
+				bucket[0],
+				data.Map{
+					"age":   data.Int(1),
+					"px":    data.Array{data.Int(1)},
+					"color": data.String("red"),
+					"words": data.String("a"),
+				},
+			}, nil)
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then statistics should not be updated", func() {
+				for _, st := range p.Steps {
+					So(st.Counts, ShouldBeEmpty)
+					So(st.Categories, ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When fit the bucket without committing", func() {
+			_, _, err := p.FitTransform(bucket, nil)
+			So(err, ShouldBeNil)
+
+			Convey("Then statistics should not be updated", func() {
+				_, err := p.Transform(bucket[0])
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When fit the bucket twice and commit both", func() {
+			_, f1, err := p.FitTransform(bucket[:2], nil)
+			So(err, ShouldBeNil)
+			_, f2, err := p.FitTransform(bucket[2:], nil)
+			So(err, ShouldBeNil)
+			So(p.Commit(f1), ShouldBeNil)
+			So(p.Commit(f2), ShouldBeNil)
+
+			Convey("Then statistics should be the same as fitting them at once", func() {
+				p2, err := NewPreprocessor(data.Array{
+					data.Map{"path": data.String("age"), "type": data.String("impute")},
+					data.Map{"path": data.String("px"), "type": data.String("min_max")},
+				})
+				So(err, ShouldBeNil)
+				_, f, err := p2.FitTransform(bucket, nil)
+				So(err, ShouldBeNil)
+				So(p2.Commit(f), ShouldBeNil)
+				So(p.Steps[0].Means[0], ShouldAlmostEqual, p2.Steps[0].Means[0], 1e-9)
+				So(p.Steps[0].Counts, ShouldResemble, p2.Steps[0].Counts)
+				So(p.Steps[2].Mins, ShouldResemble, p2.Steps[1].Mins)
+				So(p.Steps[2].Maxes, ShouldResemble, p2.Steps[1].Maxes)
+				So(p.Steps[3].Categories, ShouldResemble, []string{"red", "blue"})
+			})
+		})
+
+		Convey("When transform while another transformation is running", func() {
+			_, f, err := p.FitTransform(bucket, nil)
+			So(err, ShouldBeNil)
+			So(p.Commit(f), ShouldBeNil)
+			// a running transformation holds the read lock
+			p.mu.RLock()
+			done := make(chan error, 1)
+			go func() {
+				_, err := p.Transform(bucket[0])
+				done <- err
+			}()
+			var err2 error
+			select {
+			case err2 = <-done:
+			case <-time.After(time.Second):
+				err2 = errors.New("Transform is blocked")
+			}
+			p.mu.RUnlock()
+
+			Convey("Then it should not wait for the other one", func() {
+				So(err2, ShouldBeNil)
+			})
+		})
+
+		Convey("When fit a sample of the bucket", func() {
+			oversampled := append([]data.Value{bucket[0], bucket[0]}, bucket...)
+			res, f, err := p.FitTransform(oversampled, bucket)
+			So(err, ShouldBeNil)
+			So(p.Commit(f), ShouldBeNil)
+
+			Convey("Then all values should be transformed", func() {
+				So(len(res), ShouldEqual, 5)
+			})
+
+			Convey("Then statistics should be fitted only with the sample", func() {
+				So(p.Steps[0].Counts, ShouldResemble, []int64{2})
+				So(p.Steps[0].Means[0], ShouldAlmostEqual, 20, 1e-9)
+			})
+		})
+	})
+}
+
+func TestPyMLStatePreprocessFitFailure(t *testing.T) {
+	Convey("Given a pymlstate with preprocess", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		p, err := NewPreprocessor(data.Array{
+			data.Map{"path": data.String("x"), "type": data.String("standard")},
+		})
+		So(err, ShouldBeNil)
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:  1,
+			Backend:    processBackend,
+			Preprocess: p,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		_, err = s.Fit(ctx, []data.Value{data.Map{"x": data.Int(1)}, data.Map{"x": data.Int(3)}})
+		So(err, ShouldBeNil)
+
+		Convey("When fit of Python fails", func() {
+			_, err := s.Fit(ctx, []data.Value{
+				data.Map{"x": data.Int(100), "fail": data.Bool(true)},
+			})
+			So(err, ShouldNotBeNil)
+
+			Convey("Then statistics should not be updated", func() {
+				So(p.Steps[0].Counts, ShouldResemble, []int64{2})
+				So(p.Steps[0].Means[0], ShouldAlmostEqual, 2, 1e-9)
+			})
+		})
+
+		Convey("When set preprocess", func() {
+			So(s.SetParams(ctx, data.Map{
+				"preprocess": data.Array{
+					data.Map{"path": data.String("x"), "type": data.String("standard")},
+				},
+			}), ShouldBeNil)
+
+			Convey("Then fitted statistics should be discarded", func() {
+				So(s.params.Preprocess, ShouldNotEqual, p)
+				So(s.params.Preprocess.Steps[0].Counts, ShouldBeEmpty)
+				_, err := s.Predict(ctx, data.Map{"x": data.Int(1)})
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a tuple of the batch is invalid", func() {
+			_, err := s.Fit(ctx, []data.Value{
+				data.Map{"x": data.Int(100)},
+				data.Map{"x": data.String("a")},
+			})
+			So(err, ShouldNotBeNil)
+
+			Convey("Then statistics should not be updated", func() {
+				So(p.Steps[0].Counts, ShouldResemble, []int64{2})
+			})
+		})
+	})
+}
+
+func TestPyMLStatePreprocessSlidingWindow(t *testing.T) {
+	Convey("Given a pymlstate with preprocess and a sliding window bucket", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		p, err := NewPreprocessor(data.Array{
+			data.Map{"path": data.String("x"), "type": data.String("standard")},
+		})
+		So(err, ShouldBeNil)
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:     3,
+			BucketPolicy:  slidingWindowPolicy,
+			TrainInterval: 2,
+			Backend:       processBackend,
+			Preprocess:    p,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When write tuples trained in two overlapping windows", func() {
+			for i := 1; i <= 4; i++ {
+				So(s.Write(ctx, &core.Tuple{
+					Data: data.Map{"data": data.Map{"x": data.Int(i)}},
+				}), ShouldBeNil)
+			}
+
+			Convey("Then each tuple should be counted once in statistics", func() {
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(2))
+				So(p.Steps[0].Counts, ShouldResemble, []int64{4})
+				So(p.Steps[0].Means[0], ShouldAlmostEqual, 2.5, 1e-9)
+			})
+		})
+	})
+}
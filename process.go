@@ -0,0 +1,626 @@
+package pymlstate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// process_bridge.go is generated from process_bridge.py.
+//go:generate go run gen_process_bridge.go
+
+// Backends running Python models.
+const (
+	inProcessBackend = "inprocess"
+	processBackend   = "process"
+)
+
+const (
+	defaultPythonPath = "python"
+
+	// exitTimeout is how long Terminate waits for the process to exit
+	// before killing it.
+	exitTimeout = 10 * time.Second
+
+	// maxFramePartSize is the maximum size of a part of a frame exchanged
+	// with the process, which prevents a broken stream from allocating a
+	// huge buffer.
+	maxFramePartSize = 1 << 30
+)
+
+var (
+	backendPath    = data.MustCompilePath("backend")
+	pythonPathPath = data.MustCompilePath("python_path")
+	rpcTimeoutPath = data.MustCompilePath("rpc_timeout")
+	restartPath    = data.MustCompilePath("restart")
+)
+
+// errCallCanceled is returned by a call to the process which is canceled.
+var errCallCanceled = errors.New("the call to pymlstate's python process was canceled")
+
+// model is an instance of a Python model. *pystate.Base runs it in the
+// process of SensorBee, and processModel runs it in a child process.
+type model interface {
+	Call(name string, args ...data.Value) (data.Value, error)
+	Save(ctx *core.Context, w io.Writer, params data.Map) error
+	Load(ctx *core.Context, r io.Reader, params data.Map) error
+	Terminate(ctx *core.Context) error
+	CheckTermination() error
+}
+
+var _ model = &pystate.Base{}
+
+// backendOf returns the backend of MLParams.
+func (p *MLParams) backendOf() string {
+	if p.Backend == "" {
+		return inProcessBackend
+	}
+	return p.Backend
+}
+
+// parseBackendParams parses parameters of the backend and removes them from
+// params. The backend cannot be changed when the state is loaded.
+//
+// backend: "inprocess" or "process" (default: "inprocess")
+//
+// python_path: the Python interpreter run by the "process" backend (default:
+// "python")
+//
+// rpc_timeout: the timeout of a call to the "process" backend, e.g. "30s" or a
+// number of seconds. It also applies to fit and save, so it must be longer than
+// them (default: no timeout)
+//
+// restart: whether the "process" backend restarts the process after it
+// crashes or times out (default: true)
+//
+// workers greater than 1, which is parsed by parseMLParams, is rejected
+// unless the backend is "process".
+func parseBackendParams(params data.Map, mlParams *MLParams, loading bool) error {
+	if b, err := params.Get(backendPath); err == nil {
+		backend, err := data.AsString(b)
+		if err != nil {
+			return err
+		}
+		switch backend {
+		case inProcessBackend, processBackend:
+		default:
+			return fmt.Errorf("unsupported backend: %v", backend)
+		}
+		if loading && backend != mlParams.backendOf() {
+			return fmt.Errorf("backend of the saved state is %v and cannot be changed",
+				mlParams.backendOf())
+		}
+		mlParams.Backend = backend
+		delete(params, "backend")
+	}
+
+	process := mlParams.backendOf() == processBackend
+	if pp, err := params.Get(pythonPathPath); err == nil {
+		if !process {
+			return errors.New("python_path can only be used with the process backend")
+		}
+		if mlParams.PythonPath, err = data.AsString(pp); err != nil {
+			return err
+		}
+		delete(params, "python_path")
+	}
+	if rt, err := params.Get(rpcTimeoutPath); err == nil {
+		if !process {
+			return errors.New("rpc_timeout can only be used with the process backend")
+		}
+		timeout, err := data.ToDuration(rt)
+		if err != nil {
+			return fmt.Errorf("rpc_timeout is invalid: %v", err)
+		}
+		if timeout <= 0 {
+			return errors.New("rpc_timeout must be greater than 0")
+		}
+		mlParams.RPCTimeout = timeout
+		delete(params, "rpc_timeout")
+	}
+	if rs, err := params.Get(restartPath); err == nil {
+		if !process {
+			return errors.New("restart can only be used with the process backend")
+		}
+		restart, err := data.AsBool(rs)
+		if err != nil {
+			return err
+		}
+		mlParams.NoRestart = !restart
+		delete(params, "restart")
+	}
+	return mlParams.checkWorkers()
+}
+
+// newModel creates a model on the backend of mlParams.
+func newModel(baseParams *pystate.BaseParams, mlParams *MLParams, params data.Map) (
+	model, error) {
+	if mlParams.backendOf() == processBackend {
+		m, err := newProcessModel(baseParams, mlParams, params)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	b, err := pystate.NewBase(baseParams, params)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// loadModel loads a model saved on the backend of mlParams.
+func loadModel(ctx *core.Context, mlParams *MLParams, r io.Reader, params data.Map) (
+	model, error) {
+	if mlParams.backendOf() == processBackend {
+		m, err := loadProcessModel(ctx, mlParams, r, params)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	b, err := pystate.LoadBase(ctx, r, params)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// processModel is a Python model running in a child process. Calls are
+// serialized and each of them times out after rpc_timeout when it's set. The
+// process is killed when it doesn't respond in time, and it's restarted by the
+// next call unless restart is disabled. A restarted process loads the model
+// saved or loaded last, or creates a new model when there's no such model, so
+// the training since then is lost. Restarts are logged as errors and reported by
+// State.Health.
+type processModel struct {
+	pythonPath string
+	timeout    time.Duration
+	restart    bool
+	modulePath string
+	moduleName string
+	className  string
+
+	mu      sync.Mutex
+	proc    *modelProcess
+	started bool
+
+	// terminated is accessed atomically so that CheckTermination doesn't
+	// wait for the running call.
+	terminated uint32
+
+	// restarts is the number of restarts of the process, and reported is
+	// the number of restarts which have been logged.
+	restartMu sync.Mutex
+	restarts  uint64
+	reported  uint64
+
+	createParams data.Map
+	loadParams   data.Map
+	snapshot     []byte
+}
+
+var _ canceler = &processModel{}
+
+// modelProcess is a running process of processBridge.
+type modelProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func newProcessModelOf(mlParams *MLParams) *processModel {
+	m := &processModel{
+		pythonPath: mlParams.PythonPath,
+		timeout:    mlParams.RPCTimeout,
+		restart:    !mlParams.NoRestart,
+	}
+	if m.pythonPath == "" {
+		m.pythonPath = defaultPythonPath
+	}
+	return m
+}
+
+func newProcessModel(baseParams *pystate.BaseParams, mlParams *MLParams,
+	params data.Map) (*processModel, error) {
+	m := newProcessModelOf(mlParams)
+	m.modulePath = baseParams.ModulePath
+	m.moduleName = baseParams.ModuleName
+	m.className = baseParams.ClassName
+	m.createParams = params.Copy()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.ensureRunning(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func loadProcessModel(ctx *core.Context, mlParams *MLParams, r io.Reader,
+	params data.Map) (*processModel, error) {
+	m := newProcessModelOf(mlParams)
+	if err := m.Load(ctx, r, params); err != nil {
+		m.Terminate(ctx)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Call calls a method of the model.
+func (m *processModel) Call(name string, args ...data.Value) (data.Value, error) {
+	return m.callWithCancel(nil, name, args...)
+}
+
+// callWithCancel calls a method of the model and aborts the call when cancel
+// is closed. The process is killed when the call is running, and the call
+// returns without calling the model when it's waiting for other calls.
+func (m *processModel) callWithCancel(cancel <-chan struct{}, name string,
+	args ...data.Value) (data.Value, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-cancel:
+		return nil, errCallCanceled
+	default:
+	}
+	res, _, err := m.requestLocked(cancel, data.Map{
+		"method": data.String("call"),
+		"name":   data.String(name),
+		"args":   data.Array(args),
+	}, nil)
+	return res, err
+}
+
+// Save saves the model with the module and the class of the model.
+func (m *processModel) Save(ctx *core.Context, w io.Writer, params data.Map) error {
+	header, saved, err := m.save(params)
+	m.logRestarts(ctx)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, header, saved)
+}
+
+func (m *processModel) save(params data.Map) (data.Map, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, saved, err := m.requestLocked(nil, data.Map{
+		"method": data.String("save"),
+		"kwargs": params,
+	}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.snapshot = saved
+	m.loadParams = nil
+	return data.Map{
+		"module_path": data.String(m.modulePath),
+		"module_name": data.String(m.moduleName),
+		"class_name":  data.String(m.className),
+	}, saved, nil
+}
+
+// Load loads the model saved by Save.
+func (m *processModel) Load(ctx *core.Context, r io.Reader, params data.Map) error {
+	header, saved, err := readFrame(r)
+	if err != nil {
+		return fmt.Errorf("cannot read the model of the process backend: %v", err)
+	}
+	var names [3]string
+	for i, k := range []string{"module_path", "module_name", "class_name"} {
+		v, ok := header[k]
+		if !ok {
+			return fmt.Errorf("the model of the process backend doesn't have %v", k)
+		}
+		if names[i], err = data.AsString(v); err != nil {
+			return err
+		}
+	}
+
+	defer m.logRestarts(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.CheckTermination(); err != nil {
+		return err
+	}
+	m.modulePath, m.moduleName, m.className = names[0], names[1], names[2]
+	if m.proc == nil {
+		// the model is created by the load request, so the process is
+		// started without creating a model
+		if err := m.startLocked(); err != nil {
+			return err
+		}
+	}
+	if _, _, err := m.roundTrip(nil, m.loadRequest(params), saved); err != nil {
+		return err
+	}
+	m.snapshot = saved
+	m.loadParams = params.Copy()
+	return nil
+}
+
+// Terminate stops the process.
+func (m *processModel) Terminate(ctx *core.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	atomic.StoreUint32(&m.terminated, 1)
+	if m.proc == nil {
+		return nil
+	}
+
+	// the bridge exits when stdin is closed
+	p := m.proc
+	m.proc = nil
+	p.stdin.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.cmd.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(exitTimeout):
+		p.cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// CheckTermination returns an error when the model is terminated.
+func (m *processModel) CheckTermination() error {
+	if atomic.LoadUint32(&m.terminated) != 0 {
+		return errors.New("pymlstate's python process is already terminated")
+	}
+	return nil
+}
+
+// restartCount returns the number of restarts of the process.
+func (m *processModel) restartCount() uint64 {
+	m.restartMu.Lock()
+	defer m.restartMu.Unlock()
+	return m.restarts
+}
+
+// logRestarts logs restarts which haven't been logged yet. A restart rolls
+// the model back to the last save or load, so it's logged as an error.
+func (m *processModel) logRestarts(ctx *core.Context) {
+	m.restartMu.Lock()
+	n := m.restarts - m.reported
+	m.reported = m.restarts
+	total := m.restarts
+	m.restartMu.Unlock()
+	if n == 0 {
+		return
+	}
+	ctx.Log().WithField("restarts", total).WithField("new_restarts", n).
+		Error("pymlstate's python process was restarted and its model was rolled back to the last save or load, the training since then is lost")
+}
+
+// requestLocked sends a request to the process, which is started when it
+// isn't running. The request is aborted when cancel is closed, and cancel can
+// be nil. m.mu must be locked.
+func (m *processModel) requestLocked(cancel <-chan struct{}, msg data.Map,
+	attachment []byte) (data.Value, []byte, error) {
+	if err := m.CheckTermination(); err != nil {
+		return nil, nil, err
+	}
+	if err := m.ensureRunning(); err != nil {
+		return nil, nil, err
+	}
+	return m.roundTrip(cancel, msg, attachment)
+}
+
+func (m *processModel) moduleRequest(method string, kwargs data.Map) data.Map {
+	if kwargs == nil {
+		kwargs = data.Map{}
+	}
+	return data.Map{
+		"method":      data.String(method),
+		"module_path": data.String(m.modulePath),
+		"module_name": data.String(m.moduleName),
+		"class_name":  data.String(m.className),
+		"kwargs":      kwargs,
+	}
+}
+
+func (m *processModel) loadRequest(params data.Map) data.Map {
+	return m.moduleRequest("load", params)
+}
+
+// ensureRunning starts the process when it isn't running, and creates or
+// restores the model. m.mu must be locked.
+func (m *processModel) ensureRunning() error {
+	if m.proc != nil {
+		return nil
+	}
+	if err := m.startLocked(); err != nil {
+		return err
+	}
+
+	var err error
+	if m.snapshot != nil {
+		_, _, err = m.roundTrip(nil, m.loadRequest(m.loadParams), m.snapshot)
+	} else if m.className != "" {
+		_, _, err = m.roundTrip(nil, m.moduleRequest("create", m.createParams), nil)
+	}
+	if err != nil {
+		m.kill()
+		return fmt.Errorf("cannot set up the model in the python process: %v", err)
+	}
+	return nil
+}
+
+// startLocked starts the process without setting up the model. m.mu must be
+// locked.
+func (m *processModel) startLocked() error {
+	if m.started && !m.restart {
+		return errors.New("pymlstate's python process has exited and restart is disabled")
+	}
+	p, err := startModelProcess(m.pythonPath)
+	if err != nil {
+		return err
+	}
+	if m.started {
+		m.restartMu.Lock()
+		m.restarts++
+		m.restartMu.Unlock()
+	}
+	m.proc = p
+	m.started = true
+	return nil
+}
+
+func startModelProcess(pythonPath string) (*modelProcess, error) {
+	cmd := exec.Command(pythonPath, "-c", processBridge)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start python process '%v': %v", pythonPath, err)
+	}
+	return &modelProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// roundTrip sends a request to the process and receives its response. The
+// process is killed when it doesn't respond in time, cancel is closed, or the
+// stream is broken. m.mu must be locked.
+func (m *processModel) roundTrip(cancel <-chan struct{}, msg data.Map,
+	attachment []byte) (data.Value, []byte, error) {
+	p := m.proc
+	type response struct {
+		msg        data.Map
+		attachment []byte
+		err        error
+	}
+	ch := make(chan response, 1)
+	go func() {
+		if err := writeFrame(p.stdin, msg, attachment); err != nil {
+			ch <- response{err: err}
+			return
+		}
+		res, a, err := readFrame(p.stdout)
+		ch <- response{res, a, err}
+	}()
+
+	var timeout <-chan time.Time
+	if m.timeout > 0 {
+		t := time.NewTimer(m.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var res response
+	select {
+	case res = <-ch:
+	case <-timeout:
+		m.kill()
+		<-ch
+		return nil, nil, fmt.Errorf("pymlstate's python process didn't respond in %v", m.timeout)
+	case <-cancel:
+		m.kill()
+		<-ch
+		return nil, nil, errCallCanceled
+	}
+	if res.err != nil {
+		// the process has crashed or the stream is broken
+		if err := m.kill(); err != nil {
+			return nil, nil, fmt.Errorf("pymlstate's python process has exited: %v", err)
+		}
+		return nil, nil, fmt.Errorf("cannot communicate with pymlstate's python process: %v", res.err)
+	}
+
+	if e, ok := res.msg["error"]; ok {
+		s, _ := data.ToString(e)
+		return nil, nil, fmt.Errorf("python error: %v", s)
+	}
+	v, ok := res.msg["result"]
+	if !ok {
+		v = data.Null{}
+	}
+	return v, res.attachment, nil
+}
+
+// kill kills the process and returns the result of the process. m.mu must be
+// locked.
+func (m *processModel) kill() error {
+	p := m.proc
+	if p == nil {
+		return nil
+	}
+	m.proc = nil
+	p.cmd.Process.Kill()
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+// writeFrame writes a msgpack map followed by a binary attachment. Each part
+// is prefixed by its size in uint32 big endian.
+func writeFrame(w io.Writer, msg data.Map, attachment []byte) error {
+	b, err := data.MarshalMsgpack(msg)
+	if err != nil {
+		return err
+	}
+	for _, part := range [][]byte{b, attachment} {
+		if len(part) > maxFramePartSize {
+			return fmt.Errorf("frame is too large: %v bytes", len(part))
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(part)))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads a frame written by writeFrame.
+func readFrame(r io.Reader) (data.Map, []byte, error) {
+	var parts [2][]byte
+	for i := range parts {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, nil, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxFramePartSize {
+			return nil, nil, fmt.Errorf("frame is too large: %v bytes", n)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(n)))
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint32(len(b)) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		parts[i] = b
+	}
+	msg, err := data.UnmarshalMsgpack(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, parts[1], nil
+}
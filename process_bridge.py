@@ -0,0 +1,292 @@
+"""The Python script run by the "process" backend of pymlstate.
+
+It reads requests from stdin and writes responses to stdout. Both are frames
+of a msgpack map followed by a binary attachment, each of which is prefixed by
+its size in uint32 big endian. Saved models are passed as attachments.
+
+The script has its own msgpack codec so that the backend doesn't require any
+Python package. It works with Python 2.7 and 3. process_bridge.go is
+generated from this file by "go generate".
+"""
+
+import importlib
+import os
+import struct
+import sys
+import tempfile
+import traceback
+
+PY2 = sys.version_info[0] == 2
+if PY2:
+    text_type = unicode  # noqa: F821
+    int_types = (int, long)  # noqa: F821
+else:
+    text_type = str
+    int_types = (int,)
+
+
+def _pack_len(n, fix, fix_max, codes, buf):
+    if n <= fix_max:
+        buf.append(struct.pack('B', fix | n))
+    elif n < 0x10000 and codes[0] is None:
+        buf.append(codes[1] + struct.pack('>H', n))
+    elif n < 0x100 and codes[0] is not None:
+        buf.append(codes[0] + struct.pack('B', n))
+    elif n < 0x10000:
+        buf.append(codes[1] + struct.pack('>H', n))
+    else:
+        buf.append(codes[2] + struct.pack('>I', n))
+
+
+def _pack(o, buf):
+    if o is None:
+        buf.append(b'\xc0')
+    elif o is True:
+        buf.append(b'\xc3')
+    elif o is False:
+        buf.append(b'\xc2')
+    elif isinstance(o, int_types):
+        if -0x8000000000000000 <= o < 0x8000000000000000:
+            buf.append(b'\xd3' + struct.pack('>q', o))
+        elif 0 <= o < 0x10000000000000000:
+            buf.append(b'\xcf' + struct.pack('>Q', o))
+        else:
+            raise ValueError('integer is out of range: %d' % o)
+    elif isinstance(o, float):
+        buf.append(b'\xcb' + struct.pack('>d', o))
+    elif isinstance(o, text_type) or (PY2 and isinstance(o, str)):
+        if not isinstance(o, text_type):
+            o = o.decode('utf-8')
+        b = o.encode('utf-8')
+        _pack_len(len(b), 0xa0, 31, (b'\xd9', b'\xda', b'\xdb'), buf)
+        buf.append(b)
+    elif isinstance(o, (bytes, bytearray)):
+        b = bytes(o)
+        if len(b) < 0x100:
+            buf.append(b'\xc4' + struct.pack('B', len(b)))
+        elif len(b) < 0x10000:
+            buf.append(b'\xc5' + struct.pack('>H', len(b)))
+        else:
+            buf.append(b'\xc6' + struct.pack('>I', len(b)))
+        buf.append(b)
+    elif isinstance(o, (list, tuple)):
+        _pack_len(len(o), 0x90, 15, (None, b'\xdc', b'\xdd'), buf)
+        for v in o:
+            _pack(v, buf)
+    elif isinstance(o, dict):
+        _pack_len(len(o), 0x80, 15, (None, b'\xde', b'\xdf'), buf)
+        for k, v in o.items():
+            _pack(k, buf)
+            _pack(v, buf)
+    elif hasattr(o, 'tolist'):
+        # numpy arrays and scalars
+        _pack(o.tolist(), buf)
+    else:
+        raise TypeError('cannot serialize %s' % type(o).__name__)
+
+
+def packb(o):
+    buf = []
+    _pack(o, buf)
+    return b''.join(buf)
+
+
+class _Reader(object):
+
+    def __init__(self, b):
+        self.b = b
+        self.i = 0
+
+    def read(self, n):
+        if self.i + n > len(self.b):
+            raise ValueError('msgpack data is truncated')
+        b = self.b[self.i:self.i + n]
+        self.i += n
+        return b
+
+    def unpack(self, fmt):
+        return struct.unpack(fmt, self.read(struct.calcsize(fmt)))[0]
+
+
+_FIXED = {
+    0xc0: lambda r: None,
+    0xc2: lambda r: False,
+    0xc3: lambda r: True,
+    0xca: lambda r: r.unpack('>f'),
+    0xcb: lambda r: r.unpack('>d'),
+    0xcc: lambda r: r.unpack('B'),
+    0xcd: lambda r: r.unpack('>H'),
+    0xce: lambda r: r.unpack('>I'),
+    0xcf: lambda r: r.unpack('>Q'),
+    0xd0: lambda r: r.unpack('b'),
+    0xd1: lambda r: r.unpack('>h'),
+    0xd2: lambda r: r.unpack('>i'),
+    0xd3: lambda r: r.unpack('>q'),
+}
+
+_LENGTHS = {
+    0xc4: 'B', 0xc5: '>H', 0xc6: '>I',  # bin
+    0xc7: 'B', 0xc8: '>H', 0xc9: '>I',  # ext
+    0xd9: 'B', 0xda: '>H', 0xdb: '>I',  # str
+    0xdc: '>H', 0xdd: '>I',  # array
+    0xde: '>H', 0xdf: '>I',  # map
+}
+
+_FIXEXT = {0xd4: 1, 0xd5: 2, 0xd6: 4, 0xd7: 8, 0xd8: 16}
+
+
+def _unpack(r):
+    c = bytearray(r.read(1))[0]
+    if c <= 0x7f:
+        return c
+    if c >= 0xe0:
+        return c - 0x100
+    if c in _FIXED:
+        return _FIXED[c](r)
+    if 0xa0 <= c <= 0xbf:
+        return r.read(c & 0x1f).decode('utf-8')
+    if 0x90 <= c <= 0x9f:
+        return [_unpack(r) for _ in range(c & 0x0f)]
+    if 0x80 <= c <= 0x8f:
+        return _unpack_map(r, c & 0x0f)
+    if c in _FIXEXT:
+        r.read(1)
+        return r.read(_FIXEXT[c])
+    if c in _LENGTHS:
+        n = r.unpack(_LENGTHS[c])
+        if c <= 0xc6:
+            return r.read(n)
+        if c <= 0xc9:
+            r.read(1)  # ext type
+            return r.read(n)
+        if c <= 0xdb:
+            return r.read(n).decode('utf-8')
+        if c <= 0xdd:
+            return [_unpack(r) for _ in range(n)]
+        return _unpack_map(r, n)
+    raise ValueError('unsupported msgpack type: 0x%02x' % c)
+
+
+def _unpack_map(r, n):
+    m = {}
+    for _ in range(n):
+        k = _unpack(r)
+        m[k] = _unpack(r)
+    return m
+
+
+def unpackb(b):
+    return _unpack(_Reader(b))
+
+
+def read_exactly(f, n):
+    chunks = []
+    while n > 0:
+        b = f.read(n)
+        if not b:
+            return None
+        chunks.append(b)
+        n -= len(b)
+    return b''.join(chunks)
+
+
+def read_part(f):
+    h = read_exactly(f, 4)
+    if h is None:
+        return None
+    n = struct.unpack('>I', h)[0]
+    if n == 0:
+        return b''
+    return read_exactly(f, n)
+
+
+def read_frame(f):
+    msg = read_part(f)
+    if msg is None:
+        return None, None
+    return unpackb(msg), read_part(f)
+
+
+def write_frame(f, msg, attachment=b''):
+    b = packb(msg)
+    f.write(struct.pack('>I', len(b)))
+    f.write(b)
+    f.write(struct.pack('>I', len(attachment)))
+    f.write(attachment)
+    f.flush()
+
+
+def kwargs_of(req):
+    kwargs = req.get('kwargs') or {}
+    return dict((str(k), v) for k, v in kwargs.items())
+
+
+def model_class(req):
+    path = req['module_path']
+    if path not in sys.path:
+        sys.path.insert(0, path)
+    module = importlib.import_module(req['module_name'])
+    return getattr(module, req['class_name'])
+
+
+class Bridge(object):
+
+    def __init__(self):
+        self.instance = None
+
+    def handle(self, req, attachment):
+        method = req['method']
+        if method == 'create':
+            self.instance = model_class(req).create(**kwargs_of(req))
+            return None, b''
+        if method == 'load':
+            fd, path = tempfile.mkstemp()
+            try:
+                with os.fdopen(fd, 'wb') as f:
+                    f.write(attachment)
+                self.instance = model_class(req).load(path, **kwargs_of(req))
+            finally:
+                os.remove(path)
+            return None, b''
+
+        if self.instance is None:
+            raise RuntimeError('the model is not created')
+        if method == 'save':
+            fd, path = tempfile.mkstemp()
+            try:
+                os.close(fd)
+                self.instance.save(path, **kwargs_of(req))
+                with open(path, 'rb') as f:
+                    return None, f.read()
+            finally:
+                os.remove(path)
+        if method == 'call':
+            f = getattr(self.instance, req['name'])
+            return f(*(req.get('args') or [])), b''
+        raise ValueError('unknown method: %s' % method)
+
+
+def main():
+    # stdout is reserved for responses, and outputs of the model go to stderr
+    out = os.fdopen(os.dup(1), 'wb')
+    os.dup2(2, 1)
+    if PY2:
+        inp = sys.stdin
+    else:
+        inp = sys.stdin.buffer
+
+    bridge = Bridge()
+    while True:
+        req, attachment = read_frame(inp)
+        if req is None:
+            return
+        try:
+            res, attachment = bridge.handle(req, attachment)
+            write_frame(out, {'result': res}, attachment)
+        except Exception as e:
+            sys.stderr.write(traceback.format_exc())
+            write_frame(out, {'error': '%s: %s' % (type(e).__name__, e)})
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,350 @@
+package pymlstate
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+var processTestBaseParams = &pystate.BaseParams{
+	ModulePath: "./",
+	ModuleName: "_test_pymlstate_process",
+	ClassName:  "ProcessTestClass",
+}
+
+func TestParseBackendParams(t *testing.T) {
+	Convey("Given parameters of the process backend", t, func() {
+		params := data.Map{
+			"backend":     data.String("process"),
+			"python_path": data.String("python3"),
+			"rpc_timeout": data.String("30s"),
+			"restart":     data.Bool(false),
+			"other":       data.Int(1),
+		}
+
+		Convey("When parse them", func() {
+			p := &MLParams{}
+			So(parseBackendParams(params, p, false), ShouldBeNil)
+
+			Convey("Then MLParams should have them", func() {
+				So(p.Backend, ShouldEqual, processBackend)
+				So(p.PythonPath, ShouldEqual, "python3")
+				So(p.RPCTimeout, ShouldEqual, 30*time.Second)
+				So(p.NoRestart, ShouldBeTrue)
+			})
+
+			Convey("Then they should be removed from parameters", func() {
+				So(params, ShouldResemble, data.Map{"other": data.Int(1)})
+			})
+		})
+
+		Convey("When parse them to load a state of the inprocess backend", func() {
+			err := parseBackendParams(params, &MLParams{}, true)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When parse them without the backend to load a state of the process backend", func() {
+			delete(params, "backend")
+			p := &MLParams{Backend: processBackend}
+			So(parseBackendParams(params, p, true), ShouldBeNil)
+
+			Convey("Then parameters of the process should be overridden", func() {
+				So(p.PythonPath, ShouldEqual, "python3")
+				So(p.RPCTimeout, ShouldEqual, 30*time.Second)
+			})
+		})
+	})
+
+	Convey("Given invalid parameters of the backend", t, func() {
+		cases := map[string]data.Map{
+			"unknown backend": data.Map{
+				"backend": data.String("remote"),
+			},
+			"python_path of the inprocess backend": data.Map{
+				"python_path": data.String("python3"),
+			},
+			"rpc_timeout of the inprocess backend": data.Map{
+				"backend":     data.String("inprocess"),
+				"rpc_timeout": data.Int(1),
+			},
+			"non-positive rpc_timeout": data.Map{
+				"backend":     data.String("process"),
+				"rpc_timeout": data.Int(0),
+			},
+			"non-bool restart": data.Map{
+				"backend": data.String("process"),
+				"restart": data.String("yes"),
+			},
+		}
+
+		for title, params := range cases {
+			Convey("When parse "+title, func() {
+				err := parseBackendParams(params, &MLParams{}, false)
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+	})
+}
+
+func TestProcessFrame(t *testing.T) {
+	Convey("Given a frame", t, func() {
+		buf := bytes.NewBuffer(nil)
+		So(writeFrame(buf, data.Map{"method": data.String("save")}, []byte("model")), ShouldBeNil)
+
+		Convey("When read it", func() {
+			msg, attachment, err := readFrame(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+
+			Convey("Then it should have the same message and attachment", func() {
+				So(msg, ShouldResemble, data.Map{"method": data.String("save")})
+				So(string(attachment), ShouldEqual, "model")
+			})
+		})
+
+		Convey("When read a truncated frame", func() {
+			_, _, err := readFrame(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+	})
+}
+
+func TestProcessBridge(t *testing.T) {
+	Convey("Given the script of the process backend", t, func() {
+		script, err := ioutil.ReadFile("process_bridge.py")
+		So(err, ShouldBeNil)
+
+		Convey("When compare it with the script built into the package", func() {
+			Convey("Then process_bridge.go should be generated from it", func() {
+				So(processBridge, ShouldEqual, string(script))
+			})
+		})
+
+		Convey("When run unit tests of it", func() {
+			out, err := exec.Command(defaultPythonPath, "-m", "unittest",
+				"_test_process_bridge").CombinedOutput()
+
+			Convey("Then they should pass", func() {
+				So(err, ShouldBeNil)
+				So(string(out), ShouldContainSubstring, "OK")
+			})
+		})
+	})
+}
+
+func TestProcessBackend(t *testing.T) {
+	Convey("Given a pymlstate running on the process backend", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:  1,
+			Backend:    processBackend,
+			RPCTimeout: time.Second,
+		}, data.Map{"name": data.String("p")})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When fit and predict", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+			So(err, ShouldBeNil)
+			res, err := s.Predict(ctx, data.Map{"a": data.Int(1)})
+			So(err, ShouldBeNil)
+
+			Convey("Then the model in the process should be called", func() {
+				So(res, ShouldResemble, data.Map{"a": data.Int(1)})
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+			})
+
+			Convey("Then create parameters should be passed to the model", func() {
+				v, err := s.base.Call("param", data.String("name"))
+				So(err, ShouldBeNil)
+				So(v, ShouldEqual, data.String("p"))
+			})
+		})
+
+		Convey("When the model raises an error", func() {
+			_, err := s.base.Call("fail")
+
+			Convey("Then it should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "ValueError: failed")
+			})
+
+			Convey("Then the process should keep running", func() {
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the process crashes after the model is saved", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+			So(err, ShouldBeNil)
+			So(s.Save(ctx, bytes.NewBuffer(nil), data.Map{}), ShouldBeNil)
+			_, err = s.base.Call("crash")
+			So(err, ShouldNotBeNil)
+
+			Convey("Then the process should be restarted with the saved model", func() {
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+			})
+
+			Convey("Then the restart should be reported by Health", func() {
+				h, err := s.Health(ctx)
+				So(err, ShouldBeNil)
+				So(h["restarts"], ShouldEqual, data.Int(0))
+				_, err = s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+				h, err = s.Health(ctx)
+				So(err, ShouldBeNil)
+				So(h["restarts"], ShouldEqual, data.Int(1))
+			})
+		})
+
+		Convey("When a call times out", func() {
+			start := time.Now()
+			_, err := s.base.Call("sleep", data.Int(10))
+
+			Convey("Then it should fail after the timeout", func() {
+				So(err, ShouldNotBeNil)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			})
+
+			Convey("Then the process should be restarted", func() {
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When save and load the state", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+			So(err, ShouldBeNil)
+			buf := bytes.NewBuffer(nil)
+			So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			s2 := &State{}
+			So(s2.load(ctx, buf, data.Map{}), ShouldBeNil)
+			Reset(func() {
+				s2.Terminate(ctx)
+			})
+
+			Convey("Then the loaded state should run on the process backend", func() {
+				So(s2.params.Backend, ShouldEqual, processBackend)
+				So(s2.params.RPCTimeout, ShouldEqual, time.Second)
+				n, err := s2.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+			})
+		})
+
+		Convey("When terminate the state", func() {
+			So(s.Terminate(ctx), ShouldBeNil)
+
+			Convey("Then it should not be called", func() {
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a pymlstate on the process backend without restart", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+			NoRestart: true,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When rpc_timeout isn't given", func() {
+			m := s.base.(*processModel)
+
+			Convey("Then calls should have no timeout", func() {
+				So(m.timeout, ShouldEqual, 0)
+				_, err := s.base.Call("sleep", data.Float(0.1))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the process crashes", func() {
+			_, err := s.base.Call("crash")
+			So(err, ShouldNotBeNil)
+
+			Convey("Then the following calls should fail", func() {
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "restart is disabled")
+				h, err := s.Health(ctx)
+				So(err, ShouldBeNil)
+				So(h["restarts"], ShouldEqual, data.Int(0))
+			})
+		})
+	})
+
+	Convey("Given a pymlstate on the process backend whose create requires arguments", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(&pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate_process",
+			ClassName:  "RequiredArgsTestClass",
+		}, &MLParams{
+			BatchSize: 1,
+			Backend:   processBackend,
+		}, data.Map{"name": data.String("saved")})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When save and load the state", func() {
+			buf := bytes.NewBuffer(nil)
+			So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			s2 := &State{}
+			err := s2.load(ctx, buf, data.Map{})
+			Reset(func() {
+				s2.Terminate(ctx)
+			})
+
+			Convey("Then it should load the model without creating a new one", func() {
+				So(err, ShouldBeNil)
+				res, err := s2.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+				So(res, ShouldEqual, data.String("saved"))
+			})
+		})
+	})
+
+	Convey("Given a python interpreter which doesn't exist", t, func() {
+		Convey("When create a pymlstate on the process backend", func() {
+			_, err := New(processTestBaseParams, &MLParams{
+				BatchSize:  1,
+				Backend:    processBackend,
+				PythonPath: "/nonexistent/python",
+			}, data.Map{})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,15 +1,21 @@
 package pymlstate
 
 import (
-	"encoding/binary"
-	"errors"
+	"bytes"
 	"fmt"
 	"github.com/ugorji/go/codec"
 	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/pymlstate.v0/archive"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
 	"gopkg.in/sensorbee/sensorbee.v0/core"
 	"gopkg.in/sensorbee/sensorbee.v0/data"
 	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -20,10 +26,43 @@ var (
 // The python instance and this struct must not be coppied directly by assignment
 // statement because it doesn't increase reference count of instance.
 type State struct {
-	base   *pystate.Base
+	// trained is the number of trainings, which is accessed atomically. It's
+	// the first field to be aligned on 32-bit platforms.
+	trained uint64
+
+	// unhealthy is 1 when a call to "fit" or "predict" timed out and no call
+	// has succeeded since then. It's accessed atomically.
+	unhealthy uint32
+	// abandoned has calls which timed out and are still running.
+	abandoned abandonedCalls
+
+	base   model
 	params MLParams
 	bucket []data.Value
+	policy bucketPolicy
 	rwm    sync.RWMutex
+
+	// replicas are model instances used by Predict in addition to base. They
+	// have copies of the model of base.
+	replicas   []model
+	nextWorker uint32
+	// syncing is 1 while replicas are synced, and it's accessed atomically.
+	syncing uint32
+	// synced is the number of trainings when replicas are synced last. It's
+	// protected by syncing or the write lock.
+	synced uint64
+
+	cpMu         sync.Mutex
+	checkpointer *checkpointer
+
+	// loaded is true when the model is loaded instead of created.
+	loaded       bool
+	healthMu     sync.Mutex
+	fitStats     callStats
+	predictStats callStats
+	lastPredict  time.Time
+
+	breaker circuitBreaker
 }
 
 // MLParams is parameters pymlstate defines in addition to those pystate does.
@@ -34,11 +73,134 @@ type MLParams struct {
 	// tuples without training until it has tuples as many as batch_train_size.
 	// This is an optional parameter and its default value is 10.
 	BatchSize int `codec:"batch_train_size"`
+
+	// BucketPolicy decides which tuples written by Write are used for
+	// training. "batch" fills the bucket with batch_train_size tuples, calls
+	// "fit", and then flushes it. "sliding_window" keeps the last
+	// batch_train_size tuples and calls "fit" every train_interval tuples.
+	// "reservoir" keeps a uniform sample of batch_train_size tuples from all
+	// tuples written so far and calls "fit" every train_interval tuples.
+	// This is an optional parameter and its default value is "batch".
+	BucketPolicy string `codec:"bucket_policy,omitempty"`
+
+	// TrainInterval is the number of tuples written between two trainings of
+	// "sliding_window" and "reservoir" policies. This is an optional
+	// parameter and its default value is batch_train_size.
+	TrainInterval int `codec:"train_interval,omitempty"`
+
+	// LabelPath is a path to the label of a tuple used by the "stratified"
+	// bucket policy. The policy classifies tuples by their labels and calls
+	// "fit" every batch_train_size tuples. This parameter is required when
+	// bucket_policy is "stratified".
+	LabelPath string `codec:"label_path,omitempty"`
+
+	// MaxPerClass is the maximum number of tuples of a class kept in the
+	// bucket of the "stratified" policy. When a class is full, a new tuple
+	// replaces a random tuple of the class. This is an optional parameter and
+	// the number is unlimited by default.
+	MaxPerClass int `codec:"max_per_class,omitempty"`
+
+	// Oversample makes the "stratified" policy repeat tuples of minority
+	// classes up to the number of tuples of the largest class when "fit" is
+	// called. This is an optional parameter and its default value is false.
+	Oversample bool `codec:"oversample,omitempty"`
+
+	// Preprocess transforms data.Map inputs before they're passed to "fit"
+	// and "predict" methods of Python. Its fitted statistics are saved with
+	// other MLParams. See NewPreprocessor for the format of the "preprocess"
+	// parameter. This is an optional parameter.
+	Preprocess *Preprocessor `codec:"preprocess,omitempty"`
+
+	// Workers is the number of model instances used by "predict". Instances
+	// other than the primary one, which is trained by "fit", are replicas
+	// loaded from the payload of the primary model, and predictions are
+	// distributed to all instances in round-robin order. Replicas run in
+	// their own processes, so workers greater than 1 can only be used with
+	// the "process" backend. This is an optional parameter and its default
+	// value is 1.
+	Workers int `codec:"workers,omitempty"`
+
+	// WorkerSyncInterval is the number of trainings of the primary model
+	// between two syncs of replicas. Replicas are synced by saving the
+	// primary model and loading it, which is done by the first prediction
+	// on a replica after the interval. This is an optional parameter and its
+	// default value is 10.
+	WorkerSyncInterval int `codec:"worker_sync_interval,omitempty"`
+
+	// PredictTimeout is the maximum duration of a call to "predict". When the
+	// call doesn't return in time, Predict returns an error and the state is
+	// marked unhealthy. The call is aborted on the "process" backend, and
+	// following calls to the model fail immediately until the call returns.
+	// This is an optional parameter and calls don't time out by default.
+	PredictTimeout time.Duration `codec:"predict_timeout,omitempty"`
+
+	// FitTimeout is the maximum duration of a call to "fit" or "score" like
+	// PredictTimeout. This is an optional parameter and calls don't time out
+	// by default.
+	FitTimeout time.Duration `codec:"fit_timeout,omitempty"`
+
+	// BreakerThreshold is the number of consecutive failures of "predict"
+	// which opens the circuit breaker of Predict. Predict returns
+	// BreakerFallback or an error without calling Python while the breaker
+	// is open. This is an optional parameter and the breaker is disabled by
+	// default.
+	BreakerThreshold int `codec:"breaker_threshold,omitempty"`
+
+	// BreakerCooldown is the duration the circuit breaker stays open before
+	// it lets a prediction through. This is an optional parameter and its
+	// default value is 30 seconds.
+	BreakerCooldown time.Duration `codec:"breaker_cooldown,omitempty"`
+
+	// BreakerFallback is a value returned by Predict while the circuit
+	// breaker is open, which is encoded in msgpack. It's annotated in the
+	// same way as PredictFallback. This is an optional parameter, see
+	// parseBreakerParams for how it's used with PredictFallback.
+	BreakerFallback []byte `codec:"breaker_fallback,omitempty"`
+
+	// PredictFallback is used by Predict when the prediction fails, which is
+	// encoded in msgpack. It's a value returned instead of the prediction, or
+	// the name of another state which predicts instead when
+	// PredictFallbackType is "state". The fallback prediction is annotated so
+	// that it can be told apart. See parseBreakerParams for its use while the
+	// circuit breaker is open. This is an optional parameter and Predict
+	// returns an error by default.
+	PredictFallback []byte `codec:"predict_fallback,omitempty"`
+
+	// PredictFallbackType is the type of PredictFallback, "value" or "state".
+	// This is an optional parameter and its default value is "value".
+	PredictFallbackType string `codec:"predict_fallback_type,omitempty"`
+
+	// Backend decides where the Python model runs. "inprocess" runs it in
+	// the process of SensorBee. "process" runs it in a child process, which
+	// is restarted when it crashes. The backend cannot be changed once the
+	// state is created. This is an optional parameter and its default value
+	// is "inprocess".
+	Backend string `codec:"backend,omitempty"`
+
+	// PythonPath is the Python interpreter run by the "process" backend. This
+	// is an optional parameter and its default value is "python".
+	PythonPath string `codec:"python_path,omitempty"`
+
+	// RPCTimeout is the timeout of a call to the "process" backend. The
+	// process is killed when it doesn't respond in time. It also applies to
+	// fit and save. This is an optional parameter and there's no timeout by
+	// default.
+	RPCTimeout time.Duration `codec:"rpc_timeout,omitempty"`
+
+	// NoRestart disables restarts of the "process" backend after it crashes
+	// or times out. It's given as "restart" parameter, whose default value
+	// is true.
+	NoRestart bool `codec:"no_restart,omitempty"`
 }
 
 // New creates `core.SharedState` for multiple layer classification.
 func New(baseParams *pystate.BaseParams, mlParams *MLParams, params data.Map) (*State, error) {
-	b, err := pystate.NewBase(baseParams, params)
+	policy, err := newBucketPolicy(mlParams)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := newModel(baseParams, mlParams, params)
 	if err != nil {
 		return nil, err
 	}
@@ -47,14 +209,19 @@ func New(baseParams *pystate.BaseParams, mlParams *MLParams, params data.Map) (*
 		base:   b,
 		params: *mlParams,
 		bucket: make([]data.Value, 0, mlParams.BatchSize),
+		policy: policy,
 	}
 	return s, nil
 }
 
 // Terminate terminates this state.
 func (s *State) Terminate(ctx *core.Context) error {
+	// the checkpointer must be stopped before the lock is acquired because
+	// it acquires the read lock
+	s.stopCheckpointer()
 	s.rwm.Lock()
 	defer s.rwm.Unlock()
+	s.terminateReplicas(ctx)
 	if err := s.base.Terminate(ctx); err != nil {
 		return err
 	}
@@ -63,8 +230,9 @@ func (s *State) Terminate(ctx *core.Context) error {
 	return nil
 }
 
-// Write stores a tuple to its bucket and calls "fit" function every
-// "batch_train_size" times.
+// Write stores a tuple to its bucket and calls "fit" function when the bucket
+// policy decides to train the model, which is every "batch_train_size" times
+// by default.
 func (s *State) Write(ctx *core.Context, t *core.Tuple) error {
 	s.rwm.Lock()
 	defer s.rwm.Unlock()
@@ -77,38 +245,81 @@ func (s *State) Write(ctx *core.Context, t *core.Tuple) error {
 		return err
 	}
 
-	if s.params.BatchSize > 1 {
-		s.bucket = append(s.bucket, dataSet)
-		if len(s.bucket) < s.params.BatchSize {
-			return nil
-		}
-	} else {
-		if dataSet.Type() == data.TypeArray {
-			arr, _ := data.AsArray(dataSet)
-			s.bucket = arr
-		} else {
-			s.bucket = []data.Value{dataSet}
-		}
+	var ready bool
+	if s.bucket, ready, err = s.policy.store(s.bucket, dataSet); err != nil {
+		return err
+	} else if !ready {
+		return nil
 	}
 
-	_, err = s.fit(ctx, s.bucket)
+	return s.trainBucket(ctx, "pymlstate's training via Write (INSERT INTO) failed")
+}
+
+// trainBucket trains the model with the bucket, and then keeps tuples which
+// the bucket policy decides to keep. msg is logged when the training fails.
+// The state must be locked.
+func (s *State) trainBucket(ctx *core.Context, msg string) error {
+	// statistics of preprocess are fitted only with tuples which the model
+	// hasn't been trained with, so neither oversampled tuples nor tuples kept
+	// across trainings are counted twice. The sample is a subset of the
+	// batch, so they're the same when they have the same length.
+	batch := s.policy.batch(s.bucket)
+	sample := s.policy.sample(s.bucket)
+	if len(sample) == len(batch) {
+		sample = nil
+	}
+	_, err := s.fit(ctx, batch, sample)
 	prevBucketSize := len(s.bucket)
-	s.bucket = s.bucket[:0] // clear slice but keep capacity
+	prevStats := s.policy.stats()
+	s.bucket = s.policy.trained(s.bucket)
 	if err != nil {
-		ctx.ErrLog(err).WithField("bucket_size", prevBucketSize).
-			Error("pymlstate's training via Write (INSERT INTO) failed")
+		l := ctx.ErrLog(err).WithField("bucket_size", prevBucketSize)
+		if prevStats != nil {
+			l = l.WithField("bucket_stats", prevStats)
+		}
+		l.Error(msg)
 		return err
 	}
-
 	return nil
 }
 
+// restoreBucket stores tuples of old to the bucket again after the bucket
+// policy is replaced, e.g. by LOAD STATE or SetParams. When the policy gets
+// ready to train with the tuples, the model is trained in the same way as
+// Write so that buffered tuples aren't dropped. Tuples which the new policy
+// cannot store are dropped with a warning. It returns the first error of the
+// trainings. The state must be locked.
+func (s *State) restoreBucket(ctx *core.Context, old []data.Value) error {
+	s.bucket = make([]data.Value, 0, s.params.BatchSize)
+	var fitErr error
+	dropped := 0
+	for _, v := range old {
+		var ready bool
+		var err error
+		if s.bucket, ready, err = s.policy.store(s.bucket, v); err != nil {
+			dropped++
+			continue
+		} else if !ready {
+			continue
+		}
+		err = s.trainBucket(ctx, "pymlstate's training with the restored bucket failed")
+		if err != nil && fitErr == nil {
+			fitErr = err
+		}
+	}
+	if dropped > 0 {
+		ctx.Log().WithField("dropped", dropped).
+			Warn("pymlstate dropped tuples which the new bucket policy cannot store")
+	}
+	return fitErr
+}
+
 // Fit receives `data.Array` type but it assumes `[]data.Map` type
 // for passing arguments to `fit` method.
 func (s *State) Fit(ctx *core.Context, bucket []data.Value) (data.Value, error) {
 	s.rwm.RLock()
 	defer s.rwm.RUnlock()
-	return s.fit(ctx, bucket)
+	return s.fit(ctx, bucket, nil)
 }
 
 // fit is the internal implementation of Fit. fit doesn't acquire the lock nor
@@ -116,73 +327,267 @@ func (s *State) Fit(ctx *core.Context, bucket []data.Value) (data.Value, error)
 // this method itself doesn't change any field of State. Although the model
 // will be updated by the data, the model is protected by Python's GIL. So,
 // this method doesn't require a write lock.
-func (s *State) fit(ctx *core.Context, bucket []data.Value) (data.Value, error) {
-	return s.base.Call("fit", data.Array(bucket))
+//
+// Statistics of preprocess are fitted with sample, or bucket when sample is
+// nil, and they're updated only when "fit" succeeds.
+func (s *State) fit(ctx *core.Context, bucket, sample []data.Value) (data.Value, error) {
+	var pf *PreprocessFit
+	if p := s.params.Preprocess; p != nil {
+		var err error
+		if bucket, pf, err = p.FitTransform(bucket, sample); err != nil {
+			return nil, err
+		}
+	}
+	res, err := s.call(ctx, s.base, s.params.FitTimeout, "fit", data.Array(bucket))
+	if err != nil {
+		return nil, err
+	}
+	if pf != nil {
+		if err := s.params.Preprocess.Commit(pf); err != nil {
+			return nil, err
+		}
+	}
+	// replicas are synced by the next prediction, see syncWorkers
+	atomic.AddUint64(&s.trained, 1)
+	return res, nil
 }
 
 // Predict applies the model to the data. It returns a result returned from
-// Python script.
+// Python script. Predictions are distributed to replicas when the state has
+// multiple workers. Python isn't called while the circuit breaker is open, see
+// parseBreakerParams for details. When the prediction fails, Predict returns
+// the fallback prediction if predict_fallback is given, see parsePredictFallback
+// for details.
 func (s *State) Predict(ctx *core.Context, dt data.Value) (data.Value, error) {
+	res, err := s.predict(ctx, dt)
+	if err != nil {
+		return s.fallback(ctx, dt, err)
+	}
+	return res, nil
+}
+
+// predict is Predict without the fallback prediction.
+func (s *State) predict(ctx *core.Context, dt data.Value) (data.Value, error) {
 	s.rwm.RLock()
 	defer s.rwm.RUnlock()
-	return s.base.Call("predict", dt)
+	if p := s.params.Preprocess; p != nil {
+		var err error
+		if dt, err = p.Transform(dt); err != nil {
+			return nil, err
+		}
+	}
+	if !s.breaker.allow(ctx, &s.params) {
+		return s.rejectPrediction(ctx)
+	}
+	res, err := s.call(ctx, s.predictor(ctx), s.params.PredictTimeout, "predict", dt)
+	s.breaker.done(ctx, &s.params, err)
+	return res, err
 }
 
-// Save saves the model of the state. pystate calls `save` method and
-// use its return value as dumped model.
-func (s *State) Save(ctx *core.Context, w io.Writer, params data.Map) error {
+// Score evaluates the model with the bucket without training it. It calls
+// "score" method of Python with `[]data.Map` type argument like Fit, and the
+// call times out after fit_timeout.
+func (s *State) Score(ctx *core.Context, bucket []data.Value) (data.Value, error) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	if err := s.base.CheckTermination(); err != nil {
+		return nil, err
+	}
+	if p := s.params.Preprocess; p != nil {
+		transformed := make([]data.Value, len(bucket))
+		for i, v := range bucket {
+			var err error
+			if transformed[i], err = p.Transform(v); err != nil {
+				return nil, err
+			}
+		}
+		bucket = transformed
+	}
+	return s.call(ctx, s.base, s.params.FitTimeout, "score", data.Array(bucket))
+}
+
+// BucketStats returns statistics of the bucket. See BucketStats function for
+// details.
+func (s *State) BucketStats(ctx *core.Context) (data.Map, error) {
 	s.rwm.RLock()
 	defer s.rwm.RUnlock()
 	if err := s.base.CheckTermination(); err != nil {
+		return nil, err
+	}
+
+	policy := s.params.BucketPolicy
+	if policy == "" {
+		policy = batchPolicy
+	}
+	m := data.Map{
+		"bucket_policy":    data.String(policy),
+		"bucket_size":      data.Int(len(s.bucket)),
+		"batch_train_size": data.Int(s.params.BatchSize),
+	}
+	for k, v := range s.policy.stats() {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// SetParams updates MLParams of the state with parameters given in params.
+// Parameters are parsed and validated in the same way as CREATE STATE, and
+// the state isn't modified when any of them is invalid. Tuples in the bucket
+// are stored again with the updated bucket policy, and the model is trained
+// when the policy gets ready to train as Write does, e.g. when the bucket has
+// more tuples than the new batch_train_size. Replicas are created or
+// terminated when workers is changed. preprocess replaces the Preprocessor
+// and discards its fitted statistics, so they're fitted again from the next
+// training, and predictions using them fail until then. Updated parameters
+// are saved by the next SAVE STATE.
+func (s *State) SetParams(ctx *core.Context, params data.Map) error {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	if err := s.base.CheckTermination(); err != nil {
+		return err
+	}
+
+	params = params.Copy()
+	mp := s.params
+	if err := parseMLParams(params, &mp); err != nil {
 		return err
 	}
+	if err := mp.checkWorkers(); err != nil {
+		return err
+	}
+	if len(params) > 0 {
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("unsupported parameters: %v", strings.Join(keys, ", "))
+	}
+
+	policy, err := newBucketPolicy(&mp)
+	if err != nil {
+		return err
+	}
+	// the bucket is stored to another policy first so that the state isn't
+	// modified when the new policy cannot store it
+	scratch, err := newBucketPolicy(&mp)
+	if err != nil {
+		return err
+	}
+	var bucket []data.Value
+	for _, v := range s.bucket {
+		if bucket, _, err = scratch.store(bucket, v); err != nil {
+			return fmt.Errorf("cannot store the bucket with new parameters: %v", err)
+		}
+	}
+
+	if mp.numWorkers() != s.params.numWorkers() {
+		prev := s.params
+		s.params = mp
+		if err := s.resizeWorkers(ctx); err != nil {
+			s.params = prev
+			return err
+		}
+	}
+
+	s.params = mp
+	s.policy = policy
+	if err := s.restoreBucket(ctx, s.bucket); err != nil {
+		return fmt.Errorf("parameters are updated but the training with the bucket failed: %v", err)
+	}
+	return nil
+}
 
-	if err := s.saveState(w); err != nil {
+// Save saves the model of the state. pystate calls `save` method and
+// use its return value as dumped model. The saved state is compressed by gzip
+// when params has compression="gzip", and encrypted by AES-GCM when params
+// has encryption_key_file.
+func (s *State) Save(ctx *core.Context, w io.Writer, params data.Map) error {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	if err := s.base.CheckTermination(); err != nil {
 		return err
 	}
-	return s.base.Save(ctx, w, params)
+	return s.saveState(ctx, w, params)
 }
 
 const (
-	pyMLStateFormatVersion uint8 = 1
+	// pyMLStateFormatVersion is the version of the format before containers.
+	// States saved in the format can still be loaded.
+	pyMLStateFormatVersion = archive.LegacyFormatVersion
+
+	paramsSection = archive.ParamsSection
+	modelSection  = archive.ModelSection
 )
 
-func (s *State) saveState(w io.Writer) error {
-	if _, err := w.Write([]byte{pyMLStateFormatVersion}); err != nil {
+// saveState saves MLParams and the model of Python in a container. The
+// container is compressed or encrypted as params specifies.
+func (s *State) saveState(ctx *core.Context, w io.Writer, params data.Map) error {
+	opts, params, err := saveOptions(params)
+	if err != nil {
 		return err
 	}
 
-	// Save parameter of State before save python's model
+	out, err := s.encodeParams()
+	if err != nil {
+		return err
+	}
+
+	model := bytes.NewBuffer(nil)
+	if err := s.base.Save(ctx, model, params); err != nil {
+		return err
+	}
+
+	return container.Write(w, []container.Section{
+		{Name: paramsSection, Data: out},
+		{Name: modelSection, Data: model.Bytes()},
+	}, opts)
+}
+
+func (s *State) encodeParams() ([]byte, error) {
+	if p := s.params.Preprocess; p != nil {
+		// statistics can be updated by fit called with the read lock
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+	}
 	msgpackHandle := &codec.MsgpackHandle{}
 	var out []byte
 	enc := codec.NewEncoderBytes(&out, msgpackHandle)
 	if err := enc.Encode(&s.params); err != nil {
-		return err
+		return nil, err
 	}
+	return out, nil
+}
 
-	// Write size of MLParams
-	dataSize := uint32(len(out))
-	err := binary.Write(w, binary.LittleEndian, dataSize)
+// Load loads the model of the state. pystate calls `load` method and
+// pass to the model data by using method parameter. encryption_key_file is
+// required in params to load an encrypted state. Parameters of MLParams in
+// params override saved ones. Checkpoints are restarted when params has
+// parameters of checkpoints.
+func (s *State) Load(ctx *core.Context, r io.Reader, params data.Map) error {
+	params = params.Copy()
+	cc, err := parseCheckpointConfig(params)
 	if err != nil {
 		return err
 	}
+	prev := s.checkpointing()
+	if cc != nil {
+		s.stopCheckpointer()
+	}
 
-	// Write MLParams in msgpack
-	n, err := w.Write(out)
-	if err != nil {
+	if err := s.loadLocked(ctx, r, params); err != nil {
+		if cc != nil && prev != nil {
+			s.startCheckpointer(ctx, prev)
+		}
 		return err
 	}
-
-	if n < len(out) {
-		return errors.New("cannot save the MLParams data")
+	if cc != nil {
+		return s.startCheckpointer(ctx, cc)
 	}
-
 	return nil
 }
 
-// Load loads the model of the state. pystate calls `load` method and
-// pass to the model data by using method parameter.
-func (s *State) Load(ctx *core.Context, r io.Reader, params data.Map) error {
+func (s *State) loadLocked(ctx *core.Context, r io.Reader, params data.Map) error {
 	s.rwm.Lock()
 	defer s.rwm.Unlock()
 	if err := s.base.CheckTermination(); err != nil {
@@ -192,60 +597,83 @@ func (s *State) Load(ctx *core.Context, r io.Reader, params data.Map) error {
 }
 
 func (s *State) load(ctx *core.Context, r io.Reader, params data.Map) error {
-	var formatVersion uint8
-	if err := binary.Read(r, binary.LittleEndian, &formatVersion); err != nil {
+	key, params, err := loadKey(params)
+	if err != nil {
 		return err
 	}
-
-	// TODO: remove MLParams specific parameters from params
-
-	switch formatVersion {
-	case 1:
-		return s.loadMLParamsAndDataV1(ctx, r, params)
-	default:
-		return fmt.Errorf("unsupported format version of State container: %v", formatVersion)
+	// the format is parsed by archive so that the runtime and tools of
+	// pymlstate read states in the same way
+	a, err := archive.Read(r, key)
+	if err != nil {
+		return err
 	}
+	return s.loadMLParamsAndModel(ctx, a.Params, bytes.NewReader(a.Model), params)
 }
 
-func (s *State) loadMLParamsAndDataV1(ctx *core.Context, r io.Reader, params data.Map) error {
-	var dataSize uint32
-	if err := binary.Read(r, binary.LittleEndian, &dataSize); err != nil {
+func (s *State) loadMLParamsAndModel(ctx *core.Context, paramsData []byte,
+	model io.Reader, params data.Map) error {
+	// Desirialize MLParams
+	var saved MLParams
+	msgpackHandle := &codec.MsgpackHandle{}
+	dec := codec.NewDecoderBytes(paramsData, msgpackHandle)
+	if err := dec.Decode(&saved); err != nil {
+		return err
+	}
+	if saved.Preprocess != nil {
+		if err := saved.Preprocess.compile(); err != nil {
+			return err
+		}
+	}
+	// parameters given by LOAD STATE override saved ones
+	if err := parseMLParams(params, &saved); err != nil {
 		return err
 	}
-	if dataSize == 0 {
-		return errors.New("size of MLParams must be greater than 0")
+	if err := parseBackendParams(params, &saved, true); err != nil {
+		return err
 	}
-
-	// Read MLParams from reader
-	buf := make([]byte, dataSize)
-	n, err := r.Read(buf)
+	if s.base != nil && s.params.backendOf() != saved.backendOf() {
+		return fmt.Errorf("cannot load a state of %v backend to a state of %v backend",
+			saved.backendOf(), s.params.backendOf())
+	}
+	policy, err := newBucketPolicy(&saved)
 	if err != nil {
 		return err
 	}
-	if n != int(dataSize) {
-		return errors.New("read size is different from the size of MLParams")
-	}
 
-	// Desirialize MLParams
-	var saved MLParams
-	msgpackHandle := &codec.MsgpackHandle{}
-	dec := codec.NewDecoderBytes(buf, msgpackHandle)
-	if err := dec.Decode(&saved); err != nil {
-		return err
+	// replicas are loaded from the same payload as the primary model
+	var payload []byte
+	if saved.numWorkers() > 1 || len(s.replicas) > 0 {
+		if payload, err = ioutil.ReadAll(model); err != nil {
+			return err
+		}
+		model = bytes.NewReader(payload)
 	}
 
 	if s.base == nil { // loading for the first time
-		s.base, err = pystate.LoadBase(ctx, r, params)
+		s.base, err = loadModel(ctx, &saved, model, params)
 		if err != nil {
 			return err
 		}
 
 	} else {
-		if err := s.base.Load(ctx, r, params); err != nil {
+		if err := s.base.Load(ctx, model, params); err != nil {
 			return err
 		}
 	}
 	s.params = saved
+	s.policy = policy
+	s.loaded = true
+	if err := s.loadReplicas(ctx, payload, params); err != nil {
+		return err
+	}
+	// the timeout and failures happened to the model which is replaced now
+	atomic.StoreUint32(&s.unhealthy, 0)
+	s.breaker.reset(ctx)
+
+	// tuples written before LOAD STATE are kept with the new bucket policy,
+	// and the loaded model isn't replaced even if the training with them
+	// fails, which is logged by restoreBucket
+	s.restoreBucket(ctx, s.bucket)
 	return nil
 }
 
@@ -272,16 +700,62 @@ func Predict(ctx *core.Context, stateName string, dt data.Value) (data.Value, er
 	return s.Predict(ctx, dt)
 }
 
+// Score evaluates the model with the given data, which is usually a
+// validation set, without training the model. The return value is typically
+// a loss, but its format depends on each Python UDS.
+func Score(ctx *core.Context, stateName string, bucket []data.Value) (data.Value, error) {
+	s, err := lookupState(ctx, stateName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Score(ctx, bucket)
+}
+
 // Flush pymlstate bucket. A return value is always nil.
 func Flush(ctx *core.Context, stateName string) (data.Value, error) {
 	s, err := lookupState(ctx, stateName)
 	if err != nil {
 		return nil, err
 	}
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
 	s.bucket = s.bucket[:0]
+	if s.policy != nil {
+		s.policy.reset()
+	}
+	return nil, nil
+}
+
+// SetParams updates parameters of the state at runtime. params can have
+// batch_train_size, bucket_policy, train_interval, label_path, max_per_class,
+// oversample, preprocess, workers, worker_sync_interval, predict_timeout,
+// fit_timeout, breaker_threshold, breaker_cooldown, breaker_fallback,
+// predict_fallback, and predict_fallback_type. See State.SetParams for
+// details. A return value is always nil.
+func SetParams(ctx *core.Context, stateName string, params data.Map) (data.Value, error) {
+	s, err := lookupState(ctx, stateName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetParams(ctx, params); err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
+// BucketStats returns statistics of the bucket of the state. It has
+// "bucket_policy", "bucket_size", and "batch_train_size". It also has
+// "class_counts" and "seen_class_counts" when the bucket policy is
+// "stratified".
+func BucketStats(ctx *core.Context, stateName string) (data.Value, error) {
+	s, err := lookupState(ctx, stateName)
+	if err != nil {
+		return nil, err
+	}
+	return s.BucketStats(ctx)
+}
+
 func lookupState(ctx *core.Context, stateName string) (*State, error) {
 	st, err := ctx.SharedStates.Get(stateName)
 	if err != nil {
@@ -1,7 +1,9 @@
 package pymlstate
 
 import (
+	"bytes"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ugorji/go/codec"
 	"gopkg.in/sensorbee/py.v0/pystate"
 	"gopkg.in/sensorbee/sensorbee.v0/core"
 	"gopkg.in/sensorbee/sensorbee.v0/data"
@@ -44,6 +46,14 @@ func TestPyMLStateFitAndPredict(t *testing.T) {
 						So(ac2, ShouldEqual, "predict called")
 					})
 				})
+
+				Convey("And when call score", func() {
+					ac3, err := Score(ctx, "pystate_test", bu)
+					So(err, ShouldBeNil)
+					Convey("Then score function should be called", func() {
+						So(ac3, ShouldEqual, 0.5)
+					})
+				})
 			})
 		})
 	})
@@ -125,3 +135,252 @@ func TestPyMLStateFlush(t *testing.T) {
 		})
 	})
 }
+
+func TestPyMLStateSetParams(t *testing.T) {
+	Convey("Given a pymlstate with a sliding window bucket", t, func() {
+		cc := &core.ContextConfig{}
+		ctx := core.NewContext(cc)
+		baseParams := &pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "TestClass",
+		}
+		mlParams := &MLParams{
+			BatchSize:     5,
+			BucketPolicy:  "sliding_window",
+			TrainInterval: 10,
+		}
+
+		s, err := New(baseParams, mlParams, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		err = ctx.SharedStates.Add("pystate_test", "py", s)
+		So(err, ShouldBeNil)
+		for i := 0; i < 5; i++ {
+			tu := &core.Tuple{
+				Data: data.Map{
+					"data": data.Int(i),
+				},
+			}
+			So(s.Write(ctx, tu), ShouldBeNil)
+		}
+
+		Convey("When set a smaller batch_train_size", func() {
+			ac, err := SetParams(ctx, "pystate_test", data.Map{
+				"batch_train_size": data.Int(3),
+			})
+			So(err, ShouldBeNil)
+			So(ac, ShouldBeNil)
+
+			Convey("Then the bucket should keep the last tuples", func() {
+				So(s.params.BatchSize, ShouldEqual, 3)
+				So(s.params.TrainInterval, ShouldEqual, 10)
+				So(s.bucket, ShouldResemble, []data.Value{
+					data.Int(2), data.Int(3), data.Int(4),
+				})
+			})
+
+			Convey("Then the new parameters should be saved", func() {
+				out, err := s.encodeParams()
+				So(err, ShouldBeNil)
+				var saved MLParams
+				dec := codec.NewDecoderBytes(out, &codec.MsgpackHandle{})
+				So(dec.Decode(&saved), ShouldBeNil)
+				So(saved.BatchSize, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When set invalid parameters", func() {
+			cases := map[string]data.Map{
+				"non-positive batch_train_size": data.Map{"batch_train_size": data.Int(0)},
+				"train_interval with batch": data.Map{
+					"bucket_policy":  data.String("batch"),
+					"train_interval": data.Int(2),
+				},
+				"unsupported parameter": data.Map{
+					"batch_train_size": data.Int(3),
+					"unknown":          data.Int(1),
+				},
+				"stratified without labels in the bucket": data.Map{
+					"bucket_policy": data.String("stratified"),
+					"label_path":    data.String("label"),
+				},
+			}
+			for name, params := range cases {
+				name, params := name, params
+				Convey("Then it should fail with "+name, func() {
+					err := s.SetParams(ctx, params)
+					So(err, ShouldNotBeNil)
+					So(s.params, ShouldResemble, *mlParams)
+					So(len(s.bucket), ShouldEqual, 5)
+				})
+			}
+		})
+	})
+}
+
+func TestPyMLStateStratifiedWrite(t *testing.T) {
+	cc := &core.ContextConfig{}
+	ctx := core.NewContext(cc)
+	Convey("Given a context set pymlstate with a stratified bucket", t, func() {
+		baseParams := &pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "TestClass",
+		}
+		mlParams := &MLParams{
+			BatchSize:    4,
+			BucketPolicy: "stratified",
+			LabelPath:    "label",
+			MaxPerClass:  2,
+		}
+
+		s, err := New(baseParams, mlParams, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		err = ctx.SharedStates.Add("pystate_test", "py", s)
+		So(err, ShouldBeNil)
+		Convey("When write three tuples of the same class", func() {
+			for i := 0; i < 3; i++ {
+				tu := &core.Tuple{
+					Data: data.Map{
+						"data": data.Map{"label": data.String("neg")},
+					},
+				}
+				So(s.Write(ctx, tu), ShouldBeNil)
+			}
+			Convey("Then bucket stats should report capped class counts", func() {
+				st, err := BucketStats(ctx, "pystate_test")
+				So(err, ShouldBeNil)
+				m, err := data.AsMap(st)
+				So(err, ShouldBeNil)
+				So(m["bucket_policy"], ShouldEqual, data.String("stratified"))
+				So(m["bucket_size"], ShouldEqual, data.Int(2))
+				So(m["class_counts"], ShouldResemble, data.Map{"neg": data.Int(2)})
+
+				Convey("And when write one more tuple", func() {
+					tu := &core.Tuple{
+						Data: data.Map{
+							"data": data.Map{"label": data.String("pos")},
+						},
+					}
+					So(s.Write(ctx, tu), ShouldBeNil)
+					Convey("Then fit function should be called and bucket is flushed", func() {
+						ac, err := s.base.Call("confirm_to_call_fit")
+						So(err, ShouldBeNil)
+						So(ac, ShouldEqual, 1)
+						So(len(s.bucket), ShouldEqual, 0)
+					})
+				})
+			})
+		})
+
+		Convey("When write a tuple without a label", func() {
+			tu := &core.Tuple{
+				Data: data.Map{
+					"data": data.Map{"value": data.Int(1)},
+				},
+			}
+			err := s.Write(ctx, tu)
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestPyMLStateLoadKeepsBucket(t *testing.T) {
+	Convey("Given a pymlstate having tuples in its bucket", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize: 10,
+			Backend:   processBackend,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		for _, l := range []string{"a", "b", "a"} {
+			So(s.Write(ctx, &core.Tuple{
+				Data: data.Map{
+					"data": data.Map{"label": data.String(l)},
+				},
+			}), ShouldBeNil)
+		}
+
+		Convey("When load a state having a stratified bucket with a smaller size", func() {
+			s2, err := New(processTestBaseParams, &MLParams{
+				BatchSize:    2,
+				BucketPolicy: stratifiedPolicy,
+				LabelPath:    "label",
+				Backend:      processBackend,
+			}, data.Map{})
+			So(err, ShouldBeNil)
+			buf := bytes.NewBuffer(nil)
+			So(s2.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			So(s2.Terminate(ctx), ShouldBeNil)
+			So(s.Load(ctx, buf, data.Map{}), ShouldBeNil)
+
+			Convey("Then the loaded model should be trained with the full batch", func() {
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+			})
+
+			Convey("Then the rest of tuples should be kept with their labels", func() {
+				So(len(s.bucket), ShouldEqual, 1)
+				sb, ok := s.policy.(*stratifiedBucket)
+				So(ok, ShouldBeTrue)
+				So(sb.labels, ShouldResemble, []string{"a"})
+			})
+		})
+	})
+}
+
+func TestPyMLStateSetParamsTrainsBucket(t *testing.T) {
+	Convey("Given a pymlstate having a partly full bucket", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize: 5,
+			Backend:   processBackend,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		for i := 0; i < 3; i++ {
+			So(s.Write(ctx, &core.Tuple{
+				Data: data.Map{"data": data.Int(i)},
+			}), ShouldBeNil)
+		}
+
+		Convey("When shrink batch_train_size below the size of the bucket", func() {
+			So(s.SetParams(ctx, data.Map{"batch_train_size": data.Int(2)}), ShouldBeNil)
+
+			Convey("Then the model should be trained with a full batch", func() {
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+			})
+
+			Convey("Then the rest of tuples should be kept", func() {
+				So(s.bucket, ShouldResemble, []data.Value{data.Int(2)})
+			})
+		})
+
+		Convey("When set batch_train_size to 1", func() {
+			So(s.SetParams(ctx, data.Map{"batch_train_size": data.Int(1)}), ShouldBeNil)
+
+			Convey("Then the model should be trained with every tuple", func() {
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(3))
+				So(s.bucket, ShouldBeEmpty)
+			})
+		})
+	})
+}
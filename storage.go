@@ -0,0 +1,62 @@
+package pymlstate
+
+import (
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+var (
+	compressionPath       = data.MustCompilePath("compression")
+	encryptionKeyFilePath = data.MustCompilePath("encryption_key_file")
+)
+
+// saveOptions extracts options of the container from parameters of SAVE
+// STATE. It returns the rest of parameters, which are passed to Python.
+//
+// compression:         "none" or "gzip", "none" by default
+//
+// encryption_key_file: a path to a file having a key of AES-GCM, states
+// aren't encrypted by default
+func saveOptions(params data.Map) (*container.Options, data.Map, error) {
+	opts := &container.Options{
+		Compression: container.CompressionNone,
+	}
+	if c, err := params.Get(compressionPath); err == nil {
+		if opts.Compression, err = data.AsString(c); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, rest, err := loadKey(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Key = key
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	delete(rest, "compression")
+	return opts, rest, nil
+}
+
+// loadKey reads the key of AES-GCM from encryption_key_file in parameters
+// of SAVE STATE or LOAD STATE. It returns nil when the parameter isn't
+// given. It also returns the rest of parameters, which are passed to Python.
+func loadKey(params data.Map) ([]byte, data.Map, error) {
+	rest := params.Copy()
+	kf, err := params.Get(encryptionKeyFilePath)
+	if err != nil {
+		return nil, rest, nil
+	}
+	delete(rest, "encryption_key_file")
+
+	path, err := data.AsString(kf)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := container.ReadKeyFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, rest, nil
+}
@@ -0,0 +1,80 @@
+package pymlstate
+
+import (
+	"bytes"
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/pymlstate.v0/container"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveOptions(t *testing.T) {
+	Convey("Given key files", t, func() {
+		dir, err := ioutil.TempDir("", "pymlstate_storage_test")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		key := bytes.Repeat([]byte{3}, 24)
+		rawKeyFile := filepath.Join(dir, "raw_key")
+		So(ioutil.WriteFile(rawKeyFile, key, 0600), ShouldBeNil)
+		hexKeyFile := filepath.Join(dir, "hex_key")
+		So(ioutil.WriteFile(hexKeyFile, []byte(hex.EncodeToString(key)+"\n"), 0600),
+			ShouldBeNil)
+		shortKeyFile := filepath.Join(dir, "short_key")
+		So(ioutil.WriteFile(shortKeyFile, []byte("short"), 0600), ShouldBeNil)
+
+		Convey("When get options from parameters having them", func() {
+			for _, kf := range []string{rawKeyFile, hexKeyFile} {
+				opts, rest, err := saveOptions(data.Map{
+					"compression":         data.String("gzip"),
+					"encryption_key_file": data.String(kf),
+					"other":               data.Int(1),
+				})
+
+				Convey("Then the options should be returned with "+filepath.Base(kf), func() {
+					So(err, ShouldBeNil)
+					So(opts.Compression, ShouldEqual, container.CompressionGzip)
+					So(opts.Key, ShouldResemble, key)
+				})
+
+				Convey("Then they should be removed from parameters passed to Python with "+filepath.Base(kf), func() {
+					So(rest, ShouldResemble, data.Map{"other": data.Int(1)})
+				})
+			}
+		})
+
+		Convey("When get options from empty parameters", func() {
+			params := data.Map{}
+			opts, rest, err := saveOptions(params)
+
+			Convey("Then the state should not be compressed nor encrypted", func() {
+				So(err, ShouldBeNil)
+				So(opts.Compression, ShouldEqual, container.CompressionNone)
+				So(opts.Key, ShouldBeNil)
+				So(rest, ShouldResemble, params)
+			})
+		})
+
+		Convey("When get options from invalid parameters", func() {
+			cases := map[string]data.Map{
+				"unknown compression": {"compression": data.String("zip")},
+				"short key":           {"encryption_key_file": data.String(shortKeyFile)},
+				"missing key file": {
+					"encryption_key_file": data.String(filepath.Join(dir, "none")),
+				},
+			}
+			for name, params := range cases {
+				params := params
+				Convey("Then it should fail with "+name, func() {
+					_, _, err := saveOptions(params)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
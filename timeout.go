@@ -0,0 +1,137 @@
+package pymlstate
+
+import (
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// canceler is implemented by models whose calls can be aborted.
+type canceler interface {
+	// callWithCancel is Call which is aborted when cancel is closed. Only
+	// the call is aborted, and other calls aren't affected by cancel.
+	callWithCancel(cancel <-chan struct{}, name string, args ...data.Value) (data.Value, error)
+}
+
+// abandonedCalls has calls which timed out but haven't returned yet.
+type abandonedCalls struct {
+	mu    sync.Mutex
+	calls map[model]*abandoned
+}
+
+type abandoned struct {
+	n    int
+	name string
+}
+
+// check returns an error when a call to m which timed out is still running.
+func (a *abandonedCalls) check(m model) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.calls[m]; ok {
+		return fmt.Errorf("%v of pymlstate which timed out is still running", c.name)
+	}
+	return nil
+}
+
+func (a *abandonedCalls) add(m model, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.calls == nil {
+		a.calls = map[model]*abandoned{}
+	}
+	c, ok := a.calls[m]
+	if !ok {
+		c = &abandoned{}
+		a.calls[m] = c
+	}
+	c.n++
+	c.name = name
+}
+
+func (a *abandonedCalls) remove(m model) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.calls[m]; ok {
+		if c.n--; c.n == 0 {
+			delete(a.calls, m)
+		}
+	}
+}
+
+// call calls a method of the model. When timeout is greater than 0 and the
+// call doesn't return in time, it returns an error and marks the state
+// unhealthy. The call is aborted when the model supports it. Otherwise, it
+// keeps running in the background and its result is discarded. Until the
+// call which timed out returns, new calls to the model fail immediately
+// instead of piling up behind it. A successful call marks the state healthy
+// again.
+func (s *State) call(ctx *core.Context, m model, timeout time.Duration, name string,
+	args ...data.Value) (data.Value, error) {
+	if r, ok := m.(restarter); ok {
+		// the call may restart the process
+		defer r.logRestarts(ctx)
+	}
+	if timeout <= 0 {
+		v, err := m.Call(name, args...)
+		return s.called(name, v, err)
+	}
+	if err := s.abandoned.check(m); err != nil {
+		s.recordCall(name, err)
+		return nil, err
+	}
+
+	type result struct {
+		v   data.Value
+		err error
+	}
+	ch := make(chan result, 1)
+	cancel := make(chan struct{})
+	go func() {
+		var v data.Value
+		var err error
+		if c, ok := m.(canceler); ok {
+			v, err = c.callWithCancel(cancel, name, args...)
+		} else {
+			v, err = m.Call(name, args...)
+		}
+		ch <- result{v, err}
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return s.called(name, r.v, r.err)
+	case <-t.C:
+	}
+
+	atomic.StoreUint32(&s.unhealthy, 1)
+	close(cancel)
+	s.abandoned.add(m, name)
+	go func() {
+		<-ch
+		s.abandoned.remove(m)
+	}()
+	err := fmt.Errorf("%v of pymlstate didn't return in %v", name, timeout)
+	s.recordCall(name, err)
+	ctx.ErrLog(err).WithField("method", name).Error("pymlstate's call timed out")
+	return nil, err
+}
+
+func (s *State) called(name string, v data.Value, err error) (data.Value, error) {
+	s.recordCall(name, err)
+	if err == nil {
+		atomic.StoreUint32(&s.unhealthy, 0)
+	}
+	return v, err
+}
+
+// healthy returns false when a call to the model timed out and no call has
+// succeeded since then.
+func (s *State) healthy() bool {
+	return atomic.LoadUint32(&s.unhealthy) == 0
+}
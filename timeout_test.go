@@ -0,0 +1,216 @@
+package pymlstate
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"testing"
+	"time"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	Convey("Given parameters of timeouts", t, func() {
+		params := data.Map{
+			"predict_timeout": data.String("500ms"),
+			"fit_timeout":     data.Int(30),
+		}
+
+		Convey("When parse them", func() {
+			mp := MLParams{BatchSize: 1}
+			So(parseMLParams(params, &mp), ShouldBeNil)
+
+			Convey("Then MLParams should have them", func() {
+				So(mp.PredictTimeout, ShouldEqual, 500*time.Millisecond)
+				So(mp.FitTimeout, ShouldEqual, 30*time.Second)
+				So(params, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When parse a non-positive timeout", func() {
+			err := parseMLParams(data.Map{"predict_timeout": data.Int(0)},
+				&MLParams{BatchSize: 1})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestPyMLStateTimeout(t *testing.T) {
+	Convey("Given a pymlstate with a slow model", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(&pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "SlowClass",
+		}, &MLParams{
+			BatchSize:      1,
+			PredictTimeout: 100 * time.Millisecond,
+			FitTimeout:     100 * time.Millisecond,
+		}, data.Map{"delay": data.Float(1)})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When predict", func() {
+			start := time.Now()
+			_, err := s.Predict(ctx, data.String("a"))
+
+			Convey("Then it should time out", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "predict")
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+
+			Convey("Then the state should be unhealthy", func() {
+				So(s.healthy(), ShouldBeFalse)
+			})
+
+			Convey("And predict again before the call returns", func() {
+				start := time.Now()
+				_, err := s.Predict(ctx, data.String("a"))
+
+				Convey("Then it should fail immediately", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "still running")
+					So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+				})
+			})
+
+			Convey("And predict with a longer timeout", func() {
+				waitAbandonedCalls(s)
+				So(s.SetParams(ctx, data.Map{"predict_timeout": data.Int(5)}), ShouldBeNil)
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+
+				Convey("Then the state should be healthy again", func() {
+					So(s.healthy(), ShouldBeTrue)
+				})
+			})
+		})
+
+		Convey("When fit", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+
+			Convey("Then it should time out", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "fit")
+				So(s.healthy(), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+// waitAbandonedCalls waits until calls to the primary model which timed out
+// return.
+func waitAbandonedCalls(s *State) {
+	for i := 0; i < 500 && s.abandoned.check(s.base) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	So(s.abandoned.check(s.base), ShouldBeNil)
+}
+
+func TestProcessBackendTimeout(t *testing.T) {
+	Convey("Given a pymlstate with a slow model on the process backend", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:      1,
+			Backend:        processBackend,
+			PredictTimeout: 200 * time.Millisecond,
+			FitTimeout:     200 * time.Millisecond,
+		}, data.Map{"delay": data.Int(10)})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When predict", func() {
+			_, err := s.Predict(ctx, data.String("a"))
+			So(err, ShouldNotBeNil)
+
+			Convey("Then the call should be interrupted", func() {
+				start := time.Now()
+				_, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+				So(s.healthy(), ShouldBeFalse)
+			})
+		})
+
+		Convey("When score", func() {
+			start := time.Now()
+			_, err := s.Score(ctx, []data.Value{data.String("a")})
+
+			Convey("Then it should time out after fit_timeout", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "score")
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+				So(s.healthy(), ShouldBeFalse)
+			})
+		})
+
+		Convey("When score a terminated state", func() {
+			So(s.Terminate(ctx), ShouldBeNil)
+			_, err := s.Score(ctx, []data.Value{data.String("a")})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a pymlstate on the process backend running a long call", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:      1,
+			Backend:        processBackend,
+			PredictTimeout: 200 * time.Millisecond,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		_, err = s.Fit(ctx, []data.Value{data.String("a")})
+		So(err, ShouldBeNil)
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.base.Call("sleep", data.Int(1))
+			done <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		Convey("When predict times out waiting for the long call", func() {
+			_, err := s.Predict(ctx, data.String("a"))
+			So(err, ShouldNotBeNil)
+			start := time.Now()
+			_, rerr := s.Predict(ctx, data.String("a"))
+			rejected := time.Since(start)
+
+			Convey("Then the long call should not be killed", func() {
+				So(<-done, ShouldBeNil)
+				n, err := s.base.Call("confirm_to_call_fit")
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, data.Int(1))
+				So(s.restarts(), ShouldEqual, 0)
+			})
+
+			Convey("Then predictions should fail immediately until the call returns", func() {
+				So(rerr, ShouldNotBeNil)
+				So(rerr.Error(), ShouldContainSubstring, "still running")
+				So(rejected, ShouldBeLessThan, 100*time.Millisecond)
+			})
+
+			Convey("Then predictions should succeed after the call returns", func() {
+				So(<-done, ShouldBeNil)
+				waitAbandonedCalls(s)
+				res, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+				So(res, ShouldEqual, data.String("a"))
+				So(s.healthy(), ShouldBeTrue)
+			})
+		})
+	})
+}
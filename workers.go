@@ -0,0 +1,158 @@
+package pymlstate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"sync/atomic"
+)
+
+// numWorkers returns the number of model instances including the primary.
+func (p *MLParams) numWorkers() int {
+	if p.Workers <= 0 {
+		return 1
+	}
+	return p.Workers
+}
+
+// defaultWorkerSyncInterval is the default number of trainings between two
+// syncs of replicas. A sync saves the primary model and loads it to all
+// replicas, so it isn't done after every training by default.
+const defaultWorkerSyncInterval = 10
+
+// syncInterval returns the number of trainings between two syncs of
+// replicas.
+func (p *MLParams) syncInterval() int {
+	if p.WorkerSyncInterval <= 0 {
+		return defaultWorkerSyncInterval
+	}
+	return p.WorkerSyncInterval
+}
+
+// checkWorkers returns an error when the in-process backend has replicas.
+// Replicas in the same process share the GIL of Python and don't predict in
+// parallel.
+func (p *MLParams) checkWorkers() error {
+	if p.numWorkers() > 1 && p.backendOf() != processBackend {
+		return errors.New("workers can only be used with the process backend")
+	}
+	return nil
+}
+
+// predictor returns a model instance used by the next prediction. Instances
+// are selected in round-robin order. Replicas are synced before the
+// prediction when the primary model has been trained worker_sync_interval
+// times since the last sync. The state must be locked.
+func (s *State) predictor(ctx *core.Context) model {
+	if len(s.replicas) == 0 {
+		return s.base
+	}
+	i := int(atomic.AddUint32(&s.nextWorker, 1) % uint32(len(s.replicas)+1))
+	if i == 0 {
+		return s.base
+	}
+	if err := s.syncWorkers(ctx); err != nil {
+		// replicas keep predicting with the previous model
+		ctx.ErrLog(err).Error("pymlstate cannot sync replicas of the model")
+	}
+	return s.replicas[i-1]
+}
+
+// savePrimary returns the payload of the primary model.
+func (s *State) savePrimary(ctx *core.Context) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := s.base.Save(ctx, buf, data.Map{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeWorkers creates or terminates replicas so that the state has as many
+// model instances as workers. All replicas are loaded from the payload of
+// the primary model. The state must be locked or not shared yet.
+func (s *State) resizeWorkers(ctx *core.Context) error {
+	n := s.params.numWorkers() - 1
+	if n == 0 && len(s.replicas) == 0 {
+		return nil
+	}
+	var payload []byte
+	if n > 0 {
+		var err error
+		if payload, err = s.savePrimary(ctx); err != nil {
+			return err
+		}
+	}
+	return s.loadReplicas(ctx, payload, data.Map{})
+}
+
+// loadReplicas loads the payload of the model to replicas. Replicas are
+// created or terminated so that the state has as many model instances as
+// workers. The state must be locked or not shared yet.
+func (s *State) loadReplicas(ctx *core.Context, payload []byte, params data.Map) error {
+	n := s.params.numWorkers() - 1
+	for len(s.replicas) > n {
+		last := s.replicas[len(s.replicas)-1]
+		s.replicas = s.replicas[:len(s.replicas)-1]
+		if err := last.Terminate(ctx); err != nil {
+			ctx.ErrLog(err).Warn("Cannot terminate a replica of pymlstate")
+		}
+	}
+
+	for i, r := range s.replicas {
+		if err := r.Load(ctx, bytes.NewReader(payload), params); err != nil {
+			return fmt.Errorf("cannot load replica %v: %v", i+1, err)
+		}
+	}
+	for len(s.replicas) < n {
+		r, err := loadModel(ctx, &s.params, bytes.NewReader(payload), params)
+		if err != nil {
+			return fmt.Errorf("cannot create replica %v: %v", len(s.replicas)+1, err)
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	s.synced = atomic.LoadUint64(&s.trained)
+	return nil
+}
+
+// syncWorkers loads the primary model to replicas when it has been trained
+// worker_sync_interval times since the last sync. Replicas are synced lazily
+// by predictions so that trainings don't pay for it. It's called with the
+// read lock or the write lock of the state. Only one prediction syncs
+// replicas at a time, and other predictions don't wait for it but use
+// replicas as they are. A replica being loaded serves predictions after its
+// load, so they wait only for the load of the replica. A failed sync isn't
+// retried until the next worker_sync_interval trainings.
+func (s *State) syncWorkers(ctx *core.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.syncing, 0, 1) {
+		// another prediction is syncing replicas
+		return nil
+	}
+	defer atomic.StoreUint32(&s.syncing, 0)
+	trained := atomic.LoadUint64(&s.trained)
+	if trained-s.synced < uint64(s.params.syncInterval()) {
+		return nil
+	}
+	s.synced = trained
+	payload, err := s.savePrimary(ctx)
+	if err != nil {
+		return err
+	}
+	for i, r := range s.replicas {
+		if err := r.Load(ctx, bytes.NewReader(payload), data.Map{}); err != nil {
+			return fmt.Errorf("cannot sync replica %v: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// terminateReplicas terminates all replicas. The state must be locked.
+func (s *State) terminateReplicas(ctx *core.Context) {
+	for _, r := range s.replicas {
+		if err := r.Terminate(ctx); err != nil {
+			ctx.ErrLog(err).Warn("Cannot terminate a replica of pymlstate")
+		}
+	}
+	s.replicas = nil
+}
@@ -0,0 +1,217 @@
+package pymlstate
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/sensorbee/py.v0/pystate"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStateWorkers(t *testing.T) {
+	Convey("Given a pymlstate with three workers", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:          10,
+			Backend:            processBackend,
+			Workers:            3,
+			WorkerSyncInterval: 2,
+		}, data.Map{})
+		So(err, ShouldBeNil)
+		So(s.resizeWorkers(ctx), ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When predict repeatedly", func() {
+			used := map[model]int{}
+			for i := 0; i < 6; i++ {
+				used[s.predictor(ctx)]++
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then predictions should be distributed to all instances", func() {
+				So(len(s.replicas), ShouldEqual, 2)
+				So(len(used), ShouldEqual, 3)
+				for _, n := range used {
+					So(n, ShouldEqual, 2)
+				}
+			})
+		})
+
+		Convey("When train the primary model worker_sync_interval times", func() {
+			for i := 0; i < 2; i++ {
+				_, err := s.Fit(ctx, []data.Value{data.String("a")})
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then replicas should not be synced by trainings", func() {
+				for _, r := range s.replicas {
+					n, err := r.Call("confirm_to_call_fit")
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 0)
+				}
+			})
+
+			Convey("And when predict with replicas", func() {
+				for i := 0; i < 3; i++ {
+					_, err := s.Predict(ctx, data.String("a"))
+					So(err, ShouldBeNil)
+				}
+
+				Convey("Then replicas should be synced", func() {
+					for _, r := range s.replicas {
+						n, err := r.Call("confirm_to_call_fit")
+						So(err, ShouldBeNil)
+						So(n, ShouldEqual, 2)
+					}
+				})
+			})
+		})
+
+		Convey("When train the primary model less than worker_sync_interval times", func() {
+			_, err := s.Fit(ctx, []data.Value{data.String("a")})
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				_, err := s.Predict(ctx, data.String("a"))
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then replicas should not be synced", func() {
+				for _, r := range s.replicas {
+					n, err := r.Call("confirm_to_call_fit")
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 0)
+				}
+			})
+		})
+
+		Convey("When decrease workers", func() {
+			So(s.SetParams(ctx, data.Map{"workers": data.Int(2)}), ShouldBeNil)
+
+			Convey("Then a replica should be terminated", func() {
+				So(len(s.replicas), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When save and load the state", func() {
+			buf := bytes.NewBuffer(nil)
+			So(s.Save(ctx, buf, data.Map{}), ShouldBeNil)
+			s2 := &State{}
+			So(s2.load(ctx, buf, data.Map{}), ShouldBeNil)
+			Reset(func() {
+				s2.Terminate(ctx)
+			})
+
+			Convey("Then the loaded state should have the same workers", func() {
+				So(s2.params.Workers, ShouldEqual, 3)
+				So(len(s2.replicas), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When set invalid workers", func() {
+			err := s.SetParams(ctx, data.Map{"workers": data.Int(0)})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(len(s.replicas), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given a pymlstate with workers whose model is saved slowly", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(processTestBaseParams, &MLParams{
+			BatchSize:          10,
+			Backend:            processBackend,
+			Workers:            3,
+			WorkerSyncInterval: 1,
+		}, data.Map{"save_delay": data.Float(0.5)})
+		So(err, ShouldBeNil)
+		So(s.resizeWorkers(ctx), ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+		_, err = s.Fit(ctx, []data.Value{data.String("a")})
+		So(err, ShouldBeNil)
+
+		Convey("When predict while a prediction is syncing replicas", func() {
+			// the next prediction uses the first replica and syncs replicas
+			atomic.StoreUint32(&s.nextWorker, 0)
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.Predict(ctx, data.String("a"))
+				done <- err
+			}()
+			for atomic.LoadUint32(&s.syncing) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			start := time.Now()
+			_, err := s.Predict(ctx, data.String("a"))
+			elapsed := time.Since(start)
+			So(<-done, ShouldBeNil)
+
+			Convey("Then it should use the replica without waiting for the sync", func() {
+				So(err, ShouldBeNil)
+				So(elapsed, ShouldBeLessThan, 250*time.Millisecond)
+			})
+
+			Convey("Then replicas should be synced by the first prediction", func() {
+				for _, r := range s.replicas {
+					n, err := r.Call("confirm_to_call_fit")
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 1)
+				}
+			})
+		})
+	})
+
+	Convey("Given a pymlstate of the inprocess backend", t, func() {
+		ctx := core.NewContext(&core.ContextConfig{})
+		s, err := New(&pystate.BaseParams{
+			ModulePath: "./",
+			ModuleName: "_test_pymlstate",
+			ClassName:  "TestClass",
+		}, &MLParams{BatchSize: 10}, data.Map{})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			s.Terminate(ctx)
+		})
+
+		Convey("When set workers", func() {
+			err := s.SetParams(ctx, data.Map{"workers": data.Int(2)})
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "process backend")
+				So(s.params.Workers, ShouldEqual, 0)
+				So(s.replicas, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When parse workers without the process backend", func() {
+			params := data.Map{"workers": data.Int(2)}
+			mp := &MLParams{}
+			So(parseMLParams(params, mp), ShouldBeNil)
+			err := parseBackendParams(params, mp, false)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When parse a worker without the process backend", func() {
+			params := data.Map{"workers": data.Int(1)}
+			mp := &MLParams{}
+			So(parseMLParams(params, mp), ShouldBeNil)
+
+			Convey("Then it should succeed", func() {
+				So(parseBackendParams(params, mp, false), ShouldBeNil)
+			})
+		})
+	})
+}